@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	_ "embed"
 	"errors"
 	"flag"
@@ -13,23 +12,23 @@ import (
 	"github.com/hashicorp/logutils"
 	"github.com/hellofresh/health-go/v5"
 	"github.com/kelseyhightower/envconfig"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/piraces/rsslay/internal/handlers"
+	"github.com/piraces/rsslay/pkg/contacts"
 	"github.com/piraces/rsslay/pkg/custom_cache"
 	"github.com/piraces/rsslay/pkg/events"
 	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/helpers"
 	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/poller"
 	"github.com/piraces/rsslay/pkg/replayer"
-	"github.com/piraces/rsslay/scripts"
+	"github.com/piraces/rsslay/pkg/storage"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/exp/slices"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"sync"
 	"time"
 )
 
@@ -41,33 +40,64 @@ var (
 const assetsDir = "/assets/"
 
 type Relay struct {
-	Secret                          string   `envconfig:"SECRET" required:"true"`
-	DatabaseDirectory               string   `envconfig:"DB_DIR" default:"db/rsslay.sqlite"`
-	DefaultProfilePictureUrl        string   `envconfig:"DEFAULT_PROFILE_PICTURE_URL" default:"https://i.imgur.com/MaceU96.png"`
-	Version                         string   `envconfig:"VERSION" default:"unknown"`
-	ReplayToRelays                  bool     `envconfig:"REPLAY_TO_RELAYS" default:"false"`
-	RelaysToPublish                 []string `envconfig:"RELAYS_TO_PUBLISH_TO" default:""`
-	NitterInstances                 []string `envconfig:"NITTER_INSTANCES" default:""`
-	DefaultWaitTimeBetweenBatches   int64    `envconfig:"DEFAULT_WAIT_TIME_BETWEEN_BATCHES" default:"60000"`
-	DefaultWaitTimeForRelayResponse int64    `envconfig:"DEFAULT_WAIT_TIME_FOR_RELAY_RESPONSE" default:"3000"`
-	MaxEventsToReplay               int      `envconfig:"MAX_EVENTS_TO_REPLAY" default:"20"`
-	EnableAutoNIP05Registration     bool     `envconfig:"ENABLE_AUTO_NIP05_REGISTRATION" default:"false"`
-	MainDomainName                  string   `envconfig:"MAIN_DOMAIN_NAME" default:""`
-	OwnerPublicKey                  string   `envconfig:"OWNER_PUBLIC_KEY" default:""`
-	MaxSubroutines                  int      `envconfig:"MAX_SUBROUTINES" default:"20"`
-	RelayName                       string   `envconfig:"INFO_RELAY_NAME" default:"rsslay"`
-	Contact                         string   `envconfig:"INFO_CONTACT" default:"~"`
-	MaxContentLength                int      `envconfig:"MAX_CONTENT_LENGTH" default:"250"`
-	DeleteFailingFeeds              bool     `envconfig:"DELETE_FAILING_FEEDS" default:"false"`
-	RedisConnectionString           string   `envconfig:"REDIS_CONNECTION_STRING" default:""`
-
-	updates            chan nostr.Event
-	lastEmitted        sync.Map
-	db                 *sql.DB
-	healthCheck        *health.Health
-	mutex              sync.Mutex
-	routineQueueLength int
-	cache              *cache.Cache[string]
+	Secret                          string             `envconfig:"SECRET" required:"true"`
+	DatabaseDirectory               string             `envconfig:"DB_DIR" default:"db/rsslay.sqlite"`
+	DefaultProfilePictureUrl        string             `envconfig:"DEFAULT_PROFILE_PICTURE_URL" default:"https://i.imgur.com/MaceU96.png"`
+	Version                         string             `envconfig:"VERSION" default:"unknown"`
+	ReplayToRelays                  bool               `envconfig:"REPLAY_TO_RELAYS" default:"false"`
+	RelaysToPublish                 []string           `envconfig:"RELAYS_TO_PUBLISH_TO" default:""`
+	NitterInstances                 []string           `envconfig:"NITTER_INSTANCES" default:""`
+	DefaultWaitTimeBetweenBatches   int64              `envconfig:"DEFAULT_WAIT_TIME_BETWEEN_BATCHES" default:"60000"`
+	DefaultWaitTimeForRelayResponse int64              `envconfig:"DEFAULT_WAIT_TIME_FOR_RELAY_RESPONSE" default:"3000"`
+	MaxEventsToReplay               int                `envconfig:"MAX_EVENTS_TO_REPLAY" default:"20"`
+	ReplayMaxAttempts               int                `envconfig:"REPLAY_MAX_ATTEMPTS" default:"10"`
+	ReplayMinBackoff                int64              `envconfig:"REPLAY_MIN_BACKOFF" default:"60"`
+	ReplayMaxBackoff                int64              `envconfig:"REPLAY_MAX_BACKOFF" default:"21600"`
+	ReplayPauseAfterRejections      int                `envconfig:"REPLAY_PAUSE_AFTER_REJECTIONS" default:"20"`
+	ReplayPauseDuration             int64              `envconfig:"REPLAY_PAUSE_DURATION" default:"3600"`
+	ReplayQueueSize                 int                `envconfig:"REPLAY_QUEUE_SIZE" default:"100"`
+	ReplayWorkers                   int                `envconfig:"REPLAY_WORKERS" default:"20"`
+	ReplayQueuePolicy               string             `envconfig:"REPLAY_QUEUE_POLICY" default:"block"`
+	EnableAutoNIP05Registration     bool               `envconfig:"ENABLE_AUTO_NIP05_REGISTRATION" default:"false"`
+	MainDomainName                  string             `envconfig:"MAIN_DOMAIN_NAME" default:""`
+	OwnerPublicKey                  string             `envconfig:"OWNER_PUBLIC_KEY" default:""`
+	ModeratorPublicKeys             []string           `envconfig:"MODERATOR_PUBLIC_KEYS" default:""`
+	MaxSubroutines                  int                `envconfig:"MAX_SUBROUTINES" default:"20"`
+	RelayName                       string             `envconfig:"INFO_RELAY_NAME" default:"rsslay"`
+	Contact                         string             `envconfig:"INFO_CONTACT" default:"~"`
+	MaxContentLength                int                `envconfig:"MAX_CONTENT_LENGTH" default:"250"`
+	DeleteFailingFeeds              bool               `envconfig:"DELETE_FAILING_FEEDS" default:"false"`
+	RedisConnectionString           string             `envconfig:"REDIS_CONNECTION_STRING" default:""`
+	DefaultFetchInterval            int                `envconfig:"DEFAULT_FETCH_INTERVAL" default:"20"`
+	MinFetchInterval                int                `envconfig:"MIN_FETCH_INTERVAL" default:"5"`
+	MaxFetchInterval                int                `envconfig:"MAX_FETCH_INTERVAL" default:"1440"`
+	MaxFeedsPerPoll                 int                `envconfig:"MAX_FEEDS_PER_POLL" default:"50"`
+	FetchConcurrency                int                `envconfig:"FETCH_CONCURRENCY" default:"10"`
+	QueryFetchDeadline              int64              `envconfig:"QUERY_FETCH_DEADLINE" default:"3000"`
+	EnableLongFormEvents            bool               `envconfig:"ENABLE_LONG_FORM_EVENTS" default:"false"`
+	LongFormEventsOnly              bool               `envconfig:"LONG_FORM_EVENTS_ONLY" default:"false"`
+	EnablePodcastEvents             bool               `envconfig:"ENABLE_PODCAST_EVENTS" default:"true"`
+	MaxQueryLimit                   int                `envconfig:"MAX_QUERY_LIMIT" default:"500"`
+	FetchUserAgent                  string             `envconfig:"FETCH_USER_AGENT" default:""`
+	FetchRatePerHost                float64            `envconfig:"FETCH_RATE_PER_HOST" default:"1"`
+	FetchBurstPerHost               int                `envconfig:"FETCH_BURST_PER_HOST" default:"5"`
+	FetchHostRates                  map[string]float64 `envconfig:"FETCH_HOST_RATES" default:""`
+	FetchAllowedAddresses           []string           `envconfig:"FETCH_ALLOWED_ADDRESSES" default:""`
+	FeedAllowedDomains              []string           `envconfig:"FEED_ALLOWED_DOMAINS" default:""`
+	FeedBlockedDomains              []string           `envconfig:"FEED_BLOCKED_DOMAINS" default:""`
+	MaxHashtags                     int                `envconfig:"MAX_HASHTAGS" default:"5"`
+	HashtagsInContent               bool               `envconfig:"HASHTAGS_IN_CONTENT" default:"false"`
+	ContactListRelays               []string           `envconfig:"CONTACT_LIST_RELAYS" default:"wss://relay.damus.io,wss://nos.lol,wss://relay.nostr.band"`
+	FollowsExportsPerMinute         int                `envconfig:"FOLLOWS_EXPORTS_PER_MINUTE" default:"5"`
+	OPMLImportsPerMinute            int                `envconfig:"OPML_IMPORTS_PER_MINUTE" default:"1"`
+	TrustedProxies                  []string           `envconfig:"TRUSTED_PROXIES" default:""`
+
+	updates     chan nostr.Event
+	store       storage.Storage
+	healthCheck *health.Health
+	cache       *cache.Cache[string]
+	poller      *poller.Poller
+	outbox      *replayer.Outbox
 }
 
 var relayInstance = &Relay{
@@ -112,25 +142,81 @@ func (r *Relay) Name() string {
 
 func (r *Relay) OnInitialized(s *relayer.Server) {
 	s.Router().Path("/").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleWebpage(writer, request, r.db, &r.MainDomainName)
+		handlers.HandleWebpage(writer, request, r.store, &r.MainDomainName)
 	})
 	s.Router().Path("/create").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleCreateFeed(writer, request, r.db, &r.Secret, dsn)
+		handlers.HandleCreateFeed(writer, request, r.store, &r.Secret, dsn)
+	})
+	s.Router().Path("/import").Methods(http.MethodPost).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleImportOPML(writer, request, r.store, &r.Secret, dsn)
 	})
 	s.Router().Path("/search").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleSearch(writer, request, r.db)
+		handlers.HandleSearch(writer, request, r.store)
 	})
 	s.Router().
 		PathPrefix(assetsDir).
 		Handler(http.StripPrefix(assetsDir, http.FileServer(http.Dir("./web/"+assetsDir))))
 	s.Router().Path("/healthz").HandlerFunc(relayInstance.healthCheck.HandlerFunc)
 	s.Router().Path("/api/feed").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleApiFeed(writer, request, r.db, &r.Secret, dsn)
+		handlers.HandleApiFeed(writer, request, r.store, &r.Secret, dsn)
+	})
+	s.Router().Path("/api/opml").Methods(http.MethodGet).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleExportOPML(writer, request, r.store)
+	})
+	s.Router().Path("/api/opml").Methods(http.MethodPost).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleApiImportOPML(writer, request, r.store, &r.Secret, dsn)
+	})
+	s.Router().Path("/api/feeds").Methods(http.MethodGet).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleApiFeeds(writer, request, r.store)
+	})
+	s.Router().Path("/api/feeds/search").Methods(http.MethodGet).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleApiFeedSearch(writer, request, r.store)
+	})
+	s.Router().Path("/api/feeds/{pubkey}").Methods(http.MethodGet).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleApiFeedByPubKey(writer, request, r.store)
 	})
 	s.Router().Path("/.well-known/nostr.json").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleNip05(writer, request, r.db, &r.OwnerPublicKey, &r.EnableAutoNIP05Registration)
+		handlers.HandleNip05(writer, request, r.store, &r.OwnerPublicKey, &r.EnableAutoNIP05Registration)
 	})
 	s.Router().Path("/metrics").Handler(promhttp.Handler())
+
+	admin := &handlers.AdminAPI{
+		Store:   r.store,
+		PubKeys: r.adminPubKeys(),
+		Refresh: func(pubKey string) error {
+			return r.poller.ForceRefresh(pubKey)
+		},
+		DSN:    dsn,
+		Outbox: r.outbox,
+	}
+	admin.Routes(s.Router())
+
+	follows := &handlers.FollowsAPI{
+		Store: r.store,
+		ContactList: func(ctx context.Context, pubKey string) (*nostr.Event, error) {
+			return contacts.FetchContactList(ctx, r.ContactListRelays, pubKey)
+		},
+		RequestsPerMinute: r.FollowsExportsPerMinute,
+	}
+	follows.Routes(s.Router())
+}
+
+// adminPubKeys returns the owner and moderator public keys, skipping the ones
+// that are not valid.
+func (r *Relay) adminPubKeys() []string {
+	var pubKeys []string
+	for _, value := range append([]string{r.OwnerPublicKey}, r.ModeratorPublicKeys...) {
+		if value == "" {
+			continue
+		}
+		pubKey, err := helpers.ParsePubKey(value)
+		if err != nil {
+			log.Printf("[WARN] ignoring admin public key %q: %v", value, err)
+			continue
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return pubKeys
 }
 
 func (r *Relay) Init() error {
@@ -142,65 +228,117 @@ func (r *Relay) Init() error {
 		log.Printf("[INFO] Running VERSION %s:\n - DSN=%s\n - DB_DIR=%s\n\n", r.Version, *dsn, r.DatabaseDirectory)
 	}
 
+	if r.RelaysToPublish, err = feed.NormalizeRelayURLs(r.RelaysToPublish); err != nil {
+		return fmt.Errorf("couldn't process RELAYS_TO_PUBLISH_TO: %w", err)
+	}
+
 	ConfigureCache()
-	r.db = InitDatabase(r)
+	feed.ConfigurePoliteness(feed.Politeness{
+		UserAgent:             r.userAgent(),
+		RequestsPerSecond:     r.FetchRatePerHost,
+		Burst:                 r.FetchBurstPerHost,
+		HostRequestsPerSecond: r.FetchHostRates,
+	})
+	if err := feed.AllowAddresses(r.FetchAllowedAddresses); err != nil {
+		return fmt.Errorf("couldn't process FETCH_ALLOWED_ADDRESSES: %w", err)
+	}
+	if err := helpers.TrustProxies(r.TrustedProxies); err != nil {
+		return fmt.Errorf("couldn't process TRUSTED_PROXIES: %w", err)
+	}
+	handlers.LimitOPMLImports(r.OPMLImportsPerMinute)
+	if err := r.configureDomainPolicy(); err != nil {
+		return err
+	}
+	r.store = InitDatabase(r)
+
+	r.poller = &poller.Poller{
+		Store:              r.store,
+		Updates:            r.updates,
+		Options:            r.eventOptions(),
+		DeleteFailingFeeds: r.DeleteFailingFeeds,
+		NitterInstances:    r.NitterInstances,
+		DefaultInterval:    time.Duration(r.DefaultFetchInterval) * time.Minute,
+		MinInterval:        time.Duration(r.MinFetchInterval) * time.Minute,
+		MaxInterval:        time.Duration(r.MaxFetchInterval) * time.Minute,
+		MaxFeedsPerPoll:    r.MaxFeedsPerPoll,
+		Concurrency:        r.FetchConcurrency,
+		QueryDeadline:      time.Duration(r.QueryFetchDeadline) * time.Millisecond,
+		OnNewEvents:        r.AttemptReplayEvents,
+	}
+	r.poller.Start()
 
-	go r.UpdateListeningFilters()
+	if r.ReplayToRelays {
+		if err := replayer.CheckPolicy(r.ReplayQueuePolicy); err != nil {
+			return err
+		}
+		r.outbox = &replayer.Outbox{
+			Store:         r.store,
+			Relays:        r.RelaysToPublish,
+			Workers:       r.ReplayWorkers,
+			QueueSize:     r.ReplayQueueSize,
+			QueuePolicy:   r.ReplayQueuePolicy,
+			BatchSize:     r.MaxEventsToReplay,
+			Interval:      time.Duration(r.DefaultWaitTimeBetweenBatches) * time.Millisecond,
+			Timeout:       time.Duration(r.DefaultWaitTimeForRelayResponse) * time.Millisecond,
+			MinBackoff:    time.Duration(r.ReplayMinBackoff) * time.Second,
+			MaxBackoff:    time.Duration(r.ReplayMaxBackoff) * time.Second,
+			MaxAttempts:   r.ReplayMaxAttempts,
+			PauseAfter:    r.ReplayPauseAfterRejections,
+			PauseDuration: time.Duration(r.ReplayPauseDuration) * time.Second,
+		}
+		r.outbox.Start()
+	}
 
 	return nil
 }
 
-func (r *Relay) UpdateListeningFilters() {
-	for {
-		time.Sleep(20 * time.Minute)
-		metrics.ListeningFiltersOps.Inc()
-
-		filters := relayer.GetListeningFilters()
-		log.Printf("[DEBUG] Checking for updates; %d filters active", len(filters))
-
-		var parsedEvents []replayer.EventWithPrivateKey
-		for _, filter := range filters {
-			if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-				for _, pubkey := range filter.Authors {
-					parsedFeed, entity := events.GetParsedFeedForPubKey(pubkey, r.db, r.DeleteFailingFeeds, r.NitterInstances)
-					if parsedFeed == nil {
-						continue
-					}
-
-					for _, item := range parsedFeed.Items {
-						defaultCreatedAt := time.Unix(time.Now().Unix(), 0)
-						evt := feed.ItemToTextNote(pubkey, item, parsedFeed, defaultCreatedAt, entity.URL, relayInstance.MaxContentLength)
-						last, ok := r.lastEmitted.Load(entity.URL)
-						if last == nil {
-							last = uint32(time.Now().Unix())
-						}
-						if !ok || nostr.Timestamp(int64(last.(uint32))) < evt.CreatedAt {
-							_ = evt.Sign(entity.PrivateKey)
-							r.updates <- evt
-							r.lastEmitted.Store(entity.URL, last.(uint32))
-							parsedEvents = append(parsedEvents, replayer.EventWithPrivateKey{Event: &evt, PrivateKey: entity.PrivateKey})
-						}
-					}
-				}
-			}
-		}
-		r.AttemptReplayEvents(parsedEvents)
+// userAgent returns the configured user agent for outgoing requests or one
+// telling hosts which instance is fetching their feeds and how to reach it.
+func (r *Relay) userAgent() string {
+	if r.FetchUserAgent != "" {
+		return r.FetchUserAgent
+	}
+
+	contact := "https://github.com/piraces/rsslay"
+	if r.MainDomainName != "" {
+		contact = "https://" + r.MainDomainName
+	}
+	if r.Contact != "" && r.Contact != "~" {
+		contact += "; " + r.Contact
 	}
+	return fmt.Sprintf("rsslay/%s (+%s)", r.Version, contact)
 }
 
+func (r *Relay) eventOptions() *events.Options {
+	return &events.Options{
+		MaxContentLength:            r.MaxContentLength,
+		EnableAutoNIP05Registration: r.EnableAutoNIP05Registration,
+		DefaultProfilePictureUrl:    r.DefaultProfilePictureUrl,
+		MainDomainName:              r.MainDomainName,
+		EnableLongFormEvents:        r.EnableLongFormEvents,
+		LongFormEventsOnly:          r.LongFormEventsOnly,
+		EnablePodcastEvents:         r.EnablePodcastEvents,
+		Hashtags:                    feed.Hashtags{InContent: r.HashtagsInContent, Max: r.MaxHashtags},
+		RelayURL:                    r.relayURL(),
+		ReplayToRelays:              r.ReplayToRelays,
+		WriteRelays:                 r.RelaysToPublish,
+	}
+}
+
+// relayURL returns the websocket url of the instance, empty if its domain
+// name is not configured.
+func (r *Relay) relayURL() string {
+	if r.MainDomainName == "" {
+		return ""
+	}
+	return "wss://" + r.MainDomainName
+}
+
+// AttemptReplayEvents queues the new events in the outbox to be replayed to
+// the configured relays, if enabled.
 func (r *Relay) AttemptReplayEvents(events []replayer.EventWithPrivateKey) {
-	if relayInstance.ReplayToRelays && relayInstance.routineQueueLength < relayInstance.MaxSubroutines && len(events) > 0 {
-		r.routineQueueLength++
-		metrics.ReplayRoutineQueueLength.Set(float64(r.routineQueueLength))
-		replayer.ReplayEventsToRelays(&replayer.ReplayParameters{
-			MaxEventsToReplay:        relayInstance.MaxEventsToReplay,
-			RelaysToPublish:          relayInstance.RelaysToPublish,
-			Mutex:                    &relayInstance.mutex,
-			Queue:                    &relayInstance.routineQueueLength,
-			WaitTime:                 relayInstance.DefaultWaitTimeBetweenBatches,
-			WaitTimeForRelayResponse: relayInstance.DefaultWaitTimeForRelayResponse,
-			Events:                   events,
-		})
+	if r.outbox != nil {
+		r.outbox.Enqueue(events)
 	}
 }
 
@@ -210,11 +348,11 @@ func (r *Relay) AcceptEvent(_ *nostr.Event) bool {
 }
 
 func (r *Relay) Storage() relayer.Storage {
-	return store{r.db}
+	return store{r.store}
 }
 
 type store struct {
-	db *sql.DB
+	storage storage.Storage
 }
 
 func (b store) Init() error { return nil }
@@ -229,76 +367,20 @@ func (b store) DeleteEvent(_, _ string) error {
 }
 
 func (b store) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
-	var parsedEvents []nostr.Event
-	var eventsToReplay []replayer.EventWithPrivateKey
-
 	metrics.QueryEventsRequests.Inc()
 
-	if filter.IDs != nil || len(filter.Tags) > 0 {
-		return parsedEvents, nil
+	// don't dump the whole database to filters not narrowed down to some events
+	if filter.IDs == nil && len(filter.Tags) == 0 && len(filter.Authors) == 0 {
+		return nil, nil
 	}
 
-	for _, pubkey := range filter.Authors {
-		parsedFeed, entity := events.GetParsedFeedForPubKey(pubkey, relayInstance.db, relayInstance.DeleteFailingFeeds, relayInstance.NitterInstances)
-
-		if parsedFeed == nil {
-			continue
-		}
-
-		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindSetMetadata) {
-			evt := feed.EntryFeedToSetMetadata(pubkey, parsedFeed, entity.URL, relayInstance.EnableAutoNIP05Registration, relayInstance.DefaultProfilePictureUrl, relayInstance.MainDomainName)
-
-			if filter.Since != nil && evt.CreatedAt < *filter.Since {
-				continue
-			}
-			if filter.Until != nil && evt.CreatedAt > *filter.Until {
-				continue
-			}
-
-			_ = evt.Sign(entity.PrivateKey)
-			parsedEvents = append(parsedEvents, evt)
-			if relayInstance.ReplayToRelays {
-				eventsToReplay = append(eventsToReplay, replayer.EventWithPrivateKey{Event: &evt, PrivateKey: entity.PrivateKey})
-			}
-		}
-
-		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-			var last uint32 = 0
-			for _, item := range parsedFeed.Items {
-				defaultCreatedAt := time.Unix(time.Now().Unix(), 0)
-				evt := feed.ItemToTextNote(pubkey, item, parsedFeed, defaultCreatedAt, entity.URL, relayInstance.MaxContentLength)
-
-				// Feed need to have a date for each entry...
-				if evt.CreatedAt == nostr.Timestamp(defaultCreatedAt.Unix()) {
-					continue
-				}
-
-				if filter.Since != nil && evt.CreatedAt < *filter.Since {
-					continue
-				}
-				if filter.Until != nil && evt.CreatedAt > *filter.Until {
-					continue
-				}
-
-				_ = evt.Sign(entity.PrivateKey)
-
-				if evt.CreatedAt > nostr.Timestamp(int64(last)) {
-					last = uint32(evt.CreatedAt)
-				}
-
-				parsedEvents = append(parsedEvents, evt)
-				if relayInstance.ReplayToRelays {
-					eventsToReplay = append(eventsToReplay, replayer.EventWithPrivateKey{Event: &evt, PrivateKey: entity.PrivateKey})
-				}
-			}
-
-			relayInstance.lastEmitted.Store(entity.URL, last)
-		}
+	if filter.Limit <= 0 || filter.Limit > relayInstance.MaxQueryLimit {
+		filter.Limit = relayInstance.MaxQueryLimit
 	}
 
-	relayInstance.AttemptReplayEvents(eventsToReplay)
+	relayInstance.poller.RefreshPending(filter.Authors)
 
-	return parsedEvents, nil
+	return b.storage.QueryEvents(filter)
 }
 
 func (r *Relay) InjectEvents() chan nostr.Event {
@@ -321,57 +403,196 @@ func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
 		infoDocument.PubKey = "~"
 	}
 
+	if relayInstance.EnableLongFormEvents {
+		infoDocument.SupportedNIPs = append(infoDocument.SupportedNIPs, 23)
+	}
+	// feeds publish relay lists when there is a relay to list
+	if relayInstance.relayURL() != "" || relayInstance.ReplayToRelays {
+		infoDocument.SupportedNIPs = append(infoDocument.SupportedNIPs, 65)
+	}
+	// notes describe their media in imeta tags
+	infoDocument.SupportedNIPs = append(infoDocument.SupportedNIPs, 92)
+	if relayInstance.EnablePodcastEvents {
+		infoDocument.SupportedNIPs = append(infoDocument.SupportedNIPs, 94)
+	}
+	// the admin and follows APIs authenticate with HTTP auth
+	infoDocument.SupportedNIPs = append(infoDocument.SupportedNIPs, 98)
+
 	return infoDocument
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			ConfigureLogging()
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	CreateHealthCheck()
 	ConfigureLogging()
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
+	defer func() {
+		if relayInstance.store == nil {
+			return
+		}
+		if err := relayInstance.store.Close(); err != nil {
 			log.Fatalf("[FATAL] failed to close the database connection: %v", err)
 		}
-	}(relayInstance.db)
+	}()
 
 	if err := relayer.Start(relayInstance); err != nil {
 		log.Fatalf("[FATAL] server terminated: %v", err)
 	}
 }
 
-func InitDatabase(r *Relay) *sql.DB {
-	finalConnection := dsn
-	if *dsn == "" {
-		log.Print("[INFO] dsn required is not present... defaulting to DB_DIR")
-		finalConnection = &r.DatabaseDirectory
+// commands are the maintenance tasks run instead of the relay when named as
+// first argument.
+var commands = map[string]func(args []string) error{
+	"migrate": RunMigrateCommand,
+	"feeds":   RunFeedsCommand,
+}
+
+// RunMigrateCommand handles `rsslay migrate [-dsn <datasource>] status|up`,
+// which reports or applies the schema migrations of the configured database.
+func RunMigrateCommand(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if err := envconfig.Process("", relayInstance); err != nil {
+		return fmt.Errorf("couldn't process envconfig: %w", err)
 	}
 
-	// Create empty dir if not exists
-	dbPath := path.Dir(*finalConnection)
-	err := os.MkdirAll(dbPath, 0660)
+	db := OpenDatabase(relayInstance)
+	defer db.Close()
+
+	switch flag.Arg(0) {
+	case "status":
+		statuses, err := db.MigrationsStatus()
+		if err != nil {
+			return fmt.Errorf("cannot retrieve migrations status: %w", err)
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+	case "up":
+		migrations, err := db.Migrate()
+		if err != nil {
+			return fmt.Errorf("cannot migrate schema: %w", err)
+		}
+		for _, migration := range migrations {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if len(migrations) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	default:
+		return errors.New("usage: rsslay migrate [-dsn <datasource>] status|up")
+	}
+
+	return nil
+}
+
+// RunFeedsCommand handles `rsslay feeds [-dsn <datasource>] check|purge`,
+// which lists or deletes, along with their events, the registered feeds the
+// domain policy refuses, e.g. after adding a rule to FEED_BLOCKED_DOMAINS.
+func RunFeedsCommand(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if err := envconfig.Process("", relayInstance); err != nil {
+		return fmt.Errorf("couldn't process envconfig: %w", err)
+	}
+	if err := relayInstance.configureDomainPolicy(); err != nil {
+		return err
+	}
+
+	var dryRun bool
+	switch flag.Arg(0) {
+	case "check":
+		dryRun = true
+	case "purge":
+		dryRun = false
+	default:
+		return errors.New("usage: rsslay feeds [-dsn <datasource>] check|purge")
+	}
+
+	db := OpenDatabase(relayInstance)
+	defer db.Close()
+
+	purged, err := storage.PurgeFeeds(db, func(entity feed.Entity) bool {
+		return feed.CheckDomain(entity.URL) != nil
+	}, dryRun)
+	for _, entity := range purged {
+		fmt.Printf("%s\t%s\t%v\n", entity.PublicKey, entity.URL, feed.CheckDomain(entity.URL))
+	}
 	if err != nil {
-		log.Printf("[INFO] unable to initialize DB_DIR at: %s. Error: %v", dbPath, err)
+		return fmt.Errorf("cannot purge feeds: %w", err)
+	}
+	if dryRun {
+		fmt.Printf("%d feeds not allowed by the domain policy\n", len(purged))
+	} else {
+		fmt.Printf("deleted %d feeds not allowed by the domain policy\n", len(purged))
 	}
 
-	// Connect to SQLite database.
-	sqlDb, err := sql.Open("sqlite3", *finalConnection)
+	return nil
+}
+
+// configureDomainPolicy sets the domains feeds can be registered from.
+func (r *Relay) configureDomainPolicy() error {
+	policy, err := feed.ParseDomainPolicy(r.FeedAllowedDomains, r.FeedBlockedDomains)
 	if err != nil {
-		log.Fatalf("[FATAL] open db: %v", err)
+		return fmt.Errorf("couldn't process FEED_ALLOWED_DOMAINS or FEED_BLOCKED_DOMAINS: %w", err)
 	}
+	feed.ConfigureDomainPolicy(policy)
+	return nil
+}
 
-	log.Printf("[INFO] database opened at %s", *finalConnection)
+func InitDatabase(r *Relay) storage.Storage {
+	db := OpenDatabase(r)
 
-	// Run migrations
-	if _, err := sqlDb.Exec(scripts.SchemaSQL); err != nil {
+	migrations, err := db.Migrate()
+	if err != nil {
 		log.Fatalf("[FATAL] cannot migrate schema: %v", err)
 	}
+	for _, migration := range migrations {
+		log.Printf("[INFO] applied migration %04d_%s", migration.Version, migration.Name)
+	}
+
+	return db
+}
 
-	if _, err := sqlDb.Exec(scripts.CheckNitterColumnSQL); err != nil {
-		_, err := sqlDb.Exec(scripts.CreateNitterColumnSQL)
+// OpenDatabase connects to the PostgreSQL database of a postgres:// DSN or to
+// the SQLite database of any other DSN, falling back to DB_DIR.
+func OpenDatabase(r *Relay) storage.Storage {
+	finalConnection := dsn
+	if *dsn == "" {
+		log.Print("[INFO] dsn required is not present... defaulting to DB_DIR")
+		finalConnection = &r.DatabaseDirectory
+	}
+
+	if !storage.IsPostgres(*finalConnection) {
+		// Create empty dir if not exists
+		dbPath := path.Dir(*finalConnection)
+		err := os.MkdirAll(dbPath, 0660)
 		if err != nil {
-			log.Fatalf("[FATAL] cannot migrate schema from previous versions: %v", err)
+			log.Printf("[INFO] unable to initialize DB_DIR at: %s. Error: %v", dbPath, err)
 		}
 	}
 
-	return sqlDb
+	db, err := storage.Open(*finalConnection)
+	if err != nil {
+		log.Fatalf("[FATAL] open db: %v", err)
+	}
+
+	log.Printf("[INFO] database opened at %s", *finalConnection)
+
+	return db
 }
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/nip98"
+	"github.com/piraces/rsslay/pkg/poller"
+	"github.com/piraces/rsslay/pkg/replayer"
+	"github.com/piraces/rsslay/pkg/storage"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	failingFeedsTop = 20
+	maxHashtags     = 50
+	maxFeedRelays   = 20
+)
+
+// AdminStats counts the feeds by state and lists the ones failing the most.
+type AdminStats struct {
+	storage.FeedStats
+	FailingFeeds []AdminFeedStatus
+}
+
+// PurgeResult lists the feeds refused by the domain policy, which were
+// deleted unless DryRun is set.
+type PurgeResult struct {
+	DryRun bool
+	Feeds  []Entry
+}
+
+// AdminAPI serves the /api/admin endpoints, restricted to requests signed
+// with NIP-98 HTTP auth by the owner or a moderator.
+type AdminAPI struct {
+	Store storage.Storage
+	// PubKeys are the hex public keys allowed to use the API.
+	PubKeys []string
+	// Refresh fetches the feed of a public key right away, failing with
+	// poller.ErrFeedDisabled or poller.ErrAlreadyRefreshing if it can't.
+	Refresh func(pubKey string) error
+	// DSN of the database, so changes are redirected to the primary node.
+	DSN *string
+	// Outbox replaying events to other relays, nil if disabled.
+	Outbox *replayer.Outbox
+}
+
+// Routes registers the admin endpoints in the router.
+func (a *AdminAPI) Routes(router *mux.Router) {
+	router.Path("/api/admin/stats").Methods(http.MethodGet).HandlerFunc(a.authorize(a.handleStats))
+	router.Path("/api/admin/feeds").Methods(http.MethodGet).HandlerFunc(a.authorize(a.handleListFeeds))
+	router.Path("/api/admin/feeds/purge").Methods(http.MethodPost).HandlerFunc(a.authorize(a.handlePurgeFeeds))
+	router.Path("/api/admin/feeds/{pubkey}").Methods(http.MethodGet).HandlerFunc(a.authorize(a.handleGetFeed))
+	router.Path("/api/admin/feeds/{pubkey}").Methods(http.MethodDelete).HandlerFunc(a.authorize(a.handleDeleteFeed))
+	router.Path("/api/admin/feeds/{pubkey}/disable").Methods(http.MethodPost).HandlerFunc(a.authorize(a.handleSetFeedDisabled(true)))
+	router.Path("/api/admin/feeds/{pubkey}/enable").Methods(http.MethodPost).HandlerFunc(a.authorize(a.handleSetFeedDisabled(false)))
+	router.Path("/api/admin/feeds/{pubkey}/hashtags").Methods(http.MethodPut).HandlerFunc(a.authorize(a.handleSetFeedHashtags))
+	router.Path("/api/admin/feeds/{pubkey}/relays").Methods(http.MethodPut).HandlerFunc(a.authorize(a.handleSetFeedRelays))
+	router.Path("/api/admin/feeds/{pubkey}/refresh").Methods(http.MethodPost).HandlerFunc(a.authorize(a.handleRefreshFeed))
+	router.Path("/api/admin/relays").Methods(http.MethodGet).HandlerFunc(a.authorize(a.handleListRelays))
+	router.Path("/api/admin/relays/resume").Methods(http.MethodPost).HandlerFunc(a.authorize(a.handleResumeRelay))
+	router.Path("/api/admin/deliveries").Methods(http.MethodGet).HandlerFunc(a.authorize(a.handleListDeliveries))
+}
+
+func (a *AdminAPI) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubKey, err := nip98.ValidateRequest(r, a.Store, a.allowed)
+		if errors.Is(err, nip98.ErrNotAllowed) {
+			writeError(w, http.StatusForbidden, "Public key not allowed to use the admin API")
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Nostr")
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if r.Method != http.MethodGet && a.DSN != nil && handleRedirectToPrimaryNode(w, a.DSN) {
+			return
+		}
+		log.Printf("[INFO] admin request %s %s by %s", r.Method, r.URL.Path, pubKey)
+		next(w, r)
+	}
+}
+
+func (a *AdminAPI) allowed(pubKey string) bool {
+	for _, allowed := range a.PubKeys {
+		if pubKey == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AdminAPI) handleStats(w http.ResponseWriter, _ *http.Request) {
+	stats, err := a.Store.FeedStats()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	failingFeeds, err := a.Store.FailingFeeds(failingFeedsTop)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AdminStats{FeedStats: stats, FailingFeeds: adminFeedStatuses(failingFeeds)})
+}
+
+func (a *AdminAPI) handleListFeeds(w http.ResponseWriter, r *http.Request) {
+	statuses, nextCursor, ok := listFeedStatuses(w, r, a.Store)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminFeedPage{Feeds: adminFeedStatuses(statuses), NextCursor: nextCursor})
+}
+
+func (a *AdminAPI) handleGetFeed(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+	a.writeFeedStatus(w, pubKey)
+}
+
+func (a *AdminAPI) handleDeleteFeed(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+
+	entity, err := a.Store.GetFeed(pubKey)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := a.Store.DeleteFeed(entity.URL); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	log.Printf("[INFO] deleted feed at url %q with publicKey %s", entity.URL, pubKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) handleSetFeedDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubKey, ok := pubKeyVar(w, r)
+		if !ok {
+			return
+		}
+
+		if err := a.Store.SetFeedDisabled(pubKey, disabled); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		a.writeFeedStatus(w, pubKey)
+	}
+}
+
+// handleSetFeedHashtags replaces the hashtag settings of a feed with the ones
+// of the JSON body, null or missing fields meaning the instance defaults.
+func (a *AdminAPI) handleSetFeedHashtags(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+
+	var overrides feed.HashtagOverrides
+	if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid hashtag settings: "+err.Error())
+		return
+	}
+	if overrides.Max != nil && (*overrides.Max < 0 || *overrides.Max > maxHashtags) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid hashtag settings: Max must be between 0 and %d", maxHashtags))
+		return
+	}
+
+	if err := a.Store.SetFeedHashtags(pubKey, overrides); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	a.writeFeedStatus(w, pubKey)
+}
+
+// handleSetFeedRelays replaces the relays the events of a feed are replayed
+// to, and listed in its relay list, with the JSON array of the body, null
+// meaning the instance defaults. The feed is fetched again right away to
+// publish its new relay list.
+func (a *AdminAPI) handleSetFeedRelays(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+
+	var relays []string
+	if err := json.NewDecoder(r.Body).Decode(&relays); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid relays: "+err.Error())
+		return
+	}
+	if len(relays) > maxFeedRelays {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid relays: at most %d relays are allowed", maxFeedRelays))
+		return
+	}
+	relays, err := feed.NormalizeRelayURLs(relays)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid relays: "+err.Error())
+		return
+	}
+
+	if err := a.Store.SetFeedRelays(pubKey, relays); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	// otherwise the new relays are listed on the next refresh
+	err = a.Refresh(pubKey)
+	if err != nil && !errors.Is(err, poller.ErrFeedDisabled) && !errors.Is(err, poller.ErrAlreadyRefreshing) {
+		writeStorageError(w, err)
+		return
+	}
+	a.writeFeedStatus(w, pubKey)
+}
+
+func (a *AdminAPI) handleRefreshFeed(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.Refresh(pubKey); err != nil {
+		writeRefreshError(w, err)
+		return
+	}
+	a.writeFeedStatus(w, pubKey)
+}
+
+func writeRefreshError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, poller.ErrFeedDisabled):
+		writeError(w, http.StatusConflict, "Feed is disabled, enable it to refresh it")
+	case errors.Is(err, poller.ErrAlreadyRefreshing):
+		writeError(w, http.StatusConflict, "Feed is already being refreshed")
+	default:
+		writeStorageError(w, err)
+	}
+}
+
+// handlePurgeFeeds deletes the feeds refused by the domain policy, or only
+// lists them with dry_run=true.
+func (a *AdminAPI) handlePurgeFeeds(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	purged, err := storage.PurgeFeeds(a.Store, func(entity feed.Entity) bool {
+		return feed.CheckDomain(entity.URL) != nil
+	}, dryRun)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	result := PurgeResult{DryRun: dryRun, Feeds: entriesFromFeeds(purged)}
+	for i, entity := range purged {
+		result.Feeds[i].ErrorMessage = feed.CheckDomain(entity.URL).Error()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *AdminAPI) writeFeedStatus(w http.ResponseWriter, pubKey string) {
+	status, err := a.Store.GetFeedStatus(pubKey)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminFeedStatus(status))
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/nip98"
+	"github.com/piraces/rsslay/pkg/poller"
+	"github.com/piraces/rsslay/pkg/replayer"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	adminPrivateKey    = "4d0888c07093941c9db16fcffb96fdf8af49a6839e865ea6110c7ab7cbd2d3d3"
+	strangerPrivateKey = "5c6a4b2f7e8d9c0b1a2f3e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b9a0f1e2d3c4b"
+)
+
+func newTestAdminAPI(t *testing.T) (*mux.Router, storage.Storage, *[]string) {
+	store := openTestStorage(t)
+
+	adminPubKey, _ := nostr.GetPublicKey(adminPrivateKey)
+	var refreshed []string
+	router := mux.NewRouter()
+	api := &AdminAPI{
+		Store:   store,
+		PubKeys: []string{adminPubKey},
+		Refresh: func(pubKey string) error {
+			if status, err := store.GetFeedStatus(pubKey); err == nil && status.Disabled {
+				return poller.ErrFeedDisabled
+			}
+			refreshed = append(refreshed, pubKey)
+			return nil
+		},
+	}
+	api.Routes(router)
+	return router, store, &refreshed
+}
+
+func adminRequest(t *testing.T, router http.Handler, privateKey string, method string, path string) *httptest.ResponseRecorder {
+	return adminRequestWithBody(t, router, privateKey, method, path, "")
+}
+
+// signedRequests tells apart the events signing the same request within the
+// same second, which would be refused as replayed otherwise.
+var signedRequests atomic.Int64
+
+func adminRequestWithBody(t *testing.T, router http.Handler, privateKey string, method string, path string, body string) *httptest.ResponseRecorder {
+	url := "http://rsslay.example.com" + path
+	evt := nostr.Event{
+		Kind:      nip98.Kind,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Tags:      nostr.Tags{{"u", url}, {"method", method}},
+		Content:   strconv.FormatInt(signedRequests.Add(1), 10),
+	}
+	if body != "" {
+		hash := sha256.Sum256([]byte(body))
+		evt.Tags = append(evt.Tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	assert.NoError(t, evt.Sign(privateKey))
+	rawEvent, _ := json.Marshal(evt)
+
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(rawEvent))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAdminAPIRequiresAuthorizedPubKey(t *testing.T) {
+	router, _, _ := newTestAdminAPI(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://rsslay.example.com/api/admin/feeds", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = adminRequest(t, router, strangerPrivateKey, http.MethodGet, "/api/admin/feeds")
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/feeds")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var page AdminFeedPage
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	assert.Len(t, page.Feeds, 1)
+	assert.Equal(t, feedUrl, page.Feeds[0].Url)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestAdminAPIManagesFeeds(t *testing.T) {
+	router, store, refreshed := newTestAdminAPI(t)
+
+	recorder := adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/"+feedPubKey+"/disable")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var status AdminFeedStatus
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.Disabled)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/"+status.NPubKey+"/refresh")
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Empty(t, *refreshed)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/stats")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stats AdminStats
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Disabled)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/"+feedPubKey+"/enable")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/"+status.NPubKey+"/refresh")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []string{feedPubKey}, *refreshed)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/feeds/not-a-key")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodDelete, "/api/admin/feeds/"+feedPubKey)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	_, err := store.GetFeed(feedPubKey)
+	assert.ErrorIs(t, err, storage.ErrFeedNotFound)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/feeds/"+feedPubKey)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAdminAPISetsFeedHashtags(t *testing.T) {
+	router, store, _ := newTestAdminAPI(t)
+
+	recorder := adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, "/api/admin/feeds/"+feedPubKey+"/hashtags", `{"InContent": true, "Max": 2}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var status AdminFeedStatus
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, *status.Hashtags.InContent)
+	assert.Equal(t, 2, *status.Hashtags.Max)
+
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, "/api/admin/feeds/"+feedPubKey+"/hashtags", `{"Max": 0}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	entity, _ := store.GetFeed(feedPubKey)
+	assert.Nil(t, entity.Hashtags.InContent)
+	assert.Equal(t, 0, *entity.Hashtags.Max)
+
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, "/api/admin/feeds/"+feedPubKey+"/hashtags", `{"Max": -1}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, "/api/admin/feeds/"+feedPubKey+"/hashtags", `not json`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAdminAPISetsFeedRelays(t *testing.T) {
+	router, store, refreshed := newTestAdminAPI(t)
+	path := "/api/admin/feeds/" + feedPubKey + "/relays"
+
+	recorder := adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, path, `["wss://Relay.example.com/", "ws://localhost:7447"]`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var status AdminFeedStatus
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Equal(t, []string{"wss://relay.example.com", "ws://localhost:7447"}, status.Relays)
+	assert.Equal(t, []string{feedPubKey}, *refreshed)
+
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, path, `[]`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	entity, _ := store.GetFeed(feedPubKey)
+	assert.Equal(t, []string{}, entity.Relays)
+
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, path, `null`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	entity, _ = store.GetFeed(feedPubKey)
+	assert.Nil(t, entity.Relays)
+
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, path, `["https://relay.example.com"]`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, path, `"wss://relay.example.com"`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = adminRequestWithBody(t, router, adminPrivateKey, http.MethodPut, "/api/admin/feeds/"+strings.Repeat("0", 64)+"/relays", `null`)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Len(t, *refreshed, 3)
+}
+
+func TestAdminAPIPurgesFeedsRefusedByDomainPolicy(t *testing.T) {
+	router, store, _ := newTestAdminAPI(t)
+	policy, _ := feed.ParseDomainPolicy(nil, []string{".example.com"})
+	feed.ConfigureDomainPolicy(policy)
+	t.Cleanup(func() { feed.ConfigureDomainPolicy(feed.DomainPolicy{}) })
+
+	recorder := adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/purge?dry_run=true")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var result PurgeResult
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.True(t, result.DryRun)
+	assert.Len(t, result.Feeds, 1)
+	_, err := store.GetFeed(feedPubKey)
+	assert.NoError(t, err)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/feeds/purge")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	_, err = store.GetFeed(feedPubKey)
+	assert.ErrorIs(t, err, storage.ErrFeedNotFound)
+}
+
+func TestAdminAPIReportsRelayDeliveries(t *testing.T) {
+	store := openTestStorage(t)
+	const blockingRelay = "wss://relay.example.com"
+	outbox := &replayer.Outbox{Store: store, Relays: []string{blockingRelay}, Workers: 1, QueueSize: 10, BatchSize: 10, Timeout: time.Second,
+		PauseAfter: 1, PauseDuration: time.Hour,
+		Publish: func(context.Context, string, string, nostr.Event) error {
+			return errors.New("msg: blocked: not on the whitelist")
+		}}
+	evt := nostr.Event{ID: strings.Repeat("a", 64), PubKey: feedPubKey, CreatedAt: 1000, Kind: nostr.KindTextNote, Tags: nostr.Tags{}}
+	_, err := store.SaveEvent(&evt)
+	assert.NoError(t, err)
+	t.Cleanup(outbox.Close)
+	outbox.Enqueue([]replayer.EventWithPrivateKey{{Event: &evt}})
+	outbox.Wait()
+
+	adminPubKey, _ := nostr.GetPublicKey(adminPrivateKey)
+	router := mux.NewRouter()
+	(&AdminAPI{Store: store, PubKeys: []string{adminPubKey}, Outbox: outbox}).Routes(router)
+
+	recorder := adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/relays")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var reports []RelayReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &reports))
+	assert.Len(t, reports, 1)
+	assert.Equal(t, blockingRelay, reports[0].Relay)
+	assert.True(t, reports[0].Paused)
+	assert.Equal(t, replayer.OutcomeBlocked, reports[0].LastOutcome)
+	assert.Equal(t, map[string]int{storage.DeliveryFailed: 1}, reports[0].Statuses)
+	assert.Equal(t, map[string]int{replayer.OutcomeBlocked: 1}, reports[0].Outcomes)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/deliveries?outcome=blocked")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var deliveries []storage.DeliveryRecord
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &deliveries))
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, evt.ID, deliveries[0].EventID)
+	assert.Equal(t, "blocked: not on the whitelist", deliveries[0].Message)
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/admin/deliveries?outcome=accepted")
+	assert.Equal(t, "[]", strings.TrimSpace(recorder.Body.String()))
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/relays/resume?url="+blockingRelay)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var state replayer.RelayState
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.False(t, state.Paused)
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodPost, "/api/admin/relays/resume?url="+blockingRelay)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
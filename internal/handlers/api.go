@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/helpers"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// FeedStatus describes a registered feed and how its fetches are going.
+type FeedStatus struct {
+	PubKey      string
+	NPubKey     string
+	Url         string
+	Nitter      bool
+	LastFetchAt int64
+	NextFetchAt int64
+	ErrorCount  int
+	EventCount  int
+}
+
+// AdminFeedStatus adds to FeedStatus the settings of the feed and the error
+// of its last fetch, which only admins get to see.
+type AdminFeedStatus struct {
+	FeedStatus
+	Hashtags feed.HashtagOverrides
+	// Relays overrides the relays its events are replayed to, if not null.
+	Relays    []string
+	Disabled  bool
+	LastError string
+}
+
+// FeedPage is a page of feeds, NextCursor being empty on the last one.
+type FeedPage struct {
+	Feeds      []FeedStatus
+	NextCursor string
+}
+
+// AdminFeedPage is a FeedPage of AdminFeedStatus.
+type AdminFeedPage struct {
+	Feeds      []AdminFeedStatus
+	NextCursor string
+}
+
+// HandleApiFeeds lists the registered feeds ordered by public key, a page
+// of up to limit feeds at a time starting after the cursor.
+func HandleApiFeeds(w http.ResponseWriter, r *http.Request, store storage.Storage) {
+	metrics.ListRequestsAPI.Inc()
+	statuses, nextCursor, ok := listFeedStatuses(w, r, store)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, FeedPage{Feeds: feedStatuses(statuses), NextCursor: nextCursor})
+}
+
+// listFeedStatuses reads the page of feeds asked for and the cursor to the
+// next one, empty on the last one, writing the error if it fails.
+func listFeedStatuses(w http.ResponseWriter, r *http.Request, store storage.Storage) ([]storage.FeedStatus, string, bool) {
+	limit, err := pageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, "", false
+	}
+
+	statuses, err := store.ListFeedStatuses(r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeStorageError(w, err)
+		return nil, "", false
+	}
+
+	var nextCursor string
+	if len(statuses) == limit {
+		nextCursor = statuses[len(statuses)-1].Entity.PublicKey
+	}
+	return statuses, nextCursor, true
+}
+
+// HandleApiFeedByPubKey looks up a feed by its public key, in hex or as an npub.
+func HandleApiFeedByPubKey(w http.ResponseWriter, r *http.Request, store storage.Storage) {
+	metrics.LookupRequestsAPI.Inc()
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := store.GetFeedStatus(pubKey)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newFeedStatus(status))
+}
+
+// HandleApiFeedSearch returns up to limit feeds whose url contains the query.
+func HandleApiFeedSearch(w http.ResponseWriter, r *http.Request, store storage.Storage) {
+	metrics.SearchRequestsAPI.Inc()
+	query := r.URL.Query().Get("q")
+	if len(query) <= 4 {
+		writeError(w, http.StatusBadRequest, "Please enter more than 5 characters to search")
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	statuses, err := store.SearchFeedStatuses(query, limit)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, FeedPage{Feeds: feedStatuses(statuses)})
+}
+
+func newFeedStatus(status storage.FeedStatus) FeedStatus {
+	nPubKey, _ := nip19.EncodePublicKey(status.Entity.PublicKey)
+	return FeedStatus{
+		PubKey:      status.Entity.PublicKey,
+		NPubKey:     nPubKey,
+		Url:         status.Entity.URL,
+		Nitter:      status.Entity.Nitter,
+		LastFetchAt: status.LastFetchAt,
+		NextFetchAt: status.NextFetchAt,
+		ErrorCount:  status.ErrorCount,
+		EventCount:  status.EventCount,
+	}
+}
+
+func newAdminFeedStatus(status storage.FeedStatus) AdminFeedStatus {
+	return AdminFeedStatus{
+		FeedStatus: newFeedStatus(status),
+		Hashtags:   status.Entity.Hashtags,
+		Relays:     status.Entity.Relays,
+		Disabled:   status.Disabled,
+		LastError:  status.LastError,
+	}
+}
+
+func feedStatuses(statuses []storage.FeedStatus) []FeedStatus {
+	result := make([]FeedStatus, len(statuses))
+	for i, status := range statuses {
+		result[i] = newFeedStatus(status)
+	}
+	return result
+}
+
+func adminFeedStatuses(statuses []storage.FeedStatus) []AdminFeedStatus {
+	result := make([]AdminFeedStatus, len(statuses))
+	for i, status := range statuses {
+		result[i] = newAdminFeedStatus(status)
+	}
+	return result
+}
+
+// pageSize reads the limit query parameter, defaulting to defaultPageSize.
+func pageSize(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit, expected a positive number")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// pubKeyVar reads the public key, in hex or as an npub, from the path.
+func pubKeyVar(w http.ResponseWriter, r *http.Request) (string, bool) {
+	pubKey, err := helpers.ParsePubKey(mux.Vars(r)["pubkey"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return pubKey, true
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrFeedNotFound) {
+		writeError(w, http.StatusNotFound, "Feed not found")
+		return
+	}
+	log.Printf("[ERROR] api request failed: %v", err)
+	writeError(w, http.StatusInternalServerError, "Internal error")
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, Entry{Error: true, ErrorCode: code, ErrorMessage: message})
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	response, _ := json.Marshal(value)
+	_, _ = w.Write(response)
+}
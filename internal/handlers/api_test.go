@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/piraces/rsslay/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	feedPubKey = "1a21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+	feedUrl    = "https://example.com/rss"
+)
+
+// openTestStorage returns an in-memory database with a single feed registered.
+func openTestStorage(t *testing.T) storage.Storage {
+	store := storagetest.Open(t)
+	_, err := store.InsertFeed(feed.Entity{PublicKey: feedPubKey, PrivateKey: "private", URL: feedUrl})
+	assert.NoError(t, err)
+	return store
+}
+
+func newTestRouter(store storage.Storage) *mux.Router {
+	router := mux.NewRouter()
+	router.Path("/api/feeds").HandlerFunc(func(w http.ResponseWriter, r *http.Request) { HandleApiFeeds(w, r, store) })
+	router.Path("/api/feeds/search").HandlerFunc(func(w http.ResponseWriter, r *http.Request) { HandleApiFeedSearch(w, r, store) })
+	router.Path("/api/feeds/{pubkey}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) { HandleApiFeedByPubKey(w, r, store) })
+	return router
+}
+
+func getJSON(t *testing.T, router http.Handler, path string, value any) int {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), value))
+	return recorder.Code
+}
+
+func TestHandleApiFeedsPaginates(t *testing.T) {
+	store := openTestStorage(t)
+	const otherPubKey = "ff21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+	_, err := store.InsertFeed(feed.Entity{PublicKey: otherPubKey, PrivateKey: "private", URL: "https://example.org/atom"})
+	assert.NoError(t, err)
+	router := newTestRouter(store)
+
+	var page FeedPage
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds?limit=1", &page))
+	assert.Len(t, page.Feeds, 1)
+	assert.Equal(t, feedPubKey, page.Feeds[0].PubKey)
+	assert.Equal(t, feedPubKey, page.NextCursor)
+
+	cursor := page.NextCursor
+	page = FeedPage{}
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds?limit=1&cursor="+cursor, &page))
+	assert.Len(t, page.Feeds, 1)
+	assert.Equal(t, otherPubKey, page.Feeds[0].PubKey)
+
+	page = FeedPage{}
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds?cursor="+otherPubKey, &page))
+	assert.Empty(t, page.Feeds)
+	assert.Empty(t, page.NextCursor)
+
+	var entry Entry
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, router, "/api/feeds?limit=zero", &entry))
+	assert.True(t, entry.Error)
+}
+
+func TestHandleApiFeedByPubKey(t *testing.T) {
+	store := openTestStorage(t)
+	assert.NoError(t, store.RecordFetch(feedPubKey, 1000, nil))
+	router := newTestRouter(store)
+
+	var status FeedStatus
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds/"+feedPubKey, &status))
+	assert.Equal(t, feedUrl, status.Url)
+	assert.Equal(t, int64(1000), status.LastFetchAt)
+	assert.Zero(t, status.EventCount)
+
+	npub := status.NPubKey
+	status = FeedStatus{}
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds/"+npub, &status))
+	assert.Equal(t, feedPubKey, status.PubKey)
+
+	// the settings of the feed and its errors are left to the admin API
+	assert.NoError(t, store.RecordFetch(feedPubKey, 2000, errors.New("connection refused by 10.0.0.1")))
+	var fields map[string]any
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds/"+feedPubKey, &fields))
+	assert.Equal(t, float64(1), fields["ErrorCount"])
+	for _, field := range []string{"LastError", "Hashtags", "Relays", "Disabled"} {
+		assert.NotContains(t, fields, field)
+	}
+
+	var entry Entry
+	assert.Equal(t, http.StatusNotFound, getJSON(t, router, "/api/feeds/"+strings.Repeat("ab", 32), &entry))
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, router, "/api/feeds/unknown", &entry))
+}
+
+func TestHandleApiFeedSearch(t *testing.T) {
+	router := newTestRouter(openTestStorage(t))
+
+	var page FeedPage
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds/search?q=example.com", &page))
+	assert.Len(t, page.Feeds, 1)
+	assert.Equal(t, feedUrl, page.Feeds[0].Url)
+
+	page = FeedPage{}
+	assert.Equal(t, http.StatusOK, getJSON(t, router, "/api/feeds/search?q=example.org", &page))
+	assert.Empty(t, page.Feeds)
+
+	var entry Entry
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, router, "/api/feeds/search?q=ex", &entry))
+}
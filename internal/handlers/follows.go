@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/piraces/rsslay/pkg/contacts"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/nip98"
+	"github.com/piraces/rsslay/pkg/storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+const contactListTimeout = 10 * time.Second
+
+// FollowsAPI exports the feeds of the rsslay profiles a Nostr user follows,
+// so they can take their subscriptions to a regular feed reader.
+type FollowsAPI struct {
+	Store storage.Storage
+	// ContactList fetches the newest kind 3 contact list of a public key.
+	ContactList func(ctx context.Context, pubKey string) (*nostr.Event, error)
+	// RequestsPerMinute limits the exports of any public key each client
+	// can ask for, as they connect to the contact list relays, or 0 for no
+	// limit.
+	RequestsPerMinute int
+
+	limiter *clientLimiter
+}
+
+// Routes registers the export endpoints in the router: one for any public
+// key and one for the public key signing the request with NIP-98 HTTP auth.
+func (f *FollowsAPI) Routes(router *mux.Router) {
+	f.limiter = newClientLimiter(f.RequestsPerMinute)
+	router.Path("/api/follows").Methods(http.MethodGet).HandlerFunc(f.handleSignedExport)
+	router.Path("/api/follows/{pubkey}").Methods(http.MethodGet).HandlerFunc(f.handleExport)
+}
+
+func (f *FollowsAPI) handleSignedExport(w http.ResponseWriter, r *http.Request) {
+	pubKey, err := nip98.ValidateRequest(r, f.Store, nil)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Nostr")
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	f.writeFollows(w, r, pubKey)
+}
+
+func (f *FollowsAPI) handleExport(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pubKeyVar(w, r)
+	if !ok || !f.limiter.allow(w, r) {
+		return
+	}
+	f.writeFollows(w, r, pubKey)
+}
+
+// writeFollows intersects the contact list of the public key with the
+// registered feeds and sends them as OPML, or as JSON with format=json.
+func (f *FollowsAPI) writeFollows(w http.ResponseWriter, r *http.Request, pubKey string) {
+	metrics.FollowsExportRequests.Inc()
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "opml" && format != "json" {
+		writeError(w, http.StatusBadRequest, "Invalid format, expected opml or json")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), contactListTimeout)
+	defer cancel()
+	contactList, err := f.ContactList(ctx, pubKey)
+	if errors.Is(err, contacts.ErrContactListNotFound) {
+		writeError(w, http.StatusNotFound, "No contact list found for this public key in the relays")
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to fetch the contact list of %s: %v", pubKey, err)
+		writeError(w, http.StatusBadGateway, "Could not fetch the contact list from the relays")
+		return
+	}
+
+	feeds, err := f.Store.FeedsOf(contacts.FollowedPubKeys(contactList))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if format == "json" {
+		entries := entriesFromFeeds(feeds)
+		if entries == nil {
+			entries = []Entry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+	nPubKey, _ := nip19.EncodePublicKey(pubKey)
+	writeOPML(w, "rsslay feeds followed by "+nPubKey, "rsslay-follows.opml", feeds)
+}
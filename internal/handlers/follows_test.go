@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/contacts"
+	"github.com/piraces/rsslay/pkg/opml"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const unknownPubKey = "ff21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+
+func newTestFollowsAPI(t *testing.T) *mux.Router {
+	return newLimitedTestFollowsAPI(t, 0)
+}
+
+func newLimitedTestFollowsAPI(t *testing.T, requestsPerMinute int) *mux.Router {
+	store := openTestStorage(t)
+	adminPubKey, _ := nostr.GetPublicKey(adminPrivateKey)
+
+	router := mux.NewRouter()
+	api := &FollowsAPI{
+		Store: store,
+		ContactList: func(ctx context.Context, pubKey string) (*nostr.Event, error) {
+			if pubKey != adminPubKey {
+				return nil, contacts.ErrContactListNotFound
+			}
+			return &nostr.Event{Kind: nostr.KindContactList, PubKey: pubKey, Tags: nostr.Tags{{"p", unknownPubKey}, {"p", feedPubKey}}}, nil
+		},
+		RequestsPerMinute: requestsPerMinute,
+	}
+	api.Routes(router)
+	return router
+}
+
+func TestFollowsAPIExportsFollowedFeeds(t *testing.T) {
+	router := newTestFollowsAPI(t)
+	adminPubKey, _ := nostr.GetPublicKey(adminPrivateKey)
+
+	var entries []Entry
+	code := getJSON(t, router, "/api/follows/"+adminPubKey+"?format=json", &entries)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, feedPubKey, entries[0].PubKey)
+	assert.Equal(t, feedUrl, entries[0].Url)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/follows/"+adminPubKey, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	document, err := opml.Parse(recorder.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{feedUrl}, document.FeedURLs())
+}
+
+func TestFollowsAPIExportsFeedsFollowedBySigner(t *testing.T) {
+	router := newTestFollowsAPI(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/follows", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/follows")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), feedUrl)
+
+	recorder = adminRequest(t, router, strangerPrivateKey, http.MethodGet, "/api/follows")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestFollowsAPIRejectsInvalidRequests(t *testing.T) {
+	router := newTestFollowsAPI(t)
+
+	var entry Entry
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, router, "/api/follows/not-a-key", &entry))
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, router, "/api/follows/"+feedPubKey+"?format=csv", &entry))
+}
+
+func TestFollowsAPILimitsExportsOfEachClient(t *testing.T) {
+	router := newLimitedTestFollowsAPI(t, 2)
+	adminPubKey, _ := nostr.GetPublicKey(adminPrivateKey)
+
+	export := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/follows/"+adminPubKey+"?format=json", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, export("192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusOK, export("192.0.2.1:5678").Code)
+	recorder := export("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, export("192.0.2.2:1234").Code)
+
+	// exports signed by the user are not limited
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, adminRequest(t, router, adminPrivateKey, http.MethodGet, "/api/follows").Code)
+	}
+}
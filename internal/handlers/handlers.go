@@ -1,15 +1,15 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
-	_ "github.com/mattn/go-sqlite3"
+	"errors"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip05"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/piraces/rsslay/pkg/feed"
 	"github.com/piraces/rsslay/pkg/helpers"
 	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
 	"github.com/piraces/rsslay/web/templates"
 	"github.com/prometheus/client_golang/prometheus"
 	"html/template"
@@ -39,43 +39,27 @@ type PageData struct {
 	MainDomainName string
 }
 
-func HandleWebpage(w http.ResponseWriter, r *http.Request, db *sql.DB, mainDomainName *string) {
+func HandleWebpage(w http.ResponseWriter, r *http.Request, store storage.Storage, mainDomainName *string) {
 	mustRedirect := handleOtherRegion(w, r)
 	if mustRedirect {
 		return
 	}
 
 	metrics.IndexRequests.Inc()
-	var count uint64
-	row := db.QueryRow(`SELECT count(*) FROM feeds`)
-	err := row.Scan(&count)
+	count, err := store.CountFeeds()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var items []Entry
-	rows, err := db.Query(`SELECT publickey, url FROM feeds ORDER BY RANDOM() LIMIT 50`)
+	feeds, err := store.RandomFeeds(50)
 	if err != nil {
+		log.Printf("[ERROR] failed to retrieve random feeds: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	for rows.Next() {
-		var entry Entry
-		if err := rows.Scan(&entry.PubKey, &entry.Url); err != nil {
-			log.Printf("[ERROR] failed to scan row iterating feeds: %v", err)
-			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
-			continue
-		}
-
-		entry.NPubKey, _ = nip19.EncodePublicKey(entry.PubKey)
-		items = append(items, entry)
-	}
-	if err := rows.Close(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	items := entriesFromFeeds(feeds)
 
 	data := PageData{
 		Count:          count,
@@ -86,7 +70,7 @@ func HandleWebpage(w http.ResponseWriter, r *http.Request, db *sql.DB, mainDomai
 	_ = t.ExecuteTemplate(w, "index.html.tmpl", data)
 }
 
-func HandleSearch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func HandleSearch(w http.ResponseWriter, r *http.Request, store storage.Storage) {
 	mustRedirect := handleOtherRegion(w, r)
 	if mustRedirect {
 		return
@@ -99,36 +83,20 @@ func HandleSearch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	var count uint64
-	row := db.QueryRow(`SELECT count(*) FROM feeds`)
-	err := row.Scan(&count)
+	count, err := store.CountFeeds()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var items []Entry
-	rows, err := db.Query(`SELECT publickey, url FROM feeds WHERE url like '%' || $1 || '%' LIMIT 50`, query)
+	feeds, err := store.SearchFeeds(query, 50)
 	if err != nil {
+		log.Printf("[ERROR] failed to search feeds: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	for rows.Next() {
-		var entry Entry
-		if err := rows.Scan(&entry.PubKey, &entry.Url); err != nil {
-			log.Printf("[ERROR] failed to scan row iterating feeds searching: %v", err)
-			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
-			continue
-		}
-
-		entry.NPubKey, _ = nip19.EncodePublicKey(entry.PubKey)
-		items = append(items, entry)
-	}
-	if err := rows.Close(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	items := entriesFromFeeds(feeds)
 
 	data := PageData{
 		Count:         count,
@@ -139,26 +107,26 @@ func HandleSearch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	_ = t.ExecuteTemplate(w, "search.html.tmpl", data)
 }
 
-func HandleCreateFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+func HandleCreateFeed(w http.ResponseWriter, r *http.Request, store storage.Storage, secret *string, dsn *string) {
 	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
 	if mustRedirect {
 		return
 	}
 
 	metrics.CreateRequests.Inc()
-	entry := createFeedEntry(r, db, secret)
+	entry := createFeedEntry(r, store, secret)
 	_ = t.ExecuteTemplate(w, "created.html.tmpl", entry)
 }
 
-func HandleApiFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+func HandleApiFeed(w http.ResponseWriter, r *http.Request, store storage.Storage, secret *string, dsn *string) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		handleCreateFeedEntry(w, r, db, secret, dsn)
+		handleCreateFeedEntry(w, r, store, secret, dsn)
 	} else {
 		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
 	}
 }
 
-func HandleNip05(w http.ResponseWriter, r *http.Request, db *sql.DB, ownerPubKey *string, enableAutoRegistration *bool) {
+func HandleNip05(w http.ResponseWriter, r *http.Request, store storage.Storage, ownerPubKey *string, enableAutoRegistration *bool) {
 	metrics.WellKnownRequests.Inc()
 	name := r.URL.Query().Get("name")
 	name, _ = url.QueryUnescape(name)
@@ -172,10 +140,7 @@ func HandleNip05(w http.ResponseWriter, r *http.Request, db *sql.DB, ownerPubKey
 
 	var response []byte
 	if name != "" && name != "_" && *enableAutoRegistration {
-		row := db.QueryRow("SELECT publickey FROM feeds WHERE url like '%' || $1 || '%'", name)
-
-		var entity feed.Entity
-		err := row.Scan(&entity.PublicKey)
+		entity, err := store.FindFeedByURL(name)
 		if err == nil {
 			nip05WellKnownResponse = nip05.WellKnownResponse{
 				Names: map[string]string{
@@ -190,14 +155,14 @@ func HandleNip05(w http.ResponseWriter, r *http.Request, db *sql.DB, ownerPubKey
 	_, _ = w.Write(response)
 }
 
-func handleCreateFeedEntry(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+func handleCreateFeedEntry(w http.ResponseWriter, r *http.Request, store storage.Storage, secret *string, dsn *string) {
 	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
 	if mustRedirect {
 		return
 	}
 
 	metrics.CreateRequestsAPI.Inc()
-	entry := createFeedEntry(r, db, secret)
+	entry := createFeedEntry(r, store, secret)
 	w.Header().Set("Content-Type", "application/json")
 
 	if entry.ErrorCode >= 400 {
@@ -221,6 +186,11 @@ func handleOtherRegion(w http.ResponseWriter, r *http.Request) bool {
 }
 
 func handleRedirectToPrimaryNode(w http.ResponseWriter, dsn *string) bool {
+	// Replicas sharing a PostgreSQL database can all write to it.
+	if storage.IsPostgres(*dsn) {
+		return false
+	}
+
 	// If this node is not primary, look up and redirect to the current primary.
 	primaryFilename := filepath.Join(filepath.Dir(*dsn), ".primary")
 	primary, err := os.ReadFile(primaryFilename)
@@ -237,8 +207,13 @@ func handleRedirectToPrimaryNode(w http.ResponseWriter, dsn *string) bool {
 	return false
 }
 
-func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
-	urlParam := r.URL.Query().Get("url")
+func createFeedEntry(r *http.Request, store storage.Storage, secret *string) *Entry {
+	return createFeedEntryFromURL(r.URL.Query().Get("url"), store, secret)
+}
+
+// createFeedEntryFromURL registers the feed found at the url, if not already,
+// and describes its profile or why it couldn't be registered.
+func createFeedEntryFromURL(urlParam string, store storage.Storage, secret *string) *Entry {
 	entry := Entry{
 		Error: false,
 	}
@@ -251,7 +226,21 @@ func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
 		return &entry
 	}
 
-	feedUrl := feed.GetFeedURL(urlParam)
+	if err := feed.CheckDomain(urlParam); isDomainNotAllowed(err, &entry) {
+		log.Printf("[DEBUG] tried to create feed from not allowed url '%q': %v", urlParam, err)
+		return &entry
+	}
+
+	if err := feed.CheckURL(urlParam); isBlockedAddress(err, &entry) {
+		log.Printf("[DEBUG] tried to create feed from forbidden url '%q': %v", urlParam, err)
+		return &entry
+	}
+
+	feedUrl, err := feed.FindFeedURL(urlParam)
+	if isBlockedAddress(err, &entry) || isDomainNotAllowed(err, &entry) {
+		log.Printf("[DEBUG] tried to create feed from forbidden url '%q': %v", urlParam, err)
+		return &entry
+	}
 	if feedUrl == "" {
 		entry.ErrorCode = http.StatusBadRequest
 		entry.Error = true
@@ -259,7 +248,17 @@ func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
 		return &entry
 	}
 
+	// the feed may be hosted elsewhere than the page linking to it
+	if err := feed.CheckDomain(feedUrl); isDomainNotAllowed(err, &entry) {
+		log.Printf("[DEBUG] tried to create feed from not allowed feed url '%q': %v", feedUrl, err)
+		return &entry
+	}
+
 	parsedFeed, err := feed.ParseFeed(feedUrl)
+	if isBlockedAddress(err, &entry) || isDomainNotAllowed(err, &entry) {
+		log.Printf("[DEBUG] tried to create feed from forbidden feed url '%q': %v", feedUrl, err)
+		return &entry
+	}
 	if err != nil {
 		entry.ErrorCode = http.StatusBadRequest
 		entry.Error = true
@@ -278,7 +277,7 @@ func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
 
 	publicKey = strings.TrimSpace(publicKey)
 	isNitterFeed := strings.Contains(parsedFeed.Description, "Twitter feed")
-	defer insertFeed(err, feedUrl, publicKey, sk, isNitterFeed, db)
+	defer insertFeed(err, feedUrl, publicKey, sk, isNitterFeed, store)
 
 	entry.Url = feedUrl
 	entry.PubKey = publicKey
@@ -286,14 +285,37 @@ func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
 	return &entry
 }
 
-func insertFeed(err error, feedUrl string, publicKey string, sk string, nitter bool, db *sql.DB) {
-	row := db.QueryRow("SELECT privatekey, url FROM feeds WHERE publickey=$1", publicKey)
+// isBlockedAddress fills the entry with a clear error if the url, or any url
+// it redirected to, points to an internal address rsslay refuses to fetch.
+func isBlockedAddress(err error, entry *Entry) bool {
+	var blockedAddressError *feed.BlockedAddressError
+	if !errors.As(err, &blockedAddressError) {
+		return false
+	}
+	entry.ErrorCode = http.StatusForbidden
+	entry.Error = true
+	entry.ErrorMessage = "URL not allowed, it points to an internal address (" + blockedAddressError.Error() + ")..."
+	return true
+}
+
+// isDomainNotAllowed fills the entry with a clear error if the domain policy
+// of the instance refuses the url, or any url it redirected to.
+func isDomainNotAllowed(err error, entry *Entry) bool {
+	var domainNotAllowedError *feed.DomainNotAllowedError
+	if !errors.As(err, &domainNotAllowedError) {
+		return false
+	}
+	entry.ErrorCode = http.StatusForbidden
+	entry.Error = true
+	entry.ErrorMessage = "Feeds from this domain are not accepted by this instance (" + domainNotAllowedError.Error() + ")..."
+	return true
+}
 
-	var entity feed.Entity
-	err = row.Scan(&entity.PrivateKey, &entity.URL)
-	if err != nil && err == sql.ErrNoRows {
+func insertFeed(err error, feedUrl string, publicKey string, sk string, nitter bool, store storage.Storage) {
+	_, err = store.GetFeed(publicKey)
+	if err != nil && err == storage.ErrFeedNotFound {
 		log.Printf("[DEBUG] not found feed at url %q as publicKey %s", feedUrl, publicKey)
-		if _, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, nitter) VALUES (?, ?, ?, ?)`, publicKey, sk, feedUrl, nitter); err != nil {
+		if _, err := store.InsertFeed(feed.Entity{PublicKey: publicKey, PrivateKey: sk, URL: feedUrl, Nitter: nitter}); err != nil {
 			log.Printf("[ERROR] failure: %v", err)
 			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
 		} else {
@@ -306,3 +328,13 @@ func insertFeed(err error, feedUrl string, publicKey string, sk string, nitter b
 		log.Printf("[DEBUG] found feed at url %q as publicKey %s", feedUrl, publicKey)
 	}
 }
+
+func entriesFromFeeds(feeds []feed.Entity) []Entry {
+	var items []Entry
+	for _, entity := range feeds {
+		entry := Entry{PubKey: entity.PublicKey, Url: entity.URL}
+		entry.NPubKey, _ = nip19.EncodePublicKey(entry.PubKey)
+		items = append(items, entry)
+	}
+	return items
+}
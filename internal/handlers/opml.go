@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/opml"
+	"github.com/piraces/rsslay/pkg/storage"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxOPMLSize       = 1 << 20
+	maxImportedFeeds  = 50
+	importConcurrency = 4
+	exportPageSize    = 500
+)
+
+// importLimiter limits the OPML imports of each client, since every feed of
+// a document is fetched and registered.
+var importLimiter *clientLimiter
+
+// LimitOPMLImports lets each client import up to perMinute OPML documents a
+// minute, or any number of them with 0. Meant to be called before serving.
+func LimitOPMLImports(perMinute int) {
+	importLimiter = newClientLimiter(perMinute)
+}
+
+// ImportedFeed is the outcome of registering one feed of an OPML document.
+type ImportedFeed struct {
+	XmlUrl string
+	Entry
+}
+
+// ImportPageData is rendered after importing an OPML document from the web.
+type ImportPageData struct {
+	Error        bool
+	ErrorMessage string
+	Feeds        []ImportedFeed
+	Created      int
+}
+
+// HandleImportOPML registers every feed of the OPML document uploaded from
+// the web form, in the opml field.
+func HandleImportOPML(w http.ResponseWriter, r *http.Request, store storage.Storage, secret *string, dsn *string) {
+	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
+	if mustRedirect {
+		return
+	}
+
+	metrics.ImportRequests.Inc()
+	data := ImportPageData{}
+	if delay := importLimiter.wait(r); delay > 0 {
+		seconds := int(math.Ceil(delay.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+		data.Error = true
+		data.ErrorMessage = fmt.Sprintf("Too many imports, please try again in %d seconds", seconds)
+	} else if document, err := readOPML(w, r); err != nil {
+		data.Error = true
+		data.ErrorMessage = "Invalid OPML file: " + err.Error()
+	} else {
+		data.Feeds, err = importOPML(document, store, secret)
+		if err != nil {
+			data.Error = true
+			data.ErrorMessage = err.Error()
+		}
+	}
+	for _, imported := range data.Feeds {
+		if !imported.Error {
+			data.Created++
+		}
+	}
+
+	_ = t.ExecuteTemplate(w, "imported.html.tmpl", data)
+}
+
+// HandleApiImportOPML registers every feed of the OPML document sent as
+// request body, or as the opml field of a multipart form, and returns the
+// outcome of each one.
+func HandleApiImportOPML(w http.ResponseWriter, r *http.Request, store storage.Storage, secret *string, dsn *string) {
+	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
+	if mustRedirect {
+		return
+	}
+
+	metrics.ImportRequestsAPI.Inc()
+	if !importLimiter.allow(w, r) {
+		return
+	}
+	document, err := readOPML(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid OPML file: "+err.Error())
+		return
+	}
+
+	imported, err := importOPML(document, store, secret)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, imported)
+}
+
+// HandleExportOPML returns every registered feed as an OPML document, or
+// only the ones whose url contains the q parameter.
+func HandleExportOPML(w http.ResponseWriter, r *http.Request, store storage.Storage) {
+	metrics.ExportRequests.Inc()
+	query := r.URL.Query().Get("q")
+
+	var feeds []feed.Entity
+	cursor := ""
+	for {
+		page, err := store.ListFeeds(cursor, exportPageSize)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		for _, entity := range page {
+			if strings.Contains(entity.URL, query) {
+				feeds = append(feeds, entity)
+			}
+		}
+		if len(page) < exportPageSize {
+			break
+		}
+		cursor = page[len(page)-1].PublicKey
+	}
+
+	writeOPML(w, "rsslay feeds", "rsslay.opml", feeds)
+}
+
+// writeOPML sends the feeds as an OPML document to download, with the npub
+// of each one in a custom attribute.
+func writeOPML(w http.ResponseWriter, title string, filename string, feeds []feed.Entity) {
+	document := opml.Document{
+		Head: opml.Head{Title: title, DateCreated: time.Now().UTC().Format(time.RFC1123Z)},
+		Body: opml.Body{Outlines: make([]opml.Outline, len(feeds))},
+	}
+	for i, entity := range feeds {
+		nPubKey, _ := nip19.EncodePublicKey(entity.PublicKey)
+		document.Body.Outlines[i] = opml.Outline{Text: entity.URL, Type: "rss", XMLURL: entity.URL, NPub: nPubKey}
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if err := document.Write(w); err != nil {
+		log.Printf("[ERROR] failed to write OPML export: %v", err)
+	}
+}
+
+// readOPML parses the OPML document of the opml field of a multipart form,
+// or else of the request body.
+func readOPML(w http.ResponseWriter, r *http.Request) (*opml.Document, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxOPMLSize)
+
+	var reader io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("opml")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	return opml.Parse(reader)
+}
+
+// importOPML registers the feeds of the document a few at a time, since each
+// one is fetched first, keeping the results in document order.
+func importOPML(document *opml.Document, store storage.Storage, secret *string) ([]ImportedFeed, error) {
+	urls := document.FeedURLs()
+	if len(urls) == 0 {
+		return nil, errors.New("no feeds found in the OPML file (outlines need a xmlUrl attribute)")
+	}
+	if len(urls) > maxImportedFeeds {
+		return nil, fmt.Errorf("too many feeds in the OPML file, import at most %d at a time", maxImportedFeeds)
+	}
+
+	imported := make([]ImportedFeed, len(urls))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < importConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				entry := createFeedEntryFromURL(urls[index], store, secret)
+				imported[index] = ImportedFeed{XmlUrl: urls[index], Entry: *entry}
+			}
+		}()
+	}
+	for i := range urls {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	log.Printf("[DEBUG] imported %d feeds from OPML file", len(imported))
+	return imported, nil
+}
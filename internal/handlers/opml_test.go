@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/opml"
+	"github.com/stretchr/testify/assert"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleFeed = `<rss version="2.0">
+<channel>
+<title>Sample</title>
+<link>https://example.com</link>
+<description>Sample feed</description>
+</channel>
+</rss>`
+
+func TestHandleApiImportOPML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rss" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(sampleFeed))
+	}))
+	defer server.Close()
+	assert.NoError(t, feed.AllowAddresses([]string{"127.0.0.1"}))
+	t.Cleanup(func() { _ = feed.AllowAddresses(nil) })
+
+	store := openTestStorage(t)
+	secret := "secret"
+	dsn := filepath.Join(t.TempDir(), "rsslay.sqlite")
+	document := `<opml version="2.0"><body>
+		<outline text="Folder">
+			<outline text="Working" xmlUrl="` + server.URL + `/rss"/>
+			<outline text="Missing" xmlUrl="` + server.URL + `/missing"/>
+		</outline>
+		<outline text="Invalid" xmlUrl="ftp://example.com/rss"/>
+	</body></opml>`
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("opml", "feeds.opml")
+	_, _ = part.Write([]byte(document))
+	_ = writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/opml", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	HandleApiImportOPML(recorder, req, store, &secret, &dsn)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var imported []ImportedFeed
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &imported))
+	assert.Len(t, imported, 3)
+	assert.Equal(t, server.URL+"/rss", imported[0].XmlUrl)
+	assert.False(t, imported[0].Error)
+	assert.NotEmpty(t, imported[0].NPubKey)
+	assert.True(t, imported[1].Error)
+	assert.Equal(t, "ftp://example.com/rss", imported[2].XmlUrl)
+	assert.True(t, imported[2].Error)
+
+	_, err := store.GetFeed(imported[0].PubKey)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	HandleApiImportOPML(recorder, httptest.NewRequest(http.MethodPost, "/api/opml", strings.NewReader("<opml><body/></opml>")), store, &secret, &dsn)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHandleApiImportOPMLLimitsImportsOfEachClient(t *testing.T) {
+	LimitOPMLImports(1)
+	t.Cleanup(func() { LimitOPMLImports(0) })
+	store := openTestStorage(t)
+	secret := "secret"
+	dsn := filepath.Join(t.TempDir(), "rsslay.sqlite")
+
+	recorder := httptest.NewRecorder()
+	HandleApiImportOPML(recorder, httptest.NewRequest(http.MethodPost, "/api/opml", strings.NewReader("<opml><body/></opml>")), store, &secret, &dsn)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	HandleApiImportOPML(recorder, httptest.NewRequest(http.MethodPost, "/api/opml", strings.NewReader("<opml><body/></opml>")), store, &secret, &dsn)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/opml", strings.NewReader("<opml><body/></opml>"))
+	req.RemoteAddr = "192.0.2.2:1234"
+	recorder = httptest.NewRecorder()
+	HandleApiImportOPML(recorder, req, store, &secret, &dsn)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestImportOPMLRefusesTooManyFeeds(t *testing.T) {
+	var outlines []opml.Outline
+	for i := 0; i <= maxImportedFeeds; i++ {
+		outlines = append(outlines, opml.Outline{XMLURL: fmt.Sprintf("https://example.com/%d/rss", i)})
+	}
+
+	_, err := importOPML(&opml.Document{Body: opml.Body{Outlines: outlines}}, nil, nil)
+	assert.ErrorContains(t, err, "too many feeds")
+}
+
+func TestHandleExportOPML(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(feed.Entity{PublicKey: strings.Repeat("ab", 32), PrivateKey: "private", URL: "https://example.org/atom"})
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	HandleExportOPML(recorder, httptest.NewRequest(http.MethodGet, "/api/opml", nil), store)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/x-opml; charset=utf-8", recorder.Header().Get("Content-Type"))
+	document, err := opml.Parse(recorder.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{feedUrl, "https://example.org/atom"}, document.FeedURLs())
+	assert.True(t, strings.HasPrefix(document.Body.Outlines[0].NPub, "npub1"))
+
+	recorder = httptest.NewRecorder()
+	HandleExportOPML(recorder, httptest.NewRequest(http.MethodGet, "/api/opml?q=example.org", nil), store)
+	document, err = opml.Parse(recorder.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.org/atom"}, document.FeedURLs())
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"github.com/piraces/rsslay/pkg/helpers"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientLimiter lets each client, told apart by helpers.ClientAddress, make
+// up to perMinute requests a minute, all of them at once if it was quiet
+// before.
+type clientLimiter struct {
+	perMinute int
+
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter
+	sweptAt  time.Time
+}
+
+func newClientLimiter(perMinute int) *clientLimiter {
+	return &clientLimiter{perMinute: perMinute, limiters: map[string]*rate.Limiter{}}
+}
+
+// wait returns how long the client of the request has to wait before making
+// it, zero if it can make it now, counting it if so. Without a limit every
+// request can be made.
+func (l *clientLimiter) wait(r *http.Request) time.Duration {
+	if l == nil || l.perMinute <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// forget the clients quiet for long enough to be allowed a full burst
+	if now.Sub(l.sweptAt) >= time.Minute {
+		for client, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.perMinute) {
+				delete(l.limiters, client)
+			}
+		}
+		l.sweptAt = now
+	}
+
+	client := helpers.ClientAddress(r)
+	limiter, ok := l.limiters[client]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(float64(l.perMinute)/60), l.perMinute)
+		l.limiters[client] = limiter
+	}
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// allow writes a 429 response telling when to come back if the client of
+// the request has to wait before making it.
+func (l *clientLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	delay := l.wait(r)
+	if delay == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "Too many requests, please try again later")
+	return false
+}
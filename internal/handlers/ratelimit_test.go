@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimiterForgetsQuietClients(t *testing.T) {
+	// a request a hundredth of a second
+	limiter := newClientLimiter(6000)
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Zero(t, limiter.wait(req))
+	assert.Len(t, limiter.limiters, 1)
+
+	// once a full burst is allowed again, the client is forgotten on the
+	// next sweep
+	time.Sleep(20 * time.Millisecond)
+	limiter.sweptAt = time.Now().Add(-time.Minute)
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	assert.Zero(t, limiter.wait(other))
+	assert.Len(t, limiter.limiters, 1)
+	assert.Contains(t, limiter.limiters, "192.0.2.2")
+}
+
+func TestClientLimiterWithoutLimitAllowsEverything(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, limiter := range []*clientLimiter{nil, newClientLimiter(0)} {
+		for i := 0; i < 10; i++ {
+			assert.Zero(t, limiter.wait(req))
+		}
+	}
+}
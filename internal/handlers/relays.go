@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"github.com/piraces/rsslay/pkg/replayer"
+	"github.com/piraces/rsslay/pkg/storage"
+	"net/http"
+)
+
+// RelayReport tells how a relay events are replayed to has been answering,
+// counting its deliveries by status and outcome of their last attempt.
+type RelayReport struct {
+	replayer.RelayState
+	Statuses map[string]int
+	Outcomes map[string]int
+}
+
+// handleListRelays reports on every relay events are replayed to, or were
+// before being removed from the configuration.
+func (a *AdminAPI) handleListRelays(w http.ResponseWriter, _ *http.Request) {
+	stats, err := a.Store.RelayDeliveryStats()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	var states []replayer.RelayState
+	if a.Outbox != nil {
+		states = a.Outbox.RelayStates()
+	}
+	writeJSON(w, http.StatusOK, relayReports(states, stats))
+}
+
+// handleListDeliveries lists the latest deliveries, optionally only the ones
+// of an event_id, relay, status or outcome.
+func (a *AdminAPI) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	deliveries, err := a.Store.ListDeliveries(storage.DeliveryFilter{
+		EventID: query.Get("event_id"),
+		Relay:   query.Get("relay"),
+		Status:  query.Get("status"),
+		Outcome: query.Get("outcome"),
+	}, limit)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// handleResumeRelay replays events again right away to the relay of the url
+// parameter, paused after refusing too many of them.
+func (a *AdminAPI) handleResumeRelay(w http.ResponseWriter, r *http.Request) {
+	if a.Outbox == nil {
+		writeError(w, http.StatusNotFound, "Replaying events to other relays is disabled")
+		return
+	}
+
+	relay := r.URL.Query().Get("url")
+	if !a.Outbox.Resume(relay) {
+		writeError(w, http.StatusNotFound, "Relay not paused")
+		return
+	}
+	for _, state := range a.Outbox.RelayStates() {
+		if state.Relay == relay {
+			writeJSON(w, http.StatusOK, state)
+			return
+		}
+	}
+}
+
+// relayReports merges the state of the relays with their delivery counts,
+// in the order of the states and then of the relays only counted.
+func relayReports(states []replayer.RelayState, stats []storage.RelayDeliveryStats) []RelayReport {
+	reports := make([]RelayReport, 0, len(states))
+	indexes := make(map[string]int)
+	for _, state := range states {
+		indexes[state.Relay] = len(reports)
+		reports = append(reports, RelayReport{RelayState: state, Statuses: map[string]int{}, Outcomes: map[string]int{}})
+	}
+	for _, relayStats := range stats {
+		index, ok := indexes[relayStats.Relay]
+		if !ok {
+			index = len(reports)
+			reports = append(reports, RelayReport{RelayState: replayer.RelayState{Relay: relayStats.Relay}})
+		}
+		reports[index].Statuses = relayStats.Statuses
+		reports[index].Outcomes = relayStats.Outcomes
+	}
+	return reports
+}
@@ -0,0 +1,92 @@
+package contacts
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/helpers"
+	"log"
+	"sync"
+)
+
+// ErrContactListNotFound is returned when none of the relays has a contact
+// list of the public key.
+var ErrContactListNotFound = errors.New("contact list not found")
+
+// FetchContactList asks every relay for the kind 3 contact list of the public
+// key and returns the newest one any of them has, skipping the ones not
+// signed by the public key.
+func FetchContactList(ctx context.Context, relays []string, pubKey string) (*nostr.Event, error) {
+	filter := nostr.Filter{Kinds: []int{nostr.KindContactList}, Authors: []string{pubKey}, Limit: 1}
+
+	var (
+		newest *nostr.Event
+		mutex  sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, url := range relays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := nostr.RelayConnect(ctx, url)
+			if err != nil {
+				log.Printf("[DEBUG] failed to connect to %s to fetch the contact list of %s: %v", url, pubKey, err)
+				return
+			}
+			defer relay.Close()
+
+			events, err := relay.QuerySync(ctx, filter)
+			if err != nil {
+				log.Printf("[DEBUG] failed to fetch the contact list of %s from %s: %v", pubKey, url, err)
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, evt := range events {
+				if !validContactList(evt, pubKey) {
+					log.Printf("[DEBUG] ignoring invalid contact list %s of %s from %s", evt.ID, pubKey, url)
+					continue
+				}
+				if newest == nil || evt.CreatedAt > newest.CreatedAt {
+					newest = evt
+				}
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	if newest == nil {
+		return nil, ErrContactListNotFound
+	}
+	return newest, nil
+}
+
+// validContactList reports whether the event is a contact list of the public
+// key with a valid id and signature, so relays can't make one up.
+func validContactList(evt *nostr.Event, pubKey string) bool {
+	if evt.Kind != nostr.KindContactList || evt.PubKey != pubKey || evt.GetID() != evt.ID {
+		return false
+	}
+	ok, err := evt.CheckSignature()
+	return ok && err == nil
+}
+
+// FollowedPubKeys returns the public keys of the p tags of a contact list,
+// without duplicates and in the order they are followed.
+func FollowedPubKeys(contactList *nostr.Event) []string {
+	var pubKeys []string
+	seen := make(map[string]bool)
+	for _, tag := range contactList.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		pubKey, err := helpers.ParsePubKey(tag[1])
+		if err != nil || seen[pubKey] {
+			continue
+		}
+		seen[pubKey] = true
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return pubKeys
+}
@@ -0,0 +1,58 @@
+package contacts
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const (
+	samplePrivateKey = "4d0888c07093941c9db16fcffb96fdf8af49a6839e865ea6110c7ab7cbd2d3d3"
+	samplePubKey     = "1a21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+	otherPubKey      = "ff21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+)
+
+func TestFollowedPubKeysSkipsInvalidAndRepeatedTags(t *testing.T) {
+	contactList := &nostr.Event{
+		Kind: nostr.KindContactList,
+		Tags: nostr.Tags{
+			{"p", otherPubKey, "wss://relay.example.com"},
+			{"e", samplePubKey},
+			{"p"},
+			{"p", "not-a-key"},
+			{"p", samplePubKey},
+			{"p", otherPubKey},
+		},
+	}
+
+	assert.Equal(t, []string{otherPubKey, samplePubKey}, FollowedPubKeys(contactList))
+}
+
+func TestFetchContactListWithoutRelaysReturnsNotFound(t *testing.T) {
+	_, err := FetchContactList(context.Background(), nil, samplePubKey)
+	assert.ErrorIs(t, err, ErrContactListNotFound)
+}
+
+func TestValidContactListChecksSignature(t *testing.T) {
+	signerPubKey, _ := nostr.GetPublicKey(samplePrivateKey)
+	signed := func() *nostr.Event {
+		evt := &nostr.Event{Kind: nostr.KindContactList, CreatedAt: 1000, Tags: nostr.Tags{{"p", otherPubKey}}}
+		assert.NoError(t, evt.Sign(samplePrivateKey))
+		return evt
+	}
+
+	assert.True(t, validContactList(signed(), signerPubKey))
+	assert.False(t, validContactList(signed(), otherPubKey))
+
+	tampered := signed()
+	tampered.Tags = append(tampered.Tags, nostr.Tag{"p", samplePubKey})
+	assert.False(t, validContactList(tampered, signerPubKey))
+	tampered.ID = tampered.GetID()
+	assert.False(t, validContactList(tampered, signerPubKey))
+
+	impersonated := signed()
+	impersonated.PubKey = otherPubKey
+	impersonated.ID = impersonated.GetID()
+	assert.False(t, validContactList(impersonated, otherPubKey))
+}
@@ -1,46 +1,86 @@
 package events
 
 import (
-	"database/sql"
+	"errors"
 	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/piraces/rsslay/pkg/feed"
 	"github.com/piraces/rsslay/pkg/helpers"
 	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"net/url"
 	"strings"
+	"time"
 )
 
-func GetParsedFeedForPubKey(pubKey string, db *sql.DB, deleteFailingFeeds bool, nitterInstances []string) (*gofeed.Feed, feed.Entity) {
-	pubKey = strings.TrimSpace(pubKey)
-	row := db.QueryRow("SELECT privatekey, url, nitter FROM feeds WHERE publickey=$1", pubKey)
+// Options holds the settings used to turn parsed feeds into nostr events.
+type Options struct {
+	MaxContentLength            int
+	EnableAutoNIP05Registration bool
+	DefaultProfilePictureUrl    string
+	MainDomainName              string
+	// EnableLongFormEvents also converts items into NIP-23 long-form articles.
+	EnableLongFormEvents bool
+	// LongFormEventsOnly skips the text notes when long-form articles are enabled.
+	LongFormEventsOnly bool
+	// EnablePodcastEvents also converts the audio of podcast episodes into
+	// NIP-94 file metadata events, mentioned by their text notes.
+	EnablePodcastEvents bool
+	// Hashtags are the hashtag settings of feeds not overriding them.
+	Hashtags feed.Hashtags
+	// RelayURL is the websocket url of the instance, listed first in the
+	// NIP-65 relay list of every feed.
+	RelayURL string
+	// ReplayToRelays lists in the relay lists the relays events are replayed
+	// to: WriteRelays, unless the feed overrides them.
+	ReplayToRelays bool
+	WriteRelays    []string
+}
 
-	var entity feed.Entity
-	err := row.Scan(&entity.PrivateKey, &entity.URL, &entity.Nitter)
-	if err != nil && err == sql.ErrNoRows {
-		return nil, entity
+func GetParsedFeedForPubKey(pubKey string, store storage.Storage, deleteFailingFeeds bool, nitterInstances []string) (*gofeed.Feed, feed.Entity) {
+	pubKey = strings.TrimSpace(pubKey)
+	entity, err := store.GetFeed(pubKey)
+	if err == storage.ErrFeedNotFound {
+		return nil, feed.Entity{}
 	} else if err != nil {
 		log.Printf("[ERROR] failed when trying to retrieve row with pubkey '%s': %v", pubKey, err)
 		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
+		return nil, feed.Entity{}
+	}
+
+	result, entity, _ := FetchFeedForEntity(entity, nil, store, deleteFailingFeeds, nitterInstances)
+	if result == nil {
 		return nil, entity
 	}
 
+	return result.Feed, entity
+}
+
+// FetchFeedForEntity fetches the feed of a stored entity without going through
+// the cache, falling back to other Nitter instances when needed.
+// The validators of the previous fetch, if any, make the request conditional.
+// A nil result is returned when the feed can't be fetched, along with the
+// error it failed with, or no error if its host asked to retry later. Feeds
+// not fetched in time because of the rate limit of their host are reported
+// with a *feed.ThrottledError, which isn't a failure of the feed.
+func FetchFeedForEntity(entity feed.Entity, validators *feed.Validators, store storage.Storage, deleteFailingFeeds bool, nitterInstances []string) (*feed.FetchResult, feed.Entity, error) {
 	if !helpers.IsValidHttpUrl(entity.URL) {
 		log.Printf("[INFO] retrieved invalid url from database %q", entity.URL)
 		if deleteFailingFeeds {
-			feed.DeleteInvalidFeed(entity.URL, db)
+			deleteInvalidFeed(entity.URL, store)
 		}
-		return nil, entity
+		return nil, entity, errors.New("invalid feed url")
 	}
 
-	parsedFeed, err := feed.ParseFeed(entity.URL)
+	result, err := feed.FetchFeed(entity.URL, validators)
 	if err != nil && entity.Nitter {
 		log.Printf("[DEBUG] failed to parse feed at url %q: %v. Now iterating through other Nitter instances", entity.URL, err)
 		for i, instance := range nitterInstances {
 			newUrl, _ := setHostname(entity.URL, instance)
 			log.Printf("[DEBUG] attempt %d: use %q instead of %q", i, newUrl, entity.URL)
-			parsedFeed, err = feed.ParseFeed(newUrl)
+			result, err = feed.FetchFeed(newUrl, nil)
 			if err == nil {
 				log.Printf("[DEBUG] attempt %d: success with %q", i, newUrl)
 				break
@@ -48,25 +88,99 @@ func GetParsedFeedForPubKey(pubKey string, db *sql.DB, deleteFailingFeeds bool,
 		}
 	}
 
+	var retryAfterError *feed.RetryAfterError
+	if errors.As(err, &retryAfterError) {
+		log.Printf("[DEBUG] skipped feed at url %q: %v", entity.URL, err)
+		return nil, entity, nil
+	}
+
+	var throttledError *feed.ThrottledError
+	if errors.As(err, &throttledError) {
+		log.Printf("[DEBUG] postponed feed at url %q: %v", entity.URL, err)
+		return nil, entity, err
+	}
+
 	if err != nil {
 		log.Printf("[DEBUG] failed to parse feed at url %q: %v", entity.URL, err)
 		if deleteFailingFeeds {
-			feed.DeleteInvalidFeed(entity.URL, db)
+			deleteInvalidFeed(entity.URL, store)
 		}
-		return nil, entity
+		return nil, entity, err
 	}
 
-	if strings.Contains(parsedFeed.Description, "Twitter feed") && !entity.Nitter {
-		updateDatabaseEntry(&entity, db)
+	if result.Feed != nil && strings.Contains(result.Feed.Description, "Twitter feed") && !entity.Nitter {
+		updateDatabaseEntry(&entity, store)
 		entity.Nitter = true
 	}
 
-	return parsedFeed, entity
+	return result, entity, nil
+}
+
+// FeedToEvents converts a parsed feed into signed events: its profile, its
+// relay list unless it has no relays to list nor overrides them, and for
+// every item with a date a text note, a long-form article if enabled, alone
+// if set so, and a file metadata event for podcast episodes if enabled.
+// Items without a date are skipped, as they would produce a different event
+// each time.
+func FeedToEvents(pubKey string, parsedFeed *gofeed.Feed, entity feed.Entity, options *Options) []nostr.Event {
+	var parsedEvents []nostr.Event
+
+	evt := feed.EntryFeedToSetMetadata(pubKey, parsedFeed, entity.URL, options.EnableAutoNIP05Registration, options.DefaultProfilePictureUrl, options.MainDomainName, entity.SiteImage)
+	_ = evt.Sign(entity.PrivateKey)
+	parsedEvents = append(parsedEvents, evt)
+
+	var writeRelays []string
+	if options.ReplayToRelays {
+		writeRelays = entity.WriteRelays(options.WriteRelays)
+	}
+	// a feed overriding its relays publishes its relay list even if empty,
+	// replacing the one listing the relays it no longer writes to
+	if options.RelayURL != "" || len(writeRelays) > 0 || entity.Relays != nil {
+		evt := feed.RelayList(pubKey, options.RelayURL, writeRelays)
+		_ = evt.Sign(entity.PrivateKey)
+		parsedEvents = append(parsedEvents, evt)
+	}
+
+	hashtags := entity.Hashtags.Apply(options.Hashtags)
+	for _, item := range parsedFeed.Items {
+		defaultCreatedAt := time.Unix(time.Now().Unix(), 0)
+
+		// Feed need to have a date for each entry...
+		if item.PublishedParsed == nil && item.UpdatedParsed == nil {
+			continue
+		}
+
+		var fileEvt *nostr.Event
+		if options.EnablePodcastEvents {
+			if evt, ok := feed.ItemToFileMetadata(pubKey, item, parsedFeed, defaultCreatedAt); ok {
+				_ = evt.Sign(entity.PrivateKey)
+				parsedEvents = append(parsedEvents, evt)
+				fileEvt = &evt
+			}
+		}
+
+		if !options.EnableLongFormEvents || !options.LongFormEventsOnly {
+			evt := feed.ItemToTextNote(pubKey, item, parsedFeed, defaultCreatedAt, entity.URL, options.MaxContentLength, hashtags)
+			if fileEvt != nil {
+				evt.Tags = append(evt.Tags, nostr.Tag{"e", fileEvt.ID, "", "mention"})
+			}
+			_ = evt.Sign(entity.PrivateKey)
+			parsedEvents = append(parsedEvents, evt)
+		}
+
+		if options.EnableLongFormEvents {
+			evt := feed.ItemToArticle(pubKey, item, parsedFeed, defaultCreatedAt, hashtags)
+			_ = evt.Sign(entity.PrivateKey)
+			parsedEvents = append(parsedEvents, evt)
+		}
+	}
+
+	return parsedEvents
 }
 
-func updateDatabaseEntry(entity *feed.Entity, db *sql.DB) {
+func updateDatabaseEntry(entity *feed.Entity, store storage.Storage) {
 	log.Printf("[DEBUG] attempting to set feed at url %q with publicKey %s as nitter instance", entity.URL, entity.PublicKey)
-	if _, err := db.Exec(`UPDATE feeds SET nitter = ? WHERE publickey = ?`, 1, entity.PublicKey); err != nil {
+	if err := store.SetFeedNitter(entity.PublicKey, true); err != nil {
 		log.Printf("[ERROR] failure while updating record on db to set as nitter feed: %v", err)
 		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
 	} else {
@@ -74,6 +188,15 @@ func updateDatabaseEntry(entity *feed.Entity, db *sql.DB) {
 	}
 }
 
+func deleteInvalidFeed(url string, store storage.Storage) {
+	if err := store.DeleteFeed(url); err != nil {
+		log.Printf("[ERROR] failure to delete invalid feed: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+	} else {
+		log.Printf("[DEBUG] deleted invalid feed with url %q", url)
+	}
+}
+
 func setHostname(addr, hostname string) (string, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
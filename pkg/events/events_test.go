@@ -4,9 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/storage"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 const samplePubKey = "73e247ee8c4ff09a50525bed7b0869c371864c0bf2b4d6a2639acaed07613958"
@@ -16,7 +20,7 @@ const sampleInvalidNitterFeedUrl = "https://example.com/Twitter/rss"
 const sampleValidUrl = "https://mastodon.social/"
 
 var nitterInstances = []string{"birdsite.xanny.family", "notabird.site", "nitter.moomoo.me", "nitter.fly.dev"}
-var sqlRows = []string{"privatekey", "url", "nitter"}
+var sqlRows = []string{"privatekey", "url", "nitter", "hashtags_in_content", "max_hashtags", "relays", "site_image", "site_image_checked_at"}
 
 func TestGetParsedFeedForNitterPubKey(t *testing.T) {
 	t.Skip()
@@ -25,14 +29,14 @@ func TestGetParsedFeedForNitterPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, true)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, true, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.NotNil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        sampleValidNitterFeedUrl,
 		Nitter:     true,
@@ -47,16 +51,16 @@ func TestGetParsedFeedForExistingOutdatedNitterPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	mock.ExpectExec("UPDATE feeds").WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.NotNil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        sampleValidNitterFeedUrl,
 		Nitter:     true,
@@ -71,15 +75,15 @@ func TestGetParsedFeedForErrorExistingOutdatedNitterPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	mock.ExpectExec("UPDATE feeds").WillReturnError(errors.New("error"))
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.NotNil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        sampleValidNitterFeedUrl,
 		Nitter:     true,
@@ -93,11 +97,11 @@ func TestGetParsedFeedSQLErrorForNitterPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnError(errors.New("error"))
+	rows.AddRow(samplePrivateKey, sampleValidNitterFeedUrl, false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnError(errors.New("error"))
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.Nil(t, parsedFeed)
 	assert.Empty(t, entity)
 	_ = db.Close()
@@ -109,14 +113,14 @@ func TestGetParsedFeedInvalidFeedUrlForNitterPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleInvalidNitterFeedUrl, false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, sampleInvalidNitterFeedUrl, false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.Nil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        sampleInvalidNitterFeedUrl,
 		Nitter:     false,
@@ -130,16 +134,16 @@ func TestGetParsedFeedInvalidFeedUrlForStandardPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, sampleValidUrl, false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, sampleValidUrl, false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	expectedDeleteQuery := fmt.Sprintf("DELETE FROM feeds WHERE url=%s", sampleValidUrl)
 	mock.ExpectQuery(expectedDeleteQuery)
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.Nil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        sampleValidUrl,
 		Nitter:     false,
@@ -153,19 +157,156 @@ func TestGetParsedFeedInvalidUrlForStandardPubKey(t *testing.T) {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	rows := sqlmock.NewRows(sqlRows)
-	rows.AddRow(samplePrivateKey, "not a url", false)
-	mock.ExpectQuery("SELECT privatekey, url, nitter FROM feeds").WillReturnRows(rows)
+	rows.AddRow(samplePrivateKey, "not a url", false, nil, nil, nil, "", 0)
+	mock.ExpectQuery("SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, .* FROM feeds").WillReturnRows(rows)
 	expectedDeleteQuery := fmt.Sprintf("DELETE FROM feeds WHERE url=%s", sampleValidUrl)
 	mock.ExpectQuery(expectedDeleteQuery)
 	mock.ExpectClose()
 
-	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, db, true, nitterInstances)
+	parsedFeed, entity := GetParsedFeedForPubKey(samplePubKey, storage.NewSQLite(db), true, nitterInstances)
 	assert.Nil(t, parsedFeed)
 	assert.Equal(t, feed.Entity{
-		PublicKey:  "",
+		PublicKey:  samplePubKey,
 		PrivateKey: samplePrivateKey,
 		URL:        "not a url",
 		Nitter:     false,
 	}, entity)
 	_ = db.Close()
 }
+
+func TestFeedToEventsLongFormModes(t *testing.T) {
+	publishedAt := time.Unix(1676723717, 0)
+	parsedFeed := &gofeed.Feed{
+		Title:    "Blog",
+		FeedLink: "https://example.com/feed.xml",
+		Items: []*gofeed.Item{
+			{Title: "Dated", Content: "<p>Full article</p>", Link: "https://example.com/dated", GUID: "dated", PublishedParsed: &publishedAt},
+			{Title: "Undated", Content: "<p>Skipped</p>", Link: "https://example.com/undated", GUID: "undated"},
+		},
+	}
+	entity := feed.Entity{PublicKey: samplePubKey, PrivateKey: samplePrivateKey, URL: parsedFeed.FeedLink}
+
+	testCases := []struct {
+		options       Options
+		expectedKinds []int
+	}{
+		{
+			options:       Options{MaxContentLength: 250},
+			expectedKinds: []int{nostr.KindSetMetadata, nostr.KindTextNote},
+		},
+		{
+			options:       Options{MaxContentLength: 250, EnableLongFormEvents: true},
+			expectedKinds: []int{nostr.KindSetMetadata, nostr.KindTextNote, nostr.KindArticle},
+		},
+		{
+			options:       Options{MaxContentLength: 250, EnableLongFormEvents: true, LongFormEventsOnly: true},
+			expectedKinds: []int{nostr.KindSetMetadata, nostr.KindArticle},
+		},
+		{
+			options:       Options{MaxContentLength: 250, LongFormEventsOnly: true},
+			expectedKinds: []int{nostr.KindSetMetadata, nostr.KindTextNote},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		var kinds []int
+		for _, evt := range FeedToEvents(samplePubKey, parsedFeed, entity, &tc.options) {
+			ok, _ := evt.CheckSignature()
+			assert.True(t, ok)
+			kinds = append(kinds, evt.Kind)
+		}
+		assert.Equal(t, tc.expectedKinds, kinds)
+	}
+}
+
+func TestFeedToEventsPodcastEpisodes(t *testing.T) {
+	publishedAt := time.Unix(1676723717, 0)
+	parsedFeed := &gofeed.Feed{
+		Title:    "Podcast",
+		FeedLink: "https://example.com/podcast.xml",
+		Items: []*gofeed.Item{
+			{
+				Title:           "Episode 1",
+				Description:     "<p>First episode</p>",
+				Link:            "https://example.com/episode-1",
+				GUID:            "episode-1",
+				PublishedParsed: &publishedAt,
+				Enclosures:      []*gofeed.Enclosure{{URL: "https://example.com/episode-1.mp3", Type: "audio/mpeg", Length: "1024"}},
+			},
+		},
+	}
+	entity := feed.Entity{PublicKey: samplePubKey, PrivateKey: samplePrivateKey, URL: parsedFeed.FeedLink}
+
+	parsedEvents := FeedToEvents(samplePubKey, parsedFeed, entity, &Options{MaxContentLength: 250, EnablePodcastEvents: true})
+	assert.Len(t, parsedEvents, 3)
+	fileEvt, note := parsedEvents[1], parsedEvents[2]
+	assert.Equal(t, feed.KindFileMetadata, fileEvt.Kind)
+	assert.Equal(t, nostr.KindTextNote, note.Kind)
+	assert.Equal(t, fileEvt.ID, note.Tags.GetFirst([]string{"e", ""}).Value())
+	for _, evt := range parsedEvents {
+		ok, _ := evt.CheckSignature()
+		assert.True(t, ok)
+	}
+
+	parsedEvents = FeedToEvents(samplePubKey, parsedFeed, entity, &Options{MaxContentLength: 250})
+	assert.Len(t, parsedEvents, 2)
+	assert.Nil(t, parsedEvents[1].Tags.GetFirst([]string{"e", ""}))
+}
+
+func TestFeedToEventsRelayList(t *testing.T) {
+	publishedAt := time.Unix(1676723717, 0)
+	parsedFeed := &gofeed.Feed{
+		Title:    "Blog",
+		FeedLink: "https://example.com/feed.xml",
+		Items:    []*gofeed.Item{{Title: "Dated", Link: "https://example.com/dated", GUID: "dated", PublishedParsed: &publishedAt}},
+	}
+	entity := feed.Entity{PublicKey: samplePubKey, PrivateKey: samplePrivateKey, URL: parsedFeed.FeedLink}
+	writeRelays := []string{"wss://relay.example.com"}
+
+	testCases := []struct {
+		options      Options
+		entityRelays []string
+		expectedTags nostr.Tags
+	}{
+		{
+			options: Options{MaxContentLength: 250},
+		},
+		{
+			options:      Options{MaxContentLength: 250, RelayURL: "wss://rsslay.example.com", WriteRelays: writeRelays},
+			expectedTags: nostr.Tags{{"r", "wss://rsslay.example.com"}},
+		},
+		{
+			options:      Options{MaxContentLength: 250, RelayURL: "wss://rsslay.example.com", ReplayToRelays: true, WriteRelays: writeRelays},
+			expectedTags: nostr.Tags{{"r", "wss://rsslay.example.com"}, {"r", "wss://relay.example.com", "write"}},
+		},
+		{
+			options:      Options{MaxContentLength: 250, ReplayToRelays: true, WriteRelays: writeRelays},
+			entityRelays: []string{"wss://relay.example.org"},
+			expectedTags: nostr.Tags{{"r", "wss://relay.example.org", "write"}},
+		},
+		{
+			options:      Options{MaxContentLength: 250, ReplayToRelays: true, WriteRelays: writeRelays},
+			entityRelays: []string{},
+			expectedTags: nostr.Tags{},
+		},
+		{
+			options:      Options{MaxContentLength: 250, WriteRelays: writeRelays},
+			entityRelays: []string{"wss://relay.example.org"},
+			expectedTags: nostr.Tags{},
+		},
+	}
+	for _, tc := range testCases {
+		entity.Relays = tc.entityRelays
+		parsedEvents := FeedToEvents(samplePubKey, parsedFeed, entity, &tc.options)
+		if tc.expectedTags == nil {
+			assert.Len(t, parsedEvents, 2)
+			continue
+		}
+		assert.Len(t, parsedEvents, 3)
+		relayList := parsedEvents[1]
+		assert.Equal(t, nostr.KindRelayListMetadata, relayList.Kind)
+		assert.Equal(t, tc.expectedTags, relayList.Tags)
+		ok, _ := relayList.CheckSignature()
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,145 @@
+package feed
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DomainRule matches feed hosts in one of three ways:
+//   - "example.com" matches that exact host,
+//   - ".example.com" matches example.com and all its subdomains,
+//   - "/regex/" matches the hosts the regular expression matches.
+type DomainRule struct {
+	rule    string
+	pattern *regexp.Regexp
+}
+
+// ParseDomainRule validates a rule, compiling it if it is a regular expression.
+func ParseDomainRule(rule string) (DomainRule, error) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		pattern, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return DomainRule{}, fmt.Errorf("invalid domain rule %q: %w", rule, err)
+		}
+		return DomainRule{rule: rule, pattern: pattern}, nil
+	}
+	if strings.Trim(rule, ".") == "" || strings.ContainsAny(rule, "/:*") {
+		return DomainRule{}, fmt.Errorf("invalid domain rule %q", rule)
+	}
+	return DomainRule{rule: rule}, nil
+}
+
+func (r DomainRule) String() string {
+	return r.rule
+}
+
+// Matches reports whether the host falls under the rule.
+func (r DomainRule) Matches(host string) bool {
+	host = strings.ToLower(host)
+	if r.pattern != nil {
+		return r.pattern.MatchString(host)
+	}
+	if strings.HasPrefix(r.rule, ".") {
+		return host == r.rule[1:] || strings.HasSuffix(host, r.rule)
+	}
+	return host == r.rule
+}
+
+// DomainPolicy decides which hosts feeds can be registered and fetched from.
+// Denied hosts are always refused and, when Allowed is not empty, hosts not
+// matching any of its rules are refused as well.
+type DomainPolicy struct {
+	Allowed []DomainRule
+	Denied  []DomainRule
+}
+
+// DomainNotAllowedError is returned for feeds whose host the domain policy
+// refuses. Rule is the deny rule matched, empty when no allow rule matched.
+type DomainNotAllowedError struct {
+	Host string
+	Rule string
+}
+
+func (e *DomainNotAllowedError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("domain %s is not in the list of allowed domains", e.Host)
+	}
+	return fmt.Sprintf("domain %s is blocked by rule %q", e.Host, e.Rule)
+}
+
+var (
+	domainPolicy      DomainPolicy
+	domainPolicyMutex sync.RWMutex
+)
+
+// ParseDomainPolicy builds a policy out of lists of allowed and denied rules.
+func ParseDomainPolicy(allowed []string, denied []string) (DomainPolicy, error) {
+	allowedRules, err := parseDomainRules(allowed)
+	if err != nil {
+		return DomainPolicy{}, err
+	}
+	deniedRules, err := parseDomainRules(denied)
+	if err != nil {
+		return DomainPolicy{}, err
+	}
+	return DomainPolicy{Allowed: allowedRules, Denied: deniedRules}, nil
+}
+
+func parseDomainRules(rules []string) ([]DomainRule, error) {
+	var domainRules []DomainRule
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		domainRule, err := ParseDomainRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		domainRules = append(domainRules, domainRule)
+	}
+	return domainRules, nil
+}
+
+// ConfigureDomainPolicy sets the policy checked when registering and
+// fetching feeds.
+func ConfigureDomainPolicy(policy DomainPolicy) {
+	domainPolicyMutex.Lock()
+	defer domainPolicyMutex.Unlock()
+	domainPolicy = policy
+}
+
+// CheckDomain returns a DomainNotAllowedError if the configured policy
+// refuses the host of the url.
+func CheckDomain(feedUrl string) error {
+	parsedUrl, err := url.Parse(feedUrl)
+	if err != nil {
+		return err
+	}
+
+	domainPolicyMutex.RLock()
+	defer domainPolicyMutex.RUnlock()
+	return domainPolicy.Check(parsedUrl.Hostname())
+}
+
+// Check returns a DomainNotAllowedError if the policy refuses the host.
+func (p DomainPolicy) Check(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range p.Denied {
+		if rule.Matches(host) {
+			return &DomainNotAllowedError{Host: host, Rule: rule.String()}
+		}
+	}
+	if len(p.Allowed) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allowed {
+		if rule.Matches(host) {
+			return nil
+		}
+	}
+	return &DomainNotAllowedError{Host: host}
+}
@@ -0,0 +1,68 @@
+package feed
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseDomainRule(t *testing.T) {
+	for _, invalid := range []string{"", ".", "https://example.com", "*.example.com", "/(/"} {
+		_, err := ParseDomainRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	testCases := []struct {
+		rule    string
+		host    string
+		matches bool
+	}{
+		{rule: "example.com", host: "example.com", matches: true},
+		{rule: "Example.com", host: "EXAMPLE.com", matches: true},
+		{rule: "example.com", host: "blog.example.com", matches: false},
+		{rule: ".example.com", host: "example.com", matches: true},
+		{rule: ".example.com", host: "blog.example.com", matches: true},
+		{rule: ".example.com", host: "badexample.com", matches: false},
+		{rule: "/^feeds?\\.spam/", host: "feed.spam.net", matches: true},
+		{rule: "/^feeds?\\.spam/", host: "blog.spam.net", matches: false},
+	}
+	for _, tc := range testCases {
+		rule, err := ParseDomainRule(tc.rule)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.matches, rule.Matches(tc.host), "%s on %s", tc.rule, tc.host)
+	}
+}
+
+func TestDomainPolicyCheck(t *testing.T) {
+	policy, err := ParseDomainPolicy([]string{".example.com", ""}, []string{"spam.example.com"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, policy.Check("blog.example.com"))
+	assert.NoError(t, policy.Check("example.com."))
+
+	var domainNotAllowedError *DomainNotAllowedError
+	err = policy.Check("spam.example.com")
+	assert.True(t, errors.As(err, &domainNotAllowedError))
+	assert.Equal(t, "domain spam.example.com is blocked by rule \"spam.example.com\"", err.Error())
+
+	err = policy.Check("example.org")
+	assert.True(t, errors.As(err, &domainNotAllowedError))
+	assert.Equal(t, "domain example.org is not in the list of allowed domains", err.Error())
+
+	policy, err = ParseDomainPolicy(nil, []string{"/spam/"})
+	assert.NoError(t, err)
+	assert.NoError(t, policy.Check("example.org"))
+	assert.Error(t, policy.Check("spam.example.org"))
+
+	_, err = ParseDomainPolicy([]string{"https://example.com"}, nil)
+	assert.Error(t, err)
+}
+
+func TestCheckDomain(t *testing.T) {
+	policy, _ := ParseDomainPolicy(nil, []string{".example.org"})
+	ConfigureDomainPolicy(policy)
+	t.Cleanup(func() { ConfigureDomainPolicy(DomainPolicy{}) })
+
+	assert.NoError(t, CheckDomain("https://example.com/rss"))
+	assert.Error(t, CheckDomain("https://blog.example.org:8080/rss"))
+}
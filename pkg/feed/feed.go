@@ -1,9 +1,9 @@
 package feed
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -19,31 +19,58 @@ import (
 	"github.com/piraces/rsslay/pkg/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"html"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var (
-	fp     = gofeed.NewParser()
 	client = &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) >= 2 {
 				return errors.New("stopped after 2 redirects")
 			}
-			return nil
+			return CheckDomain(req.URL.String())
 		},
-		Timeout: 5 * time.Second,
+		Transport: newPoliteTransport(newGuardedTransport(), Politeness{UserAgent: DefaultUserAgent}),
 	}
 )
 
+// Validators identify the last fetched version of a feed, so it is only
+// downloaded and parsed again when it changed.
+type Validators struct {
+	ETag         string
+	LastModified string
+	ContentHash  string
+}
+
+// FetchResult holds a freshly fetched feed along with the headers of the
+// response, which carry the caching hints given by the publisher.
+// When NotModified is set the feed did not change and Feed is nil.
+type FetchResult struct {
+	Feed        *gofeed.Feed
+	Header      http.Header
+	NotModified bool
+	Validators  Validators
+}
+
 type Entity struct {
 	PublicKey  string
 	PrivateKey string
 	URL        string
 	Nitter     bool
+	Hashtags   HashtagOverrides
+	// Relays overrides the relays the events of the feed are replayed to,
+	// nil meaning the instance defaults.
+	Relays []string
+	// SiteImage is the last image known to be shared by the site of the
+	// feed, the banner of its profile, checked at SiteImageCheckedAt.
+	SiteImage          string
+	SiteImageCheckedAt int64
 }
 
 var types = []string{
@@ -55,22 +82,34 @@ var types = []string{
 }
 
 func GetFeedURL(url string) string {
+	feedUrl, _ := FindFeedURL(url)
+	return feedUrl
+}
+
+// FindFeedURL returns the url itself if it serves a feed, or the feed linked
+// from it if it is an HTML page. Failing requests are reported as errors,
+// while an empty url means no feed was found.
+func FindFeedURL(url string) (string, error) {
 	resp, err := client.Get(url)
-	if err != nil || resp.StatusCode >= 300 {
-		return ""
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", nil
 	}
 
 	ct := resp.Header.Get("Content-Type")
 	for _, typ := range types {
 		if strings.Contains(ct, typ) {
-			return url
+			return url, nil
 		}
 	}
 
 	if strings.Contains(ct, "text/html") {
 		doc, err := goquery.NewDocumentFromReader(resp.Body)
 		if err != nil {
-			return ""
+			return "", nil
 		}
 
 		for _, typ := range types {
@@ -81,11 +120,11 @@ func GetFeedURL(url string) string {
 			if !strings.HasPrefix(href, "http") && !strings.HasPrefix(href, "https") {
 				href, _ = helpers.UrlJoin(url, href)
 			}
-			return href
+			return href, nil
 		}
 	}
 
-	return ""
+	return "", nil
 }
 
 func ParseFeed(url string) (*gofeed.Feed, error) {
@@ -106,18 +145,80 @@ func ParseFeed(url string) (*gofeed.Feed, error) {
 	}
 
 	metrics.CacheMiss.Inc()
+	result, err := FetchFeed(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Feed, nil
+}
+
+// FetchFeed downloads and parses the feed at the given url, bypassing the
+// cache but refreshing it with the parsed result.
+// If validators of a previous fetch are given, the request is conditional and
+// an unchanged feed is reported as not modified without parsing it again.
+func FetchFeed(url string, validators *Validators) (*FetchResult, error) {
+	fp := gofeed.NewParser()
 	fp.RSSTranslator = NewCustomTranslator()
-	feed, err := fp.ParseURL(url)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		metrics.FeedsNotModified.Inc()
+		return &FetchResult{Header: resp.Header, NotModified: true, Validators: *validators}, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	// cleanup a little so we don't store too much junk
-	for i := range feed.Items {
-		feed.Items[i].Content = ""
+	hash := sha256.Sum256(body)
+	result := &FetchResult{
+		Header: resp.Header,
+		Validators: Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ContentHash:  hex.EncodeToString(hash[:]),
+		},
+	}
+
+	if validators != nil && validators.ContentHash == result.Validators.ContentHash {
+		metrics.FeedsNotModified.Inc()
+		result.NotModified = true
+		return result, nil
 	}
 
-	marshal, err := json.Marshal(feed)
+	feed, err := fp.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	marshal, err := json.Marshal(withoutItemsContent(feed))
 	if err == nil {
 		err = custom_cache.Set(url, string(marshal))
 	}
@@ -127,10 +228,27 @@ func ParseFeed(url string) (*gofeed.Feed, error) {
 		metrics.AppErrors.With(prometheus.Labels{"type": "CACHE_SET"}).Inc()
 	}
 
-	return feed, nil
+	result.Feed = feed
+	return result, nil
 }
 
-func EntryFeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string, enableAutoRegistration bool, defaultProfilePictureUrl string, mainDomainName string) nostr.Event {
+// withoutItemsContent returns a copy of the feed without the full content of
+// its items, to cleanup a little so we don't cache too much junk.
+func withoutItemsContent(feed *gofeed.Feed) *gofeed.Feed {
+	cleaned := *feed
+	cleaned.Items = make([]*gofeed.Item, len(feed.Items))
+	for i, item := range feed.Items {
+		cleanedItem := *item
+		cleanedItem.Content = ""
+		cleaned.Items[i] = &cleanedItem
+	}
+	return &cleaned
+}
+
+// EntryFeedToSetMetadata describes the feed in the metadata event of its
+// profile, marked as automated with the NIP-24 bot field. The banner is the
+// image shared by the site of the feed, if any.
+func EntryFeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string, enableAutoRegistration bool, defaultProfilePictureUrl string, mainDomainName string, bannerUrl string) nostr.Event {
 	// Handle Nitter special cases (http schema)
 	if strings.Contains(feed.Description, "Twitter feed") {
 		if strings.HasPrefix(originalUrl, "https://") {
@@ -153,9 +271,21 @@ func EntryFeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string
 
 		theFeedTitle = "/r/" + subredditParsePart2[0]
 	}
-	metadata := map[string]string{
-		"name":  theFeedTitle + " (RSS Feed)",
-		"about": theDescription + "\n\n" + feed.Link,
+	metadata := map[string]any{
+		"name":         theFeedTitle + " (RSS Feed)",
+		"display_name": theFeedTitle,
+		"about":        theDescription + "\n\n" + feed.Link,
+		"bot":          true,
+	}
+
+	if helpers.IsValidHttpUrl(feed.Link) {
+		metadata["website"] = feed.Link
+	}
+	if bannerUrl != "" {
+		metadata["banner"] = bannerUrl
+	}
+	if lightningAddress := LightningAddress(feed); lightningAddress != "" {
+		metadata["lud16"] = lightningAddress
 	}
 
 	if enableAutoRegistration {
@@ -187,21 +317,13 @@ func EntryFeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string
 	return evt
 }
 
-func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, originalUrl string, maxContentLength int) nostr.Event {
+func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, originalUrl string, maxContentLength int, hashtags Hashtags) nostr.Event {
 	content := ""
 	if item.Title != "" {
 		content = "**" + item.Title + "**"
 	}
 
-	mdConverter := md.NewConverter("", true, nil)
-	mdConverter.AddRules(converter.GetConverterRules()...)
-
-	description, err := mdConverter.ConvertString(item.Description)
-	if err != nil {
-		log.Printf("[WARN] failure to convert description to markdown (defaulting to plain text): %v", err)
-		p := bluemonday.StripTagsPolicy()
-		description = p.Sanitize(item.Description)
-	}
+	description := toMarkdown(item.Description, converter.GetConverterRules()...)
 
 	if !strings.EqualFold(item.Title, description) && !strings.Contains(feed.Link, "stacker.news") && !strings.Contains(feed.Link, "reddit.com") {
 		content += "\n\n" + description
@@ -232,20 +354,21 @@ func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, default
 		content += description
 	}
 
-	if strings.Contains(feed.Link, "reddit.com") {
-		var subredditParsePart1 = strings.Split(feed.Link, "/r/")
-		var subredditParsePart2 = strings.Split(subredditParsePart1[1], "/")
-		var theHashtag = fmt.Sprintf(" #%s", subredditParsePart2[0])
-
-		content = content + "\n\n" + theHashtag
-
-	}
-
 	content = html.UnescapeString(content)
 	if len(content) > maxContentLength {
 		content = content[0:(maxContentLength-1)] + "…"
 	}
 
+	media := ItemMedia(item)
+	if urls := mediaContent(media, content); urls != "" {
+		content += "\n\n" + urls
+	}
+
+	itemHashtags := ItemHashtags(item, feed, hashtags.Max)
+	if inContent := contentHashtags(itemHashtags, feed, hashtags); len(inContent) > 0 {
+		content += "\n\n" + hashtagsContent(inContent)
+	}
+
 	if shouldUpgradeLinkSchema {
 		item.Link = strings.ReplaceAll(item.Link, "http://", "https://")
 	}
@@ -267,16 +390,16 @@ func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, default
 		createdAt = *item.PublishedParsed
 	}
 
-	composedProxyLink := feed.FeedLink
-	if item.GUID != "" {
-		composedProxyLink += fmt.Sprintf("#%s", url.QueryEscape(item.GUID))
+	tags := append(nostr.Tags{[]string{"proxy", proxyLink(item, feed), "rss"}}, hashtagTags(itemHashtags)...)
+	for _, file := range media {
+		tags = append(tags, imetaTag(file))
 	}
 
 	evt := nostr.Event{
 		PubKey:    pubkey,
 		CreatedAt: nostr.Timestamp(createdAt.Unix()),
 		Kind:      nostr.KindTextNote,
-		Tags:      nostr.Tags{[]string{"proxy", composedProxyLink, "rss"}},
+		Tags:      tags,
 		Content:   strings.ToValidUTF8(content, ""),
 	}
 	evt.ID = string(evt.Serialize())
@@ -284,18 +407,103 @@ func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, default
 	return evt
 }
 
+// ItemToArticle converts a feed item into a NIP-23 long-form article with the
+// full content of the item as Markdown, addressable by a "d" tag derived from
+// its GUID (or link) so updates of the item replace the previous article.
+// Unlike text notes, headings, images and links are kept as Markdown since
+// long-form clients render it, and hashtags are only added as "t" tags.
+func ItemToArticle(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, hashtags Hashtags) nostr.Event {
+	content := toMarkdown(item.Content)
+	summary := ""
+	if strings.TrimSpace(content) == "" {
+		content = toMarkdown(item.Description)
+	} else {
+		summary = strings.TrimSpace(html.UnescapeString(bluemonday.StripTagsPolicy().Sanitize(item.Description)))
+	}
+	content = strings.TrimSpace(html.UnescapeString(content))
+	if item.Link != "" {
+		content += "\n\n" + item.Link
+	}
+
+	publishedAt := defaultCreatedAt
+	if item.PublishedParsed != nil {
+		publishedAt = *item.PublishedParsed
+	} else if item.UpdatedParsed != nil {
+		publishedAt = *item.UpdatedParsed
+	}
+	createdAt := publishedAt
+	if item.UpdatedParsed != nil && item.UpdatedParsed.After(createdAt) {
+		createdAt = *item.UpdatedParsed
+	}
+
+	identifier := item.GUID
+	if identifier == "" {
+		identifier = item.Link
+	}
+	hash := sha256.Sum256([]byte(identifier))
+
+	tags := nostr.Tags{
+		[]string{"d", hex.EncodeToString(hash[:])},
+		[]string{"title", item.Title},
+		[]string{"published_at", strconv.FormatInt(publishedAt.Unix(), 10)},
+	}
+	if summary != "" {
+		tags = append(tags, []string{"summary", summary})
+	}
+	if image := itemImage(item); image != "" {
+		tags = append(tags, []string{"image", image})
+	}
+	tags = append(tags, hashtagTags(ItemHashtags(item, feed, hashtags.Max))...)
+	tags = append(tags, []string{"proxy", proxyLink(item, feed), "rss"})
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Kind:      nostr.KindArticle,
+		Tags:      tags,
+		Content:   strings.ToValidUTF8(content, ""),
+	}
+	evt.ID = string(evt.Serialize())
+
+	return evt
+}
+
+func toMarkdown(htmlContent string, rules ...md.Rule) string {
+	mdConverter := md.NewConverter("", true, nil)
+	mdConverter.AddRules(rules...)
+
+	markdown, err := mdConverter.ConvertString(htmlContent)
+	if err != nil {
+		log.Printf("[WARN] failure to convert description to markdown (defaulting to plain text): %v", err)
+		p := bluemonday.StripTagsPolicy()
+		markdown = p.Sanitize(htmlContent)
+	}
+	return markdown
+}
+
+func itemImage(item *gofeed.Item) string {
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
+	for _, enclosure := range item.Enclosures {
+		if strings.HasPrefix(enclosure.Type, "image/") {
+			return enclosure.URL
+		}
+	}
+	return ""
+}
+
+func proxyLink(item *gofeed.Item, feed *gofeed.Feed) string {
+	composedProxyLink := feed.FeedLink
+	if item.GUID != "" {
+		composedProxyLink += fmt.Sprintf("#%s", url.QueryEscape(item.GUID))
+	}
+	return composedProxyLink
+}
+
 func PrivateKeyFromFeed(url string, secret string) string {
 	m := hmac.New(sha256.New, []byte(secret))
 	m.Write([]byte(url))
 	r := m.Sum(nil)
 	return hex.EncodeToString(r)
 }
-
-func DeleteInvalidFeed(url string, db *sql.DB) {
-	if _, err := db.Exec(`DELETE FROM feeds WHERE url=?`, url); err != nil {
-		log.Printf("[ERROR] failure to delete invalid feed: %v", err)
-		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
-	} else {
-		log.Printf("[DEBUG] deleted invalid feed with url %q", url)
-	}
-}
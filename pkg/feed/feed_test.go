@@ -1,13 +1,12 @@
 package feed
 
 import (
-	"database/sql"
-	"errors"
 	"fmt"
-	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/mmcdole/gofeed"
 	ext "github.com/mmcdole/gofeed/extensions"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -210,7 +209,7 @@ func TestEntryFeedToSetMetadata(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		metadata := EntryFeedToSetMetadata(tc.pubKey, tc.feed, tc.originalUrl, tc.enableAutoRegistration, tc.defaultProfilePictureUrl, tc.defaultMainDomain)
+		metadata := EntryFeedToSetMetadata(tc.pubKey, tc.feed, tc.originalUrl, tc.enableAutoRegistration, tc.defaultProfilePictureUrl, tc.defaultMainDomain, "")
 		assert.NotEmpty(t, metadata)
 		assert.Equal(t, samplePubKey, metadata.PubKey)
 		assert.Equal(t, 0, metadata.Kind)
@@ -289,7 +288,7 @@ func TestItemToTextNote(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		event := ItemToTextNote(tc.pubKey, tc.item, tc.feed, tc.defaultCreatedAt, tc.originalUrl, tc.maxContentLength)
+		event := ItemToTextNote(tc.pubKey, tc.item, tc.feed, tc.defaultCreatedAt, tc.originalUrl, tc.maxContentLength, Hashtags{})
 		assert.NotEmpty(t, event)
 		assert.Equal(t, tc.pubKey, event.PubKey)
 		assert.Equal(t, tc.defaultCreatedAt, event.CreatedAt.Time())
@@ -300,36 +299,77 @@ func TestItemToTextNote(t *testing.T) {
 	}
 }
 
-func TestDeleteExistingInvalidFeed(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+func TestItemToArticle(t *testing.T) {
+	updatedTime := actualTime.Add(time.Hour)
+	longFormItem := gofeed.Item{
+		Title:           "Release notes",
+		Description:     "<p>What&#39;s new in this release</p>",
+		Content:         "<h2>Changes</h2><p>A <strong>long</strong> article.</p>",
+		Link:            "https://example.com/blog/release-notes",
+		UpdatedParsed:   &updatedTime,
+		PublishedParsed: &actualTime,
+		GUID:            "https://example.com/blog/?p=42",
+		Image:           &gofeed.Image{URL: "https://example.com/cover.png"},
 	}
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
-			t.Fatalf("an error '%s' was not expected when closing a stub database connection", err)
-		}
-	}(db)
+	withoutContentItem := gofeed.Item{
+		Title:           "Short post",
+		Description:     "<p>Only a description</p>",
+		Link:            "https://example.com/blog/short-post",
+		PublishedParsed: &actualTime,
+		Enclosures:      []*gofeed.Enclosure{{URL: "https://example.com/picture.jpg", Type: "image/jpeg"}},
+	}
+
+	article := ItemToArticle(samplePubKey, &longFormItem, &sampleDefaultFeed, actualTime, Hashtags{})
+	assert.Equal(t, 30023, article.Kind)
+	assert.Equal(t, samplePubKey, article.PubKey)
+	assert.Equal(t, updatedTime, article.CreatedAt.Time())
+	assert.Equal(t, "## Changes\n\nA **long** article.\n\n"+longFormItem.Link, article.Content)
+	assert.Equal(t, "d120459b02a7b700829360ade154251c4a91b685928326bcb67b6687f583440e", article.Tags.GetFirst([]string{"d", ""}).Value())
+	assert.Equal(t, longFormItem.Title, article.Tags.GetFirst([]string{"title", ""}).Value())
+	assert.Equal(t, "What's new in this release", article.Tags.GetFirst([]string{"summary", ""}).Value())
+	assert.Equal(t, "https://example.com/cover.png", article.Tags.GetFirst([]string{"image", ""}).Value())
+	assert.Equal(t, fmt.Sprint(actualTime.Unix()), article.Tags.GetFirst([]string{"published_at", ""}).Value())
+	assert.NotNil(t, article.Tags.GetFirst([]string{"proxy", sampleDefaultFeed.FeedLink + "#"}))
 
-	mock.ExpectExec("DELETE FROM feeds").WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectClose()
-	DeleteInvalidFeed(sampleUrlForPublicKey, db)
+	article = ItemToArticle(samplePubKey, &withoutContentItem, &sampleDefaultFeed, actualTime, Hashtags{})
+	assert.Equal(t, actualTime, article.CreatedAt.Time())
+	assert.Equal(t, "Only a description\n\n"+withoutContentItem.Link, article.Content)
+	assert.NotEmpty(t, article.Tags.GetFirst([]string{"d", ""}).Value())
+	assert.Nil(t, article.Tags.GetFirst([]string{"summary", ""}))
+	assert.Equal(t, "https://example.com/picture.jpg", article.Tags.GetFirst([]string{"image", ""}).Value())
 }
 
-func TestDeleteNonExistingInvalidFeed(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
-			t.Fatalf("an error '%s' was not expected when closing a stub database connection", err)
+func TestFetchFeedWithValidators(t *testing.T) {
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
-	}(db)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Sat, 18 Feb 2023 12:35:17 GMT")
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(feedWithComments))
+	}))
+	defer server.Close()
+	allowLoopback(t)
 
-	mock.ExpectExec("DELETE FROM feeds").WillReturnError(errors.New(""))
-	mock.ExpectClose()
-	DeleteInvalidFeed(sampleUrlForPublicKey, db)
+	result, err := FetchFeed(server.URL, nil)
+	assert.NoError(t, err)
+	assert.False(t, result.NotModified)
+	assert.NotNil(t, result.Feed)
+	assert.Equal(t, etag, result.Validators.ETag)
+	assert.Equal(t, "Sat, 18 Feb 2023 12:35:17 GMT", result.Validators.LastModified)
+	assert.NotEmpty(t, result.Validators.ContentHash)
+
+	notModified, err := FetchFeed(server.URL, &result.Validators)
+	assert.NoError(t, err)
+	assert.True(t, notModified.NotModified)
+	assert.Nil(t, notModified.Feed)
+	assert.Equal(t, result.Validators, notModified.Validators)
+
+	sameContent, err := FetchFeed(server.URL, &Validators{ContentHash: result.Validators.ContentHash})
+	assert.NoError(t, err)
+	assert.True(t, sameContent.NotModified)
+	assert.Nil(t, sameContent.Feed)
 }
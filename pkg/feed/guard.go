@@ -0,0 +1,212 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reservedNetworks are special purpose ranges, besides the loopback, private,
+// link-local and multicast ones, that no feed should be served from.
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, including broadcast
+	"64:ff9b:1::/48", // local-use IPv4/IPv6 translation
+	"100::/64",       // discard-only
+	"2001::/23",      // IETF protocol assignments
+	"2001:db8::/32",  // documentation
+)
+
+// metadataAddresses serve cloud instance metadata, credentials included.
+var metadataAddresses = []net.IP{
+	net.ParseIP("169.254.169.254"),
+	net.ParseIP("fd00:ec2::254"),
+}
+
+// BlockedAddressError is returned when a feed url resolves to an address of
+// a range rsslay refuses to connect to, so it can't be used to reach internal
+// services.
+type BlockedAddressError struct {
+	Host   string
+	IP     net.IP
+	Reason string
+}
+
+func (e *BlockedAddressError) Error() string {
+	if e.Host != "" && e.Host != e.IP.String() {
+		return fmt.Sprintf("%s resolves to %s, which is a %s address", e.Host, e.IP, e.Reason)
+	}
+	return fmt.Sprintf("%s is a %s address", e.IP, e.Reason)
+}
+
+// addressGuard refuses connections to loopback, private, link-local and other
+// internal ranges. Since it checks the address actually dialed, it also covers
+// redirects and hosts resolving differently once validated.
+type addressGuard struct {
+	mutex           sync.RWMutex
+	allowedHosts    map[string]struct{}
+	allowedNetworks []*net.IPNet
+}
+
+var guard = &addressGuard{}
+
+// AllowAddresses exempts some hosts, IP addresses or CIDR ranges from the
+// protection against internal addresses, e.g. to fetch feeds of a local
+// service on purpose.
+func AllowAddresses(allowlist []string) error {
+	allowedHosts := map[string]struct{}{}
+	var allowedNetworks []*net.IPNet
+	for _, entry := range allowlist {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			allowedNetworks = append(allowedNetworks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			allowedNetworks = append(allowedNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if strings.ContainsAny(entry, "/:") {
+			return fmt.Errorf("invalid allowed address %q", entry)
+		} else {
+			allowedHosts[entry] = struct{}{}
+		}
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.allowedHosts = allowedHosts
+	guard.allowedNetworks = allowedNetworks
+	return nil
+}
+
+// CheckURL resolves the host of the url and reports whether any of its
+// addresses is refused, so users get a clear error before anything is fetched.
+func CheckURL(rawUrl string) error {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+
+	host := strings.ToLower(parsedUrl.Hostname())
+	if guard.allowsHost(host) {
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := guard.check(host, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGuardedTransport connects to feeds directly, ignoring HTTP_PROXY and
+// HTTPS_PROXY, since the guard would only see the address of the proxy.
+func newGuardedTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	guardedDialer := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+		Control:   guard.control,
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && guard.allowsHost(strings.ToLower(host)) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guardedDialer.DialContext(ctx, network, address)
+	}
+	return transport
+}
+
+// control runs right before connecting, once the host has been resolved.
+func (g *addressGuard) control(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected address %q", address)
+	}
+	return g.check("", ip)
+}
+
+func (g *addressGuard) allowsHost(host string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, ok := g.allowedHosts[host]
+	return ok
+}
+
+func (g *addressGuard) check(host string, ip net.IP) error {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	for _, network := range g.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	if reason := blockedReason(ip); reason != "" {
+		return &BlockedAddressError{Host: host, IP: ip, Reason: reason}
+	}
+	return nil
+}
+
+func blockedReason(ip net.IP) string {
+	for _, metadataAddress := range metadataAddresses {
+		if ip.Equal(metadataAddress) {
+			return "cloud metadata"
+		}
+	}
+
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast():
+		return "link-local"
+	case ip.IsPrivate():
+		return "private network"
+	case ip.IsUnspecified(), ip.IsMulticast():
+		return "non-unicast"
+	}
+
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return "reserved"
+		}
+	}
+	return ""
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
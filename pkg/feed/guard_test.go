@@ -0,0 +1,130 @@
+package feed
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func allowLoopback(t *testing.T) {
+	assert.NoError(t, AllowAddresses([]string{"127.0.0.1", "::1"}))
+	t.Cleanup(func() { _ = AllowAddresses(nil) })
+}
+
+func TestBlockedReason(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "127.0.0.1", expected: "loopback"},
+		{ip: "::1", expected: "loopback"},
+		{ip: "::ffff:127.0.0.1", expected: "loopback"},
+		{ip: "10.1.2.3", expected: "private network"},
+		{ip: "172.16.0.1", expected: "private network"},
+		{ip: "192.168.1.1", expected: "private network"},
+		{ip: "fd12:3456::1", expected: "private network"},
+		{ip: "169.254.169.254", expected: "cloud metadata"},
+		{ip: "fd00:ec2::254", expected: "cloud metadata"},
+		{ip: "169.254.10.1", expected: "link-local"},
+		{ip: "fe80::1", expected: "link-local"},
+		{ip: "0.0.0.0", expected: "non-unicast"},
+		{ip: "224.0.0.1", expected: "link-local"},
+		{ip: "239.1.1.1", expected: "non-unicast"},
+		{ip: "100.64.0.1", expected: "reserved"},
+		{ip: "255.255.255.255", expected: "reserved"},
+		{ip: "93.184.216.34", expected: ""},
+		{ip: "2606:4700::1111", expected: ""},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, blockedReason(net.ParseIP(tc.ip)), tc.ip)
+	}
+}
+
+func TestAllowAddresses(t *testing.T) {
+	t.Cleanup(func() { _ = AllowAddresses(nil) })
+
+	assert.Error(t, AllowAddresses([]string{"10.0.0.0/33"}))
+	assert.NoError(t, AllowAddresses([]string{"10.1.0.0/16", " 192.168.1.10 ", "Feeds.Internal"}))
+
+	assert.NoError(t, guard.check("", net.ParseIP("10.1.2.3")))
+	assert.NoError(t, guard.check("", net.ParseIP("192.168.1.10")))
+	assert.Error(t, guard.check("", net.ParseIP("192.168.1.11")))
+	assert.True(t, guard.allowsHost("feeds.internal"))
+	assert.NoError(t, CheckURL("http://feeds.internal/rss"))
+}
+
+func TestCheckURLRefusesInternalAddresses(t *testing.T) {
+	var blockedAddressError *BlockedAddressError
+
+	err := CheckURL("http://127.0.0.1:8080/feed")
+	assert.True(t, errors.As(err, &blockedAddressError))
+	assert.Equal(t, "127.0.0.1 is a loopback address", err.Error())
+
+	err = CheckURL("http://localhost/feed")
+	assert.True(t, errors.As(err, &blockedAddressError))
+	assert.Contains(t, err.Error(), "localhost resolves to")
+
+	assert.True(t, errors.As(CheckURL("http://169.254.169.254/latest/meta-data/"), &blockedAddressError))
+	assert.Equal(t, "cloud metadata", blockedAddressError.Reason)
+}
+
+func TestFetchFeedRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(feedWithComments))
+	}))
+	defer server.Close()
+
+	_, err := FetchFeed(server.URL, nil)
+	var blockedAddressError *BlockedAddressError
+	assert.True(t, errors.As(err, &blockedAddressError))
+
+	allowLoopback(t)
+	_, err = FetchFeed(server.URL, nil)
+	assert.NoError(t, err)
+}
+
+func TestFetchFeedRefusesRedirectsToInternalAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(feedWithComments))
+	}))
+	defer internal.Close()
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	// Only the redirecting server is allowed, through its host name.
+	assert.NoError(t, AllowAddresses([]string{"localhost"}))
+	t.Cleanup(func() { _ = AllowAddresses(nil) })
+	_, port, _ := net.SplitHostPort(redirecting.Listener.Addr().String())
+
+	_, err := FetchFeed("http://localhost:"+port, nil)
+	var blockedAddressError *BlockedAddressError
+	assert.True(t, errors.As(err, &blockedAddressError))
+	assert.Equal(t, "loopback", blockedAddressError.Reason)
+}
+
+func TestFetchFeedIgnoresProxies(t *testing.T) {
+	proxied := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(feedWithComments))
+	}))
+	defer proxy.Close()
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("HTTPS_PROXY", proxy.URL)
+	allowLoopback(t)
+
+	assert.Nil(t, newGuardedTransport().Proxy)
+	_, err := FetchFeed("http://10.255.255.1/rss", nil)
+	var blockedAddressError *BlockedAddressError
+	assert.True(t, errors.As(err, &blockedAddressError))
+	assert.Equal(t, "private network", blockedAddressError.Reason)
+	assert.Zero(t, proxied)
+}
@@ -0,0 +1,108 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"unicode"
+)
+
+// Hashtags decides how the categories of feeds and their items become
+// hashtags: "t" tags, and #hashtags at the end of text notes with InContent,
+// up to Max of them per event (none when zero).
+type Hashtags struct {
+	InContent bool
+	Max       int
+}
+
+// HashtagOverrides replaces the instance hashtag settings for a feed. Nil
+// fields keep the instance defaults.
+type HashtagOverrides struct {
+	InContent *bool
+	Max       *int
+}
+
+// Apply returns the settings of the feed given the instance defaults.
+func (o HashtagOverrides) Apply(defaults Hashtags) Hashtags {
+	if o.InContent != nil {
+		defaults.InContent = *o.InContent
+	}
+	if o.Max != nil {
+		defaults.Max = *o.Max
+	}
+	return defaults
+}
+
+// ItemHashtags normalises the subreddit of Reddit feeds, then the categories
+// of the item and the ones of the feed, into up to max hashtags: lowercase,
+// without spaces or punctuation and without duplicates. Categories holding a
+// comma-separated list are split.
+func ItemHashtags(item *gofeed.Item, feed *gofeed.Feed, max int) []string {
+	var categories []string
+	if subreddit := subredditOf(feed.Link); subreddit != "" {
+		categories = append(categories, subreddit)
+	}
+	categories = append(append(categories, item.Categories...), feed.Categories...)
+
+	var hashtags []string
+	seen := make(map[string]bool)
+	for _, category := range categories {
+		for _, part := range strings.Split(category, ",") {
+			if len(hashtags) >= max {
+				return hashtags
+			}
+			hashtag := normaliseHashtag(part)
+			if hashtag == "" || seen[hashtag] {
+				continue
+			}
+			seen[hashtag] = true
+			hashtags = append(hashtags, hashtag)
+		}
+	}
+	return hashtags
+}
+
+func normaliseHashtag(category string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, category)
+}
+
+func subredditOf(link string) string {
+	_, path, found := strings.Cut(link, "reddit.com/r/")
+	if !found {
+		return ""
+	}
+	subreddit, _, _ := strings.Cut(path, "/")
+	return subreddit
+}
+
+func hashtagTags(hashtags []string) nostr.Tags {
+	tags := make(nostr.Tags, len(hashtags))
+	for i, hashtag := range hashtags {
+		tags[i] = nostr.Tag{"t", hashtag}
+	}
+	return tags
+}
+
+// contentHashtags returns the hashtags ending a text note: the ones of the
+// item with InContent, and always the subreddit of Reddit feeds, as notes of
+// those did before hashtags were configurable.
+func contentHashtags(itemHashtags []string, feed *gofeed.Feed, hashtags Hashtags) []string {
+	var inContent []string
+	if hashtags.InContent {
+		inContent = itemHashtags
+	}
+	subreddit := normaliseHashtag(subredditOf(feed.Link))
+	if subreddit != "" && (len(inContent) == 0 || inContent[0] != subreddit) {
+		inContent = append([]string{subreddit}, inContent...)
+	}
+	return inContent
+}
+
+func hashtagsContent(hashtags []string) string {
+	return "#" + strings.Join(hashtags, " #")
+}
@@ -0,0 +1,78 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestItemHashtagsNormalisesCategories(t *testing.T) {
+	item := &gofeed.Item{Categories: []string{"Machine Learning", "#Go", "go", "C++, Rust", "  ", "Ünïcode_ok"}}
+	parsedFeed := &gofeed.Feed{Categories: []string{"Technology"}}
+
+	assert.Equal(t, []string{"machinelearning", "go", "c", "rust", "ünïcode_ok", "technology"}, ItemHashtags(item, parsedFeed, 10))
+	assert.Equal(t, []string{"machinelearning", "go"}, ItemHashtags(item, parsedFeed, 2))
+	assert.Empty(t, ItemHashtags(item, parsedFeed, 0))
+}
+
+func TestItemHashtagsIncludesSubreddit(t *testing.T) {
+	parsedFeed := &gofeed.Feed{Link: "https://www.reddit.com/r/nostr/"}
+
+	assert.Equal(t, []string{"nostr"}, ItemHashtags(&gofeed.Item{}, parsedFeed, 5))
+	parsedFeed.Categories = []string{"Social"}
+	assert.Equal(t, []string{"nostr"}, ItemHashtags(&gofeed.Item{Categories: []string{"Protocols"}}, parsedFeed, 1))
+}
+
+func TestItemToTextNoteEndsRedditNotesWithSubreddit(t *testing.T) {
+	item := &gofeed.Item{
+		Title:           "Relays",
+		Link:            "https://www.reddit.com/r/nostr/comments/1/relays/",
+		Categories:      []string{"Relays"},
+		PublishedParsed: &actualTime,
+	}
+	parsedFeed := &gofeed.Feed{Link: "https://www.reddit.com/r/nostr/", FeedLink: "https://www.reddit.com/r/nostr/.rss"}
+
+	note := ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), parsedFeed.FeedLink, 250, Hashtags{})
+	assert.Equal(t, "**Relays**\n\n#nostr\n\n"+item.Link, note.Content)
+	assert.Empty(t, note.Tags.GetAll([]string{"t", ""}))
+
+	note = ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), parsedFeed.FeedLink, 250, Hashtags{InContent: true, Max: 1})
+	assert.Equal(t, "**Relays**\n\n#nostr\n\n"+item.Link, note.Content)
+	assert.Equal(t, "nostr", note.Tags.GetFirst([]string{"t", ""}).Value())
+
+	note = ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), parsedFeed.FeedLink, 250, Hashtags{InContent: true, Max: 5})
+	assert.Equal(t, "**Relays**\n\n#nostr #relays\n\n"+item.Link, note.Content)
+}
+
+func TestHashtagOverridesApply(t *testing.T) {
+	defaults := Hashtags{InContent: false, Max: 5}
+	inContent, max := true, 0
+
+	assert.Equal(t, defaults, HashtagOverrides{}.Apply(defaults))
+	assert.Equal(t, Hashtags{InContent: true, Max: 0}, HashtagOverrides{InContent: &inContent, Max: &max}.Apply(defaults))
+}
+
+func TestItemToTextNoteWithHashtags(t *testing.T) {
+	item := &gofeed.Item{
+		Title:           "Release",
+		Description:     "Release",
+		Link:            "https://example.com/release",
+		Categories:      []string{"News", "Open Source"},
+		PublishedParsed: &actualTime,
+	}
+	parsedFeed := &gofeed.Feed{FeedLink: "https://example.com/rss"}
+
+	note := ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), parsedFeed.FeedLink, 250, Hashtags{Max: 5})
+	assert.Equal(t, "**Release**\n\n"+item.Link, note.Content)
+	assert.Equal(t, "news", note.Tags.GetFirst([]string{"t", ""}).Value())
+	assert.Len(t, note.Tags.GetAll([]string{"t", ""}), 2)
+
+	note = ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), parsedFeed.FeedLink, 250, Hashtags{InContent: true, Max: 1})
+	assert.Equal(t, "**Release**\n\n#news\n\n"+item.Link, note.Content)
+	assert.Len(t, note.Tags.GetAll([]string{"t", ""}), 1)
+
+	article := ItemToArticle(samplePubKey, item, parsedFeed, time.Now(), Hashtags{InContent: true, Max: 5})
+	assert.Len(t, article.Tags.GetAll([]string{"t", ""}), 2)
+	assert.NotContains(t, article.Content, "#news")
+}
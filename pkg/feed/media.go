@@ -0,0 +1,147 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/nbd-wtf/go-nostr"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxMediaPerEvent caps the media attached to an event, as some feeds list
+// every rendition of the same file.
+const maxMediaPerEvent = 4
+
+// mimeTypes are the types of the files usually attached to feed items by
+// extension. Unlike mime.TypeByExtension, it doesn't depend on the system,
+// since the type ends up in the events, whose ids must be the same anywhere.
+var mimeTypes = map[string]string{
+	".aac":  "audio/aac",
+	".avif": "image/avif",
+	".flac": "audio/flac",
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".ogv":  "video/ogg",
+	".opus": "audio/opus",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+	".webp": "image/webp",
+}
+
+// Media is a file attached to a feed item, described for NIP-92 imeta tags.
+type Media struct {
+	URL      string
+	MimeType string
+	// Size in bytes, zero if unknown.
+	Size   int64
+	Width  int
+	Height int
+	Alt    string
+}
+
+// ItemMedia collects the files attached to an item: its enclosures, its
+// Media RSS contents (also inside media:group) and its image, without
+// duplicates and up to maxMediaPerEvent of them.
+func ItemMedia(item *gofeed.Item) []Media {
+	var media []Media
+	for _, enclosure := range item.Enclosures {
+		size, _ := strconv.ParseInt(enclosure.Length, 10, 64)
+		media = append(media, Media{URL: enclosure.URL, MimeType: enclosure.Type, Size: size})
+	}
+	if mediaExtensions, ok := item.Extensions["media"]; ok {
+		media = append(media, mediaContents(mediaExtensions["content"])...)
+		for _, group := range mediaExtensions["group"] {
+			media = append(media, mediaContents(group.Children["content"])...)
+		}
+	}
+	if item.Image != nil {
+		media = append(media, Media{URL: item.Image.URL, Alt: item.Image.Title})
+	}
+
+	var unique []Media
+	seen := make(map[string]bool)
+	for _, file := range media {
+		if len(unique) >= maxMediaPerEvent {
+			break
+		}
+		if !strings.HasPrefix(file.URL, "http://") && !strings.HasPrefix(file.URL, "https://") || seen[file.URL] {
+			continue
+		}
+		seen[file.URL] = true
+		if file.MimeType == "" {
+			file.MimeType = mimeTypeOf(file.URL)
+		}
+		unique = append(unique, file)
+	}
+	return unique
+}
+
+func mediaContents(contents []ext.Extension) []Media {
+	var media []Media
+	for _, content := range contents {
+		file := Media{URL: content.Attrs["url"], MimeType: content.Attrs["type"]}
+		file.Size, _ = strconv.ParseInt(content.Attrs["fileSize"], 10, 64)
+		file.Width, _ = strconv.Atoi(content.Attrs["width"])
+		file.Height, _ = strconv.Atoi(content.Attrs["height"])
+		for _, name := range []string{"description", "title"} {
+			if children := content.Children[name]; len(children) > 0 && file.Alt == "" {
+				file.Alt = strings.Join(strings.Fields(children[0].Value), " ")
+			}
+		}
+		media = append(media, file)
+	}
+	return media
+}
+
+// mimeTypeOf guesses the type of a file from the extension of its url.
+func mimeTypeOf(fileUrl string) string {
+	parsedUrl, err := url.Parse(fileUrl)
+	if err != nil {
+		return ""
+	}
+	return mimeTypes[strings.ToLower(path.Ext(parsedUrl.Path))]
+}
+
+// imetaTag describes the file in a NIP-92 imeta tag, skipping unknown fields.
+func imetaTag(file Media) nostr.Tag {
+	tag := nostr.Tag{"imeta", "url " + file.URL}
+	if file.MimeType != "" {
+		tag = append(tag, "m "+file.MimeType)
+	}
+	if file.Width > 0 && file.Height > 0 {
+		tag = append(tag, fmt.Sprintf("dim %dx%d", file.Width, file.Height))
+	}
+	if file.Size > 0 {
+		tag = append(tag, "size "+strconv.FormatInt(file.Size, 10))
+	}
+	if file.Alt != "" {
+		tag = append(tag, "alt "+file.Alt)
+	}
+	return tag
+}
+
+// mediaContent lists the urls of the files not already in the content, one
+// per line, for clients to render them.
+func mediaContent(media []Media, content string) string {
+	var urls []string
+	for _, file := range media {
+		if !strings.Contains(content, file.URL) {
+			urls = append(urls, file.URL)
+		}
+	}
+	return strings.Join(urls, "\n")
+}
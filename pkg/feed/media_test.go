@@ -0,0 +1,78 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const sampleMediaFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/">
+  <channel>
+    <title>Photos</title>
+    <link>https://example.com/</link>
+    <item>
+      <title>Sunset</title>
+      <link>https://example.com/sunset</link>
+      <description>Golden hour</description>
+      <pubDate>Mon, 02 Jan 2023 15:04:05 GMT</pubDate>
+      <enclosure url="https://example.com/episode.mp3" length="123456" type="audio/mpeg"/>
+      <media:content url="https://example.com/sunset.jpg" type="image/jpeg" width="1024" height="768" fileSize="2048">
+        <media:description>The sun setting
+          over the sea</media:description>
+      </media:content>
+      <media:group>
+        <media:content url="https://example.com/sunset.png" width="640" height="480"/>
+        <media:content url="https://example.com/sunset.jpg"/>
+      </media:group>
+      <media:content url="data:image/png;base64,AAAA"/>
+    </item>
+  </channel>
+</rss>`
+
+func parseSampleMediaItem(t *testing.T) (*gofeed.Item, *gofeed.Feed) {
+	parsedFeed, err := gofeed.NewParser().ParseString(sampleMediaFeed)
+	assert.NoError(t, err)
+	return parsedFeed.Items[0], parsedFeed
+}
+
+func TestItemMediaCollectsEnclosuresAndMediaContents(t *testing.T) {
+	item, _ := parseSampleMediaItem(t)
+
+	assert.Equal(t, []Media{
+		{URL: "https://example.com/episode.mp3", MimeType: "audio/mpeg", Size: 123456},
+		{URL: "https://example.com/sunset.jpg", MimeType: "image/jpeg", Size: 2048, Width: 1024, Height: 768, Alt: "The sun setting over the sea"},
+		{URL: "https://example.com/sunset.png", MimeType: "image/png", Width: 640, Height: 480},
+	}, ItemMedia(item))
+}
+
+func TestMimeTypeOf(t *testing.T) {
+	testCases := map[string]string{
+		"https://example.com/episode.mp3":        "audio/mpeg",
+		"https://example.com/Sunset.JPG?size=xl": "image/jpeg",
+		"https://example.com/clip.webm":          "video/webm",
+		"https://example.com/file.unknown":       "",
+		"https://example.com/file":               "",
+	}
+	for fileUrl, expected := range testCases {
+		assert.Equal(t, expected, mimeTypeOf(fileUrl), fileUrl)
+	}
+}
+
+func TestImetaTag(t *testing.T) {
+	assert.Equal(t, nostr.Tag{"imeta", "url https://example.com/sunset.jpg", "m image/jpeg", "dim 1024x768", "size 2048", "alt Sunset"},
+		imetaTag(Media{URL: "https://example.com/sunset.jpg", MimeType: "image/jpeg", Size: 2048, Width: 1024, Height: 768, Alt: "Sunset"}))
+	assert.Equal(t, nostr.Tag{"imeta", "url https://example.com/file"}, imetaTag(Media{URL: "https://example.com/file"}))
+}
+
+func TestItemToTextNoteWithMedia(t *testing.T) {
+	item, parsedFeed := parseSampleMediaItem(t)
+
+	note := ItemToTextNote(samplePubKey, item, parsedFeed, time.Now(), "https://example.com/rss", 250, Hashtags{})
+	assert.Equal(t, "**Sunset**\n\nGolden hour\n\nhttps://example.com/episode.mp3\nhttps://example.com/sunset.jpg\nhttps://example.com/sunset.png\n\nhttps://example.com/sunset", note.Content)
+	imeta := note.Tags.GetAll([]string{"imeta", ""})
+	assert.Len(t, imeta, 3)
+	assert.Equal(t, "url https://example.com/episode.mp3", imeta[0][1])
+}
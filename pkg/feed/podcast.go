@@ -0,0 +1,124 @@
+package feed
+
+import (
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KindFileMetadata is the kind of NIP-94 file metadata events.
+const KindFileMetadata = 1063
+
+// EpisodeEnclosure returns the audio enclosure of a podcast episode, nil for
+// items without one.
+func EpisodeEnclosure(item *gofeed.Item) *gofeed.Enclosure {
+	for _, enclosure := range item.Enclosures {
+		if strings.HasPrefix(enclosure.Type, "audio/") && enclosure.URL != "" {
+			return enclosure
+		}
+	}
+	return nil
+}
+
+// ItemToFileMetadata describes the audio of a podcast episode in a NIP-94
+// file metadata event, with its url, type, size, duration, title and image,
+// so players in Nostr clients can play it. It returns false for items
+// without an audio enclosure.
+func ItemToFileMetadata(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time) (nostr.Event, bool) {
+	enclosure := EpisodeEnclosure(item)
+	if enclosure == nil {
+		return nostr.Event{}, false
+	}
+
+	tags := nostr.Tags{
+		[]string{"url", enclosure.URL},
+		[]string{"m", strings.ToLower(enclosure.Type)},
+	}
+	if size, err := strconv.ParseInt(enclosure.Length, 10, 64); err == nil && size > 0 {
+		tags = append(tags, []string{"size", strconv.FormatInt(size, 10)})
+	}
+	if item.ITunesExt != nil {
+		if duration, ok := parseDuration(item.ITunesExt.Duration); ok {
+			tags = append(tags, []string{"duration", strconv.Itoa(duration)})
+		}
+	}
+	if item.Title != "" {
+		tags = append(tags, []string{"title", item.Title}, []string{"alt", "Podcast episode: " + item.Title})
+	}
+	if summary := episodeSummary(item); summary != "" {
+		tags = append(tags, []string{"summary", summary})
+	}
+	if image := episodeImage(item, feed); image != "" {
+		tags = append(tags, []string{"image", image})
+	}
+	tags = append(tags, []string{"proxy", proxyLink(item, feed), "rss"})
+
+	createdAt := defaultCreatedAt
+	if item.PublishedParsed != nil {
+		createdAt = *item.PublishedParsed
+	} else if item.UpdatedParsed != nil {
+		createdAt = *item.UpdatedParsed
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Kind:      KindFileMetadata,
+		Tags:      tags,
+		Content:   strings.ToValidUTF8(item.Title, ""),
+	}
+	evt.ID = string(evt.Serialize())
+
+	return evt, true
+}
+
+func episodeSummary(item *gofeed.Item) string {
+	summary := item.Description
+	if item.ITunesExt != nil && item.ITunesExt.Subtitle != "" {
+		summary = item.ITunesExt.Subtitle
+	} else if item.ITunesExt != nil && item.ITunesExt.Summary != "" {
+		summary = item.ITunesExt.Summary
+	}
+	summary = html.UnescapeString(bluemonday.StripTagsPolicy().Sanitize(summary))
+	return strings.ToValidUTF8(strings.Join(strings.Fields(summary), " "), "")
+}
+
+// episodeImage prefers the artwork of the episode over the one of the show.
+func episodeImage(item *gofeed.Item, feed *gofeed.Feed) string {
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	if image := itemImage(item); image != "" {
+		return image
+	}
+	if feed.ITunesExt != nil && feed.ITunesExt.Image != "" {
+		return feed.ITunesExt.Image
+	}
+	if feed.Image != nil {
+		return feed.Image.URL
+	}
+	return ""
+}
+
+// parseDuration reads an itunes:duration, either seconds or [hh:]mm:ss, into
+// seconds.
+func parseDuration(duration string) (int, bool) {
+	parts := strings.Split(strings.TrimSpace(duration), ":")
+	if len(parts) > 3 {
+		return 0, false
+	}
+
+	seconds := 0
+	for _, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return 0, false
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, seconds > 0
+}
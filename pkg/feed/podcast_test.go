@@ -0,0 +1,57 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestItemToFileMetadata(t *testing.T) {
+	item := &gofeed.Item{
+		Title:           "Episode 42",
+		Description:     "<p>The <b>answer</b></p>",
+		Link:            "https://example.com/episodes/42",
+		GUID:            "episode-42",
+		PublishedParsed: &actualTime,
+		Enclosures: []*gofeed.Enclosure{
+			{URL: "https://example.com/cover.jpg", Type: "image/jpeg"},
+			{URL: "https://example.com/episode-42.mp3", Type: "audio/mpeg", Length: "31415926"},
+		},
+		ITunesExt: &ext.ITunesItemExtension{Duration: "1:02:03", Subtitle: "Life, the universe and everything"},
+	}
+	parsedFeed := &gofeed.Feed{FeedLink: "https://example.com/podcast.xml", ITunesExt: &ext.ITunesFeedExtension{Image: "https://example.com/show.jpg"}}
+
+	evt, ok := ItemToFileMetadata(samplePubKey, item, parsedFeed, actualTime)
+	assert.True(t, ok)
+	assert.Equal(t, KindFileMetadata, evt.Kind)
+	assert.Equal(t, actualTime, evt.CreatedAt.Time())
+	assert.Equal(t, "Episode 42", evt.Content)
+	assert.Equal(t, nostr.Tags{
+		{"url", "https://example.com/episode-42.mp3"},
+		{"m", "audio/mpeg"},
+		{"size", "31415926"},
+		{"duration", "3723"},
+		{"title", "Episode 42"},
+		{"alt", "Podcast episode: Episode 42"},
+		{"summary", "Life, the universe and everything"},
+		{"image", "https://example.com/cover.jpg"},
+		{"proxy", "https://example.com/podcast.xml#episode-42", "rss"},
+	}, evt.Tags)
+
+	_, ok = ItemToFileMetadata(samplePubKey, &gofeed.Item{Title: "Post"}, parsedFeed, actualTime)
+	assert.False(t, ok)
+}
+
+func TestParseDuration(t *testing.T) {
+	for duration, expected := range map[string]int{"3723": 3723, "02:03": 123, "1:02:03": 3723, " 45 ": 45} {
+		seconds, ok := parseDuration(duration)
+		assert.True(t, ok, duration)
+		assert.Equal(t, expected, seconds, duration)
+	}
+	for _, duration := range []string{"", "0", "abc", "1:2:3:4", "-5"} {
+		_, ok := parseDuration(duration)
+		assert.False(t, ok, duration)
+	}
+}
@@ -0,0 +1,257 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent identifies rsslay when no user agent is configured.
+const DefaultUserAgent = "rsslay (+https://github.com/piraces/rsslay)"
+
+// requestTimeout bounds each request once the host rate limit let it through,
+// so the time spent waiting for its turn doesn't count against it.
+const requestTimeout = 5 * time.Second
+
+// maxThrottleWait is how long a request may wait for the rate limit of its
+// host, so fetches to a busy host don't hold up the ones to other hosts.
+const maxThrottleWait = 30 * time.Second
+
+// defaultRetryAfter is how long a host that answered 429 Too Many Requests
+// without a Retry-After header is left alone.
+const defaultRetryAfter = time.Minute
+
+// Politeness holds the settings that keep outgoing requests from hammering
+// the hosts serving the feeds.
+type Politeness struct {
+	// UserAgent identifies rsslay, with contact info, to the hosts.
+	UserAgent string
+	// RequestsPerSecond and Burst set the token bucket of each host.
+	RequestsPerSecond float64
+	Burst             int
+	// HostRequestsPerSecond overrides the rate of some hosts and their subdomains.
+	HostRequestsPerSecond map[string]float64
+}
+
+// RetryAfterError is returned for requests to a host that asked to be left
+// alone until a given time, with a 429 or 503 response.
+type RetryAfterError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("host %s asked to retry after %s", e.Host, e.Until.UTC().Format(time.RFC3339))
+}
+
+// ThrottledError is returned for requests that would still be waiting for the
+// rate limit of their host when their deadline passes, which could be sent
+// from the given time.
+type ThrottledError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("requests to host %s are throttled until %s", e.Host, e.Until.UTC().Format(time.RFC3339))
+}
+
+// ConfigurePoliteness sets the user agent and per-host rate limits of every
+// outgoing request.
+func ConfigurePoliteness(politeness Politeness) {
+	client.Transport = newPoliteTransport(newGuardedTransport(), politeness)
+}
+
+// HostBackoff returns until when the host of the url asked to be left alone,
+// or the zero time if it didn't.
+func HostBackoff(feedUrl string) time.Time {
+	transport, ok := client.Transport.(*politeTransport)
+	if !ok {
+		return time.Time{}
+	}
+	parsedUrl, err := url.Parse(feedUrl)
+	if err != nil {
+		return time.Time{}
+	}
+	return transport.backoff(parsedUrl.Hostname())
+}
+
+// politeTransport sets the user agent of the requests, spreads them over time
+// with a token bucket per host and honours the Retry-After header of 429 and
+// 503 responses. Each request is given its timeout after its turn comes.
+type politeTransport struct {
+	next       http.RoundTripper
+	politeness Politeness
+	timeout    time.Duration
+
+	mutex        sync.Mutex
+	limiters     map[string]*rate.Limiter
+	blockedUntil map[string]time.Time
+}
+
+func newPoliteTransport(next http.RoundTripper, politeness Politeness) *politeTransport {
+	if politeness.Burst <= 0 {
+		politeness.Burst = 1
+	}
+	return &politeTransport{
+		next:         next,
+		politeness:   politeness,
+		timeout:      requestTimeout,
+		limiters:     map[string]*rate.Limiter{},
+		blockedUntil: map[string]time.Time{},
+	}
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if until := t.backoff(host); !until.IsZero() {
+		return nil, &RetryAfterError{Host: host, Until: until}
+	}
+
+	if err := t.wait(req, host); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	req = req.Clone(ctx)
+	if t.politeness.UserAgent != "" {
+		req.Header.Set("User-Agent", t.politeness.UserAgent)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		until, ok := retryAfter(resp, time.Now())
+		if ok {
+			t.mutex.Lock()
+			t.blockedUntil[host] = until
+			t.mutex.Unlock()
+
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			cancel()
+			return nil, &RetryAfterError{Host: host, Until: until}
+		}
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the timeout of a request once its body is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// wait blocks until the host has a request token available. Requests that
+// would still be waiting after maxThrottleWait or when their deadline passes
+// fail right away instead.
+func (t *politeTransport) wait(req *http.Request, host string) error {
+	reservation := t.limiter(host).Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	deadline, ok := req.Context().Deadline()
+	if !ok || deadline.After(time.Now().Add(maxThrottleWait)) {
+		deadline = time.Now().Add(maxThrottleWait)
+	}
+	if time.Now().Add(delay).After(deadline) {
+		reservation.Cancel()
+		return &ThrottledError{Host: host, Until: time.Now().Add(delay)}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		reservation.Cancel()
+		return req.Context().Err()
+	}
+}
+
+func (t *politeTransport) limiter(host string) *rate.Limiter {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	limiter, ok := t.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(t.hostRate(host)), t.politeness.Burst)
+		t.limiters[host] = limiter
+	}
+	return limiter
+}
+
+// hostRate returns the requests per second allowed to the host, taking the
+// override of the most specific matching domain.
+func (t *politeTransport) hostRate(host string) float64 {
+	requestsPerSecond := t.politeness.RequestsPerSecond
+	matched := ""
+	for domain, domainRate := range t.politeness.HostRequestsPerSecond {
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(matched) {
+			requestsPerSecond = domainRate
+			matched = domain
+		}
+	}
+	if requestsPerSecond <= 0 {
+		return float64(rate.Inf)
+	}
+	return requestsPerSecond
+}
+
+func (t *politeTransport) backoff(host string) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	until, ok := t.blockedUntil[host]
+	if !ok {
+		return time.Time{}
+	}
+	if time.Now().After(until) {
+		delete(t.blockedUntil, host)
+		return time.Time{}
+	}
+	return until
+}
+
+// retryAfter parses the Retry-After header of a response, either in seconds
+// or as an HTTP date. Without it, 429 responses back off a default time while
+// 503 ones, which may not be about rate limiting, don't.
+func retryAfter(resp *http.Response, now time.Time) (time.Time, bool) {
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return now.Add(defaultRetryAfter), true
+		}
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return now.Add(defaultRetryAfter), true
+}
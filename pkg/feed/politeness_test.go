@@ -0,0 +1,117 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2023, 2, 18, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		statusCode    int
+		header        string
+		expectedUntil time.Time
+		expectedOk    bool
+	}{
+		{statusCode: http.StatusTooManyRequests, header: "120", expectedUntil: now.Add(2 * time.Minute), expectedOk: true},
+		{statusCode: http.StatusServiceUnavailable, header: now.Add(time.Hour).Format(http.TimeFormat), expectedUntil: now.Add(time.Hour), expectedOk: true},
+		{statusCode: http.StatusTooManyRequests, header: "", expectedUntil: now.Add(defaultRetryAfter), expectedOk: true},
+		{statusCode: http.StatusTooManyRequests, header: "soon", expectedUntil: now.Add(defaultRetryAfter), expectedOk: true},
+		{statusCode: http.StatusServiceUnavailable, header: "", expectedOk: false},
+	}
+	for _, tc := range testCases {
+		resp := &http.Response{StatusCode: tc.statusCode, Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		until, ok := retryAfter(resp, now)
+		assert.Equal(t, tc.expectedOk, ok)
+		assert.True(t, tc.expectedUntil.Equal(until), "expected %v, got %v", tc.expectedUntil, until)
+	}
+}
+
+func TestHostRate(t *testing.T) {
+	transport := newPoliteTransport(http.DefaultTransport, Politeness{
+		RequestsPerSecond:     1,
+		HostRequestsPerSecond: map[string]float64{"reddit.com": 0.2, "old.reddit.com": 0.1, "example.com": 0},
+	})
+
+	assert.Equal(t, 1.0, transport.hostRate("nitter.net"))
+	assert.Equal(t, 0.2, transport.hostRate("reddit.com"))
+	assert.Equal(t, 0.2, transport.hostRate("www.reddit.com"))
+	assert.Equal(t, 0.1, transport.hostRate("old.reddit.com"))
+	assert.Equal(t, 1.0, transport.hostRate("notreddit.com"))
+	assert.Greater(t, transport.hostRate("example.com"), 1e300)
+}
+
+func TestPoliteTransportHonoursRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "rsslay-test (+https://example.com)", r.Header.Get("User-Agent"))
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: newPoliteTransport(http.DefaultTransport, Politeness{UserAgent: "rsslay-test (+https://example.com)"})}
+
+	_, err := httpClient.Get(server.URL)
+	var retryAfterError *RetryAfterError
+	assert.True(t, errors.As(err, &retryAfterError))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), retryAfterError.Until, time.Minute)
+
+	_, err = httpClient.Get(server.URL)
+	assert.True(t, errors.As(err, &retryAfterError))
+	assert.Equal(t, 1, requests)
+}
+
+func TestPoliteTransportLimitsRequestsPerHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: newPoliteTransport(http.DefaultTransport, Politeness{RequestsPerSecond: 0.01, Burst: 1})}
+
+	resp, err := httpClient.Get(server.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	start := time.Now()
+	_, err = httpClient.Do(req)
+	var throttledError *ThrottledError
+	assert.True(t, errors.As(err, &throttledError))
+	var retryAfterError *RetryAfterError
+	assert.False(t, errors.As(err, &retryAfterError))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestPoliteTransportTimesRequestsOutAfterTheirTurn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newPoliteTransport(http.DefaultTransport, Politeness{RequestsPerSecond: 2, Burst: 1})
+	transport.timeout = 200 * time.Millisecond
+	httpClient := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := httpClient.Get(server.URL)
+		if assert.NoError(t, err) {
+			_, err = io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			_ = resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mmcdole/gofeed"
+	"github.com/piraces/rsslay/pkg/helpers"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxSitePageSize = 1 << 20
+
+// SiteImage returns the image the page at the url shares in its og:image or
+// twitter:image meta tags, or empty if it has none or isn't an HTML page.
+// Failing requests are reported as errors, so the image known so far can be
+// kept.
+func SiteImage(pageUrl string) (string, error) {
+	if !helpers.IsValidHttpUrl(pageUrl) {
+		return "", nil
+	}
+	if err := CheckDomain(pageUrl); err != nil {
+		return "", nil
+	}
+
+	resp, err := client.Get(pageUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("unexpected status %d fetching %q", resp.StatusCode, pageUrl)
+	}
+	if resp.StatusCode >= 300 || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		return "", nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, maxSitePageSize))
+	if err != nil {
+		return "", err
+	}
+	for _, selector := range []string{"meta[property='og:image']", "meta[name='twitter:image']"} {
+		image := strings.TrimSpace(doc.Find(selector).AttrOr("content", ""))
+		if image == "" {
+			continue
+		}
+		imageUrl, err := resp.Request.URL.Parse(image)
+		if err == nil && helpers.IsValidHttpUrl(imageUrl.String()) {
+			return imageUrl.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// LightningAddress returns the lightning address receiving the largest split
+// of the podcast:value block of the feed, or empty if it declares none.
+// Recipients given as node public keys are skipped, since profiles only take
+// lightning addresses.
+func LightningAddress(feed *gofeed.Feed) string {
+	podcast, ok := feed.Extensions["podcast"]
+	if !ok {
+		return ""
+	}
+
+	type recipient struct {
+		address string
+		split   int
+	}
+	var recipients []recipient
+	for _, value := range podcast["value"] {
+		if value.Attrs["type"] != "lightning" {
+			continue
+		}
+		for _, child := range value.Children["valueRecipient"] {
+			address := strings.TrimSpace(child.Attrs["address"])
+			if !strings.Contains(address, "@") {
+				continue
+			}
+			split, _ := strconv.Atoi(child.Attrs["split"])
+			recipients = append(recipients, recipient{address: address, split: split})
+		}
+	}
+	if len(recipients) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(recipients, func(i, j int) bool {
+		return recipients[i].split > recipients[j].split
+	})
+	return recipients[0].address
+}
@@ -0,0 +1,79 @@
+package feed
+
+import (
+	"encoding/json"
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const samplePodcastValueFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:podcast="https://podcastindex.org/namespace/1.0">
+  <channel>
+    <title>Podcast</title>
+    <link>https://example.com/</link>
+    <podcast:value type="lightning" method="keysend">
+      <podcast:valueRecipient name="Host" type="node" address="03ae9f91a0cb8ff43840e3c322c4c61f019d8c1c3cea15a25cfc425ac605e61a4a" split="60"/>
+      <podcast:valueRecipient name="Producer" type="lnaddress" address="producer@getalby.com" split="10"/>
+      <podcast:valueRecipient name="Cohost" type="lnaddress" address="cohost@getalby.com" split="30"/>
+    </podcast:value>
+  </channel>
+</rss>`
+
+func TestLightningAddressPicksLargestSplit(t *testing.T) {
+	parsedFeed, err := gofeed.NewParser().ParseString(samplePodcastValueFeed)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "cohost@getalby.com", LightningAddress(parsedFeed))
+	assert.Empty(t, LightningAddress(&gofeed.Feed{}))
+}
+
+func TestSiteImageReadsOpenGraphImage(t *testing.T) {
+	allowLoopback(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/og":
+			_, _ = w.Write([]byte(`<html><head><meta property="og:image" content="/images/banner.png"></head></html>`))
+		case "/twitter":
+			_, _ = w.Write([]byte(`<html><head><meta name="twitter:image" content="https://cdn.example.com/banner.jpg"></head></html>`))
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte(`<html><head><title>No image</title></head></html>`))
+		}
+	}))
+	defer server.Close()
+
+	for pageUrl, expected := range map[string]string{
+		server.URL + "/og":      server.URL + "/images/banner.png",
+		server.URL + "/twitter": "https://cdn.example.com/banner.jpg",
+		server.URL + "/plain":   "",
+		"not a url":             "",
+	} {
+		image, err := SiteImage(pageUrl)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, image, pageUrl)
+	}
+
+	_, err := SiteImage(server.URL + "/down")
+	assert.Error(t, err)
+}
+
+func TestEntryFeedToSetMetadataDescribesAutomatedProfile(t *testing.T) {
+	parsedFeed, err := gofeed.NewParser().ParseString(samplePodcastValueFeed)
+	assert.NoError(t, err)
+
+	evt := EntryFeedToSetMetadata(samplePubKey, parsedFeed, "https://example.com/rss", false, "", "", "https://example.com/banner.png")
+	var metadata map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(evt.Content), &metadata))
+	assert.Equal(t, "Podcast (RSS Feed)", metadata["name"])
+	assert.Equal(t, "Podcast", metadata["display_name"])
+	assert.Equal(t, "https://example.com/", metadata["website"])
+	assert.Equal(t, "https://example.com/banner.png", metadata["banner"])
+	assert.Equal(t, "cohost@getalby.com", metadata["lud16"])
+	assert.Equal(t, true, metadata["bot"])
+	assert.NotContains(t, metadata, "nip05")
+}
@@ -0,0 +1,76 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ValidRelayURL reports whether the url is an absolute websocket url.
+func ValidRelayURL(relayUrl string) bool {
+	parsedUrl, err := url.Parse(relayUrl)
+	return err == nil && (parsedUrl.Scheme == "wss" || parsedUrl.Scheme == "ws") && parsedUrl.Host != ""
+}
+
+// NormalizeRelayURLs normalizes the relay urls, skipping the repeated ones,
+// or fails on the first one that is not a websocket url. Nil stays nil.
+func NormalizeRelayURLs(relayUrls []string) ([]string, error) {
+	if relayUrls == nil {
+		return nil, nil
+	}
+	normalized := make([]string, 0, len(relayUrls))
+	seen := make(map[string]bool)
+	for _, relayUrl := range relayUrls {
+		if !ValidRelayURL(strings.TrimSpace(relayUrl)) {
+			return nil, fmt.Errorf("%q is not a websocket url", relayUrl)
+		}
+		relayUrl = nostr.NormalizeURL(strings.TrimSpace(relayUrl))
+		if !seen[relayUrl] {
+			seen[relayUrl] = true
+			normalized = append(normalized, relayUrl)
+		}
+	}
+	return normalized, nil
+}
+
+// WriteRelays returns the relays the events of the feed are replayed to: the
+// ones it overrides, even if none, or else the defaults.
+func (e Entity) WriteRelays(defaults []string) []string {
+	if e.Relays != nil {
+		return e.Relays
+	}
+	return defaults
+}
+
+// RelayList builds the NIP-65 relay list of a feed, telling clients to read
+// it from the relay of the instance, if known, and that it also writes to
+// the write relays.
+func RelayList(pubkey string, relayUrl string, writeRelays []string) nostr.Event {
+	tags := nostr.Tags{}
+	seen := make(map[string]bool)
+	if relayUrl != "" {
+		relayUrl = nostr.NormalizeURL(relayUrl)
+		tags = append(tags, nostr.Tag{"r", relayUrl})
+		seen[relayUrl] = true
+	}
+	for _, writeRelay := range writeRelays {
+		writeRelay = nostr.NormalizeURL(writeRelay)
+		if seen[writeRelay] || !ValidRelayURL(writeRelay) {
+			continue
+		}
+		seen[writeRelay] = true
+		tags = append(tags, nostr.Tag{"r", writeRelay, "write"})
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Kind:      nostr.KindRelayListMetadata,
+		Tags:      tags,
+		Content:   "",
+	}
+	evt.ID = string(evt.Serialize())
+	return evt
+}
@@ -0,0 +1,46 @@
+package feed
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidRelayURL(t *testing.T) {
+	for relayUrl, expected := range map[string]bool{
+		"wss://relay.example.com":   true,
+		"ws://localhost:7447":       true,
+		"https://relay.example.com": false,
+		"wss://":                    false,
+		"relay.example.com":         false,
+		"":                          false,
+	} {
+		assert.Equal(t, expected, ValidRelayURL(relayUrl), relayUrl)
+	}
+}
+
+func TestNormalizeRelayURLs(t *testing.T) {
+	relays, err := NormalizeRelayURLs([]string{"wss://Relay.example.com/", " wss://relay.example.com", "ws://localhost:7447"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wss://relay.example.com", "ws://localhost:7447"}, relays)
+
+	_, err = NormalizeRelayURLs([]string{"wss://relay.example.com", "https://relay.example.org"})
+	assert.ErrorContains(t, err, `"https://relay.example.org" is not a websocket url`)
+}
+
+func TestRelayListListsInstanceAndWriteRelays(t *testing.T) {
+	evt := RelayList(samplePubKey, "wss://rsslay.example.com/", []string{"wss://Relay.example.com", "wss://relay.example.com/", "wss://rsslay.example.com", "not a relay"})
+
+	assert.Equal(t, nostr.KindRelayListMetadata, evt.Kind)
+	assert.Equal(t, samplePubKey, evt.PubKey)
+	assert.Equal(t, nostr.Tags{{"r", "wss://rsslay.example.com"}, {"r", "wss://relay.example.com", "write"}}, evt.Tags)
+	assert.Empty(t, evt.Content)
+}
+
+func TestEntityWriteRelaysFallsBackToDefaults(t *testing.T) {
+	defaults := []string{"wss://relay.example.com"}
+
+	assert.Equal(t, defaults, Entity{}.WriteRelays(defaults))
+	assert.Equal(t, []string{}, Entity{Relays: []string{}}.WriteRelays(defaults))
+	assert.Equal(t, []string{"wss://relay.example.org"}, Entity{Relays: []string{"wss://relay.example.org"}}.WriteRelays(defaults))
+}
@@ -28,6 +28,13 @@ func (ct *CustomTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
 		return nil, err
 	}
 
+	if rssFeed.TTL != "" {
+		if f.Custom == nil {
+			f.Custom = map[string]string{}
+		}
+		f.Custom["ttl"] = rssFeed.TTL
+	}
+
 	for i, item := range rssFeed.Items {
 		if item.Comments != "" {
 			if f.Items[i].Custom == nil {
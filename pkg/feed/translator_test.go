@@ -13,6 +13,7 @@ const feedWithComments = `<rss xmlns:atom="http://www.w3.org/2005/Atom" version=
 <description>Like Hacker News, but we pay you Bitcoin.</description>
 <language>en</language>
 <lastBuildDate>Sat, 18 Feb 2023 12:35:17 GMT</lastBuildDate>
+<ttl>60</ttl>
 <atom:link href="https://stacker.news/rss" rel="self" type="application/rss+xml"/>
 <item>
 <guid>https://stacker.news/items/138518</guid>
@@ -64,3 +65,18 @@ func TestCustomTranslator_TranslateWithoutComments(t *testing.T) {
 	item := feed.Items[0]
 	assert.Nil(t, item.Custom)
 }
+
+func TestCustomTranslator_TranslateWithTTL(t *testing.T) {
+	fp := gofeed.NewParser()
+	fp.RSSTranslator = NewCustomTranslator()
+	feed, _ := fp.ParseString(feedWithComments)
+	assert.NotNil(t, feed.Custom)
+	assert.Equal(t, "60", feed.Custom["ttl"])
+}
+
+func TestCustomTranslator_TranslateWithoutTTL(t *testing.T) {
+	fp := gofeed.NewParser()
+	fp.RSSTranslator = NewCustomTranslator()
+	feed, _ := fp.ParseString(feedWithoutComments)
+	assert.Nil(t, feed.Custom)
+}
@@ -1,9 +1,13 @@
 package helpers
 
 import (
+	"encoding/hex"
+	"errors"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"golang.org/x/exp/slices"
 	"net/url"
 	"path"
+	"strings"
 )
 
 var validSchemas = []string{"https", "http"}
@@ -32,3 +36,23 @@ func IsValidHttpUrl(rawUrl string) bool {
 	}
 	return true
 }
+
+// ParsePubKey returns the hex public key given either in hex or as an npub.
+func ParsePubKey(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "npub") {
+		prefix, decoded, err := nip19.Decode(value)
+		if err != nil {
+			return "", err
+		}
+		if pubKey, ok := decoded.(string); ok && prefix == "npub" {
+			return pubKey, nil
+		}
+		return "", errors.New("invalid npub")
+	}
+
+	if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != 32 {
+		return "", errors.New("invalid public key, expected 64 hex characters or an npub")
+	}
+	return strings.ToLower(value), nil
+}
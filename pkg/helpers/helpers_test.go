@@ -2,7 +2,9 @@ package helpers
 
 import (
 	"fmt"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -71,3 +73,25 @@ func TestIsValidUrl(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePubKey(t *testing.T) {
+	const pubKey = "1a21ed1d2b4b5a4d6f8b4b9fb5e07b4cb9b9fbc6a3e1c8c8ae1f2d2e8ad1e71c"
+	npub, _ := nip19.EncodePublicKey(pubKey)
+
+	parsed, err := ParsePubKey(pubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, pubKey, parsed)
+
+	parsed, err = ParsePubKey(" " + npub + " ")
+	assert.NoError(t, err)
+	assert.Equal(t, pubKey, parsed)
+
+	parsed, err = ParsePubKey(strings.ToUpper(pubKey))
+	assert.NoError(t, err)
+	assert.Equal(t, pubKey, parsed)
+
+	for _, invalid := range []string{"", "abcd", pubKey + "00", "npub1invalid", "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5"} {
+		_, err := ParsePubKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
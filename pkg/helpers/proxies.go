@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var trustedProxies struct {
+	mutex    sync.RWMutex
+	networks []*net.IPNet
+}
+
+// TrustProxies sets the IP addresses or CIDR ranges of the reverse proxies
+// in front of rsslay, whose X-Forwarded-Host and X-Forwarded-For headers are
+// the only ones believed.
+func TrustProxies(proxies []string) error {
+	var networks []*net.IPNet
+	for _, entry := range proxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			return fmt.Errorf("invalid proxy address %q", entry)
+		}
+	}
+
+	trustedProxies.mutex.Lock()
+	defer trustedProxies.mutex.Unlock()
+	trustedProxies.networks = networks
+	return nil
+}
+
+// RequestHost returns the host the request was sent to, as forwarded by a
+// trusted proxy if it went through one.
+func RequestHost(r *http.Request) string {
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" && trustedProxy(remoteIP(r)) {
+		return strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+	return r.Host
+}
+
+// ClientAddress returns the IP address the request comes from, following
+// the X-Forwarded-For header back through the trusted proxies.
+func ClientAddress(r *http.Request) string {
+	address := remoteIP(r)
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(address); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		address = hop
+	}
+	return address
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	trustedProxies.mutex.RLock()
+	defer trustedProxies.mutex.RUnlock()
+	for _, network := range trustedProxies.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package helpers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeadersAreOnlyTrustedFromProxies(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://rsslay.internal:8080/", nil)
+	req.RemoteAddr = "10.0.0.2:4321"
+	req.Header.Set("X-Forwarded-Host", "rsslay.example.com")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1, 10.0.0.1")
+
+	assert.Equal(t, "rsslay.internal:8080", RequestHost(req))
+	assert.Equal(t, "10.0.0.2", ClientAddress(req))
+
+	assert.NoError(t, TrustProxies([]string{"10.0.0.0/8"}))
+	t.Cleanup(func() { _ = TrustProxies(nil) })
+	assert.Equal(t, "rsslay.example.com", RequestHost(req))
+	// the addresses added by the client itself are not believed
+	assert.Equal(t, "198.51.100.1", ClientAddress(req))
+
+	assert.Error(t, TrustProxies([]string{"not an address"}))
+}
@@ -22,6 +22,34 @@ var (
 		Name: "rsslay_processed_create_api_ops_total",
 		Help: "The total number of processed create feed requests via API",
 	})
+	ListRequestsAPI = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_list_api_ops_total",
+		Help: "The total number of processed list feeds requests via API",
+	})
+	LookupRequestsAPI = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_lookup_api_ops_total",
+		Help: "The total number of processed lookup feed requests via API",
+	})
+	SearchRequestsAPI = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_search_api_ops_total",
+		Help: "The total number of processed search feeds requests via API",
+	})
+	ImportRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_import_ops_total",
+		Help: "The total number of processed OPML import requests",
+	})
+	ImportRequestsAPI = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_import_api_ops_total",
+		Help: "The total number of processed OPML import requests via API",
+	})
+	ExportRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_export_ops_total",
+		Help: "The total number of processed OPML export requests",
+	})
+	FollowsExportRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_follows_export_ops_total",
+		Help: "The total number of processed exports of the feeds a user follows",
+	})
 	WellKnownRequests = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "rsslay_processed_wellknown_ops_total",
 		Help: "The total number of processed well-known requests",
@@ -38,10 +66,28 @@ var (
 		Name: "rsslay_processed_invalid_events_ops_total",
 		Help: "The total number of processed invalid events requests",
 	})
-	ListeningFiltersOps = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "rsslay_processed_listening_filters_ops_total",
-		Help: "The total number of updated listening filters",
+	PollerOps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_poller_ops_total",
+		Help: "The total number of feed polling rounds",
 	})
+	FeedFetches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_feed_fetch_ops_total",
+		Help: "The total number of feeds fetched by the poller",
+	})
+	FanOutDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rsslay_fanout_duration_seconds",
+		Help:    "Time spent fetching a batch of feeds in parallel, until all of them finished or the deadline passed",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"source"})
+	FanOutFeeds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rsslay_fanout_feeds",
+		Help:    "Number of feeds fetched in parallel by each batch",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"source"})
+	FanOutDeadlineExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rsslay_fanout_deadline_exceeded_total",
+		Help: "Number of feed fetches still running when the deadline of their batch passed",
+	}, []string{"source"})
 	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "rsslay_processed_cache_hits_ops_total",
 		Help: "The total number of cache hits",
@@ -50,14 +96,42 @@ var (
 		Name: "rsslay_processed_cache_miss_ops_total",
 		Help: "The total number of cache misses",
 	})
+	FeedsNotModified = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_processed_feed_not_modified_ops_total",
+		Help: "The total number of fetched feeds that did not change since the previous fetch",
+	})
 	AppErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "rsslay_errors_total",
 		Help: "Number of errors for the app.",
 	}, []string{"type"})
 	ReplayRoutineQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "rsslay_replay_routines_queue_length",
-		Help: "Current number of subroutines to replay events to other relays",
+		Help: "Current number of events waiting in the queue to be replayed to other relays",
+	})
+	ReplayJobsEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_replay_jobs_enqueued_total",
+		Help: "Number of events queued to be replayed to other relays.",
 	})
+	ReplayJobsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_replay_jobs_dropped_total",
+		Help: "Number of events dropped from the full replay queue, to be retried on the next pass.",
+	})
+	ReplayJobsCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rsslay_replay_jobs_completed_total",
+		Help: "Number of events of the replay queue sent to other relays, whatever the outcome.",
+	})
+	ReplayOutboxDeliveries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsslay_replay_outbox_deliveries",
+		Help: "Number of events queued to replay to other relays by delivery status.",
+	}, []string{"status"})
+	ReplayDeliveryOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rsslay_replay_delivery_outcomes_total",
+		Help: "Number of events replayed to other relays by relay and outcome.",
+	}, []string{"relay", "outcome"})
+	ReplayRelayPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsslay_replay_relay_paused",
+		Help: "Whether replaying events to the relay is paused after it refused too many in a row.",
+	}, []string{"relay"})
 	ReplayEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "rsslay_replay_events_total",
 		Help: "Number of correct replayed events by relay.",
@@ -0,0 +1,147 @@
+// Package nip98 validates NIP-98 HTTP auth: requests carrying, in their
+// Authorization header, a nostr event signed for their url and method.
+package nip98
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kind of the HTTP auth events.
+const Kind = 27235
+
+// MaxClockSkew is how far from now the creation time of an event can be.
+const MaxClockSkew = time.Minute
+
+const scheme = "Nostr "
+
+// maxBodySize bounds the bodies read to check their payload tag.
+const maxBodySize = 2 << 20
+
+// ErrMissingAuthorization is returned for requests without NIP-98 auth.
+var ErrMissingAuthorization = errors.New("missing NIP-98 Authorization header")
+
+// ErrNotAllowed is returned for requests signed by a public key not allowed
+// to make them.
+var ErrNotAllowed = errors.New("public key not allowed")
+
+// UsedEvents remembers the events accepted while they are recent enough to
+// be accepted again, so each one authorizes a single request. Keeping them
+// in the database shared by the instances of rsslay, an event used with one
+// of them can't be replayed against the others.
+type UsedEvents interface {
+	// UseAuthEvent records the event id as used until expiresAt, returning
+	// false if it already was.
+	UseAuthEvent(id string, now int64, expiresAt int64) (bool, error)
+}
+
+// ValidateRequest checks the Authorization header of the request holds an
+// event signed for its url and method, and for its body if it has one, by a
+// public key allowed to make it, any if allowed is nil, and not used before,
+// and returns the public key that signed it.
+// Only the host, path and query of the url are compared, since the scheme
+// seen by rsslay may differ from the public one behind a proxy, whose
+// X-Forwarded-Host header is used if trusted with helpers.TrustProxies.
+func ValidateRequest(r *http.Request, used UsedEvents, allowed func(pubKey string) bool) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, scheme) {
+		return "", ErrMissingAuthorization
+	}
+
+	rawEvent, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(header, scheme)))
+	if err != nil {
+		return "", fmt.Errorf("invalid NIP-98 Authorization header: %w", err)
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(rawEvent, &evt); err != nil {
+		return "", fmt.Errorf("invalid NIP-98 event: %w", err)
+	}
+
+	if evt.Kind != Kind {
+		return "", fmt.Errorf("invalid NIP-98 event kind %d", evt.Kind)
+	}
+	if skew := time.Since(evt.CreatedAt.Time()); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "", errors.New("NIP-98 event is expired or not valid yet")
+	}
+	if evt.GetID() != evt.ID {
+		return "", errors.New("invalid NIP-98 event id")
+	}
+	if ok, err := evt.CheckSignature(); !ok || err != nil {
+		return "", errors.New("invalid NIP-98 event signature")
+	}
+
+	if method := tagValue(evt, "method"); !strings.EqualFold(method, r.Method) {
+		return "", fmt.Errorf("NIP-98 event signed for method %q", method)
+	}
+	signedUrl, err := url.Parse(tagValue(evt, "u"))
+	if err != nil || !strings.EqualFold(signedUrl.Host, helpers.RequestHost(r)) || signedUrl.RequestURI() != r.URL.RequestURI() {
+		return "", fmt.Errorf("NIP-98 event signed for url %q", tagValue(evt, "u"))
+	}
+
+	if err := checkPayload(r, tagValue(evt, "payload")); err != nil {
+		return "", err
+	}
+	// only the events of allowed public keys are recorded
+	if allowed != nil && !allowed(evt.PubKey) {
+		return "", ErrNotAllowed
+	}
+	fresh, err := used.UseAuthEvent(evt.ID, time.Now().Unix(), evt.CreatedAt.Time().Add(MaxClockSkew).Unix())
+	if err != nil {
+		return "", fmt.Errorf("cannot check whether the NIP-98 event was used: %w", err)
+	}
+	if !fresh {
+		return "", errors.New("NIP-98 event already used")
+	}
+
+	return evt.PubKey, nil
+}
+
+// checkPayload compares the hash of the request body with the signed one,
+// required if there is a body, leaving the body readable again for the
+// handler.
+func checkPayload(r *http.Request, payload string) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > maxBodySize {
+			return errors.New("request body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if payload == "" {
+		if len(body) > 0 {
+			return errors.New("NIP-98 event without payload tag for a request with a body")
+		}
+		return nil
+	}
+	hash := sha256.Sum256(body)
+	if !strings.EqualFold(hex.EncodeToString(hash[:]), payload) {
+		return errors.New("NIP-98 event signed for another payload")
+	}
+	return nil
+}
+
+func tagValue(evt nostr.Event, name string) string {
+	tag := evt.Tags.GetFirst([]string{name, ""})
+	if tag == nil {
+		return ""
+	}
+	return tag.Value()
+}
@@ -0,0 +1,185 @@
+package nip98
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/helpers"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const samplePrivateKey = "4d0888c07093941c9db16fcffb96fdf8af49a6839e865ea6110c7ab7cbd2d3d3"
+
+// signed tells apart the events signing the same request within the same
+// second, which would be refused as replayed otherwise.
+var signed atomic.Int64
+
+// usedEvents keeps the used events in memory, as the storage does.
+type usedEvents map[string]int64
+
+func (u usedEvents) UseAuthEvent(id string, _ int64, expiresAt int64) (bool, error) {
+	if _, ok := u[id]; ok {
+		return false, nil
+	}
+	u[id] = expiresAt
+	return true, nil
+}
+
+func authorization(t *testing.T, method string, url string, createdAt time.Time, extraTags ...nostr.Tag) string {
+	evt := nostr.Event{
+		Kind:      Kind,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Tags:      append(nostr.Tags{{"u", url}, {"method", method}}, extraTags...),
+		Content:   strconv.FormatInt(signed.Add(1), 10),
+	}
+	assert.NoError(t, evt.Sign(samplePrivateKey))
+	rawEvent, _ := json.Marshal(evt)
+	return "Nostr " + base64.StdEncoding.EncodeToString(rawEvent)
+}
+
+func TestValidateRequest(t *testing.T) {
+	used := usedEvents{}
+	samplePubKey, _ := nostr.GetPublicKey(samplePrivateKey)
+	const url = "https://rsslay.example.com/api/admin/feeds?limit=10"
+
+	req := httptest.NewRequest("GET", url, nil)
+	_, err := ValidateRequest(req, used, nil)
+	assert.ErrorIs(t, err, ErrMissingAuthorization)
+
+	req.Header.Set("Authorization", authorization(t, "GET", url, time.Now()))
+	pubKey, err := ValidateRequest(req, used, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, pubKey)
+
+	// behind a TLS terminating proxy the request is seen as plain HTTP
+	req = httptest.NewRequest("GET", "http://rsslay.example.com/api/admin/feeds?limit=10", nil)
+	req.Header.Set("Authorization", authorization(t, "GET", url, time.Now()))
+	_, err = ValidateRequest(req, used, nil)
+	assert.NoError(t, err)
+
+	invalidHeaders := map[string]string{
+		"wrong method":  authorization(t, "DELETE", url, time.Now()),
+		"wrong url":     authorization(t, "GET", "https://rsslay.example.com/api/admin/feeds?limit=20", time.Now()),
+		"wrong host":    authorization(t, "GET", "https://other.example.com/api/admin/feeds?limit=10", time.Now()),
+		"expired":       authorization(t, "GET", url, time.Now().Add(-2*time.Minute)),
+		"in the future": authorization(t, "GET", url, time.Now().Add(2*time.Minute)),
+		"not base64":    "Nostr not-base64",
+	}
+	for name, header := range invalidHeaders {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", header)
+		_, err := ValidateRequest(req, used, nil)
+		assert.Error(t, err, name)
+	}
+
+	tampered := authorization(t, "GET", url, time.Now())
+	rawEvent, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(tampered, "Nostr "))
+	var evt nostr.Event
+	_ = json.Unmarshal(rawEvent, &evt)
+	evt.Content = "tampered"
+	evt.ID = evt.GetID()
+	rawEvent, _ = json.Marshal(evt)
+	req = httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(rawEvent))
+	_, err = ValidateRequest(req, used, nil)
+	assert.EqualError(t, err, "invalid NIP-98 event signature")
+}
+
+func TestValidateRequestWithPayload(t *testing.T) {
+	used := usedEvents{}
+	const url = "https://rsslay.example.com/api/admin/feeds/purge"
+	const body = `{"dry_run":true}`
+	hash := sha256.Sum256([]byte(body))
+	payload := nostr.Tag{"payload", hex.EncodeToString(hash[:])}
+
+	req := httptest.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Authorization", authorization(t, "POST", url, time.Now(), payload))
+	_, err := ValidateRequest(req, used, nil)
+	assert.NoError(t, err)
+	readBody := make([]byte, len(body))
+	_, _ = req.Body.Read(readBody)
+	assert.Equal(t, body, string(readBody))
+
+	req = httptest.NewRequest("POST", url, strings.NewReader(`{"dry_run":false}`))
+	req.Header.Set("Authorization", authorization(t, "POST", url, time.Now(), payload))
+	_, err = ValidateRequest(req, used, nil)
+	assert.Error(t, err)
+}
+
+func TestValidateRequestRequiresPayloadForBodies(t *testing.T) {
+	used := usedEvents{}
+	const url = "https://rsslay.example.com/api/admin/feeds/purge"
+
+	req := httptest.NewRequest("POST", url, strings.NewReader(`{"dry_run":false}`))
+	req.Header.Set("Authorization", authorization(t, "POST", url, time.Now()))
+	_, err := ValidateRequest(req, used, nil)
+	assert.EqualError(t, err, "NIP-98 event without payload tag for a request with a body")
+
+	req = httptest.NewRequest("POST", url, nil)
+	req.Header.Set("Authorization", authorization(t, "POST", url, time.Now()))
+	_, err = ValidateRequest(req, used, nil)
+	assert.NoError(t, err)
+}
+
+func TestValidateRequestRefusesReplayedEvents(t *testing.T) {
+	used := usedEvents{}
+	const url = "https://rsslay.example.com/api/admin/feeds"
+	header := authorization(t, "GET", url, time.Now())
+
+	req := httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", header)
+	_, err := ValidateRequest(req, used, nil)
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", header)
+	_, err = ValidateRequest(req, used, nil)
+	assert.EqualError(t, err, "NIP-98 event already used")
+}
+
+func TestValidateRequestTrustsForwardedHostOfTrustedProxies(t *testing.T) {
+	used := usedEvents{}
+	const url = "https://rsslay.example.com/api/admin/feeds"
+	forwarded := func() *http.Request {
+		req := httptest.NewRequest("GET", "http://rsslay.internal:8080/api/admin/feeds", nil)
+		req.Header.Set("X-Forwarded-Host", "rsslay.example.com")
+		req.Header.Set("Authorization", authorization(t, "GET", url, time.Now()))
+		return req
+	}
+
+	_, err := ValidateRequest(forwarded(), used, nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, helpers.TrustProxies([]string{"192.0.2.0/24"}))
+	t.Cleanup(func() { _ = helpers.TrustProxies(nil) })
+	_, err = ValidateRequest(forwarded(), used, nil)
+	assert.NoError(t, err)
+}
+
+func TestValidateRequestRecordsOnlyEventsOfAllowedPublicKeys(t *testing.T) {
+	used := usedEvents{}
+	samplePubKey, _ := nostr.GetPublicKey(samplePrivateKey)
+	const url = "https://rsslay.example.com/api/admin/feeds"
+
+	req := httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", authorization(t, "GET", url, time.Now()))
+	_, err := ValidateRequest(req, used, func(pubKey string) bool { return false })
+	assert.ErrorIs(t, err, ErrNotAllowed)
+	assert.Empty(t, used)
+
+	req = httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", authorization(t, "GET", url, time.Now()))
+	pubKey, err := ValidateRequest(req, used, func(pubKey string) bool { return pubKey == samplePubKey })
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, pubKey)
+	assert.Len(t, used, 1)
+}
@@ -0,0 +1,87 @@
+// Package opml reads and writes OPML subscription lists, the format feed
+// readers use to import and export the feeds they follow.
+package opml
+
+import (
+	"encoding/xml"
+	"golang.org/x/net/html/charset"
+	"io"
+	"strings"
+)
+
+// Document is an OPML 2.0 document.
+type Document struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    Head     `xml:"head"`
+	Body    Body     `xml:"body"`
+}
+
+type Head struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type Body struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+// Outline is a feed, when XMLURL is set, or a folder of outlines.
+// NPub is a custom attribute holding the rsslay profile of the feed.
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	NPub     string    `xml:"npub,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// Parse decodes an OPML document.
+func Parse(r io.Reader) (*Document, error) {
+	var document Document
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// FeedURLs returns the xmlUrl of every outline, nested ones included, once
+// each and in document order.
+func (d *Document) FeedURLs() []string {
+	var urls []string
+	seen := map[string]struct{}{}
+	var walk func(outlines []Outline)
+	walk = func(outlines []Outline) {
+		for _, outline := range outlines {
+			feedUrl := strings.TrimSpace(outline.XMLURL)
+			if _, ok := seen[feedUrl]; feedUrl != "" && !ok {
+				seen[feedUrl] = struct{}{}
+				urls = append(urls, feedUrl)
+			}
+			walk(outline.Outlines)
+		}
+	}
+	walk(d.Body.Outlines)
+	return urls
+}
+
+// Write encodes the document, indented and with the XML header.
+func (d *Document) Write(w io.Writer) error {
+	if d.Version == "" {
+		d.Version = "2.0"
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(d); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
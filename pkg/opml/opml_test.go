@@ -0,0 +1,53 @@
+package opml
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const sampleOPML = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<opml version="1.0">
+  <head><title>Reading list</title></head>
+  <body>
+    <outline text="Nostr" title="Nostr">
+      <outline type="rss" text="Blog" xmlUrl="https://example.com/rss" htmlUrl="https://example.com"/>
+      <outline type="rss" text="Blog again" xmlUrl=" https://example.com/rss "/>
+    </outline>
+    <outline type="rss" text="Podcast" xmlUrl="https://example.org/podcast.xml"/>
+    <outline text="Empty folder"/>
+  </body>
+</opml>`
+
+func TestParseCollectsNestedFeedURLs(t *testing.T) {
+	document, err := Parse(strings.NewReader(sampleOPML))
+	assert.NoError(t, err)
+	assert.Equal(t, "Reading list", document.Head.Title)
+	assert.Equal(t, []string{"https://example.com/rss", "https://example.org/podcast.xml"}, document.FeedURLs())
+}
+
+func TestParseRejectsInvalidDocuments(t *testing.T) {
+	_, err := Parse(strings.NewReader("<rss><channel></channel></rss>"))
+	assert.Error(t, err)
+	_, err = Parse(strings.NewReader("not xml"))
+	assert.Error(t, err)
+}
+
+func TestWriteRoundTrips(t *testing.T) {
+	document := &Document{
+		Head: Head{Title: "rsslay feeds"},
+		Body: Body{Outlines: []Outline{{Text: "https://example.com/rss", Type: "rss", XMLURL: "https://example.com/rss", NPub: "npub1example"}}},
+	}
+
+	var buffer bytes.Buffer
+	assert.NoError(t, document.Write(&buffer))
+	assert.True(t, strings.HasPrefix(buffer.String(), `<?xml version="1.0" encoding="UTF-8"?>`))
+	assert.Contains(t, buffer.String(), `<opml version="2.0">`)
+	assert.Contains(t, buffer.String(), `npub="npub1example"`)
+
+	parsed, err := Parse(&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, document.Body.Outlines[0].NPub, parsed.Body.Outlines[0].NPub)
+	assert.Equal(t, []string{"https://example.com/rss"}, parsed.FeedURLs())
+}
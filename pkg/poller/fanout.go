@@ -0,0 +1,95 @@
+package poller
+
+import (
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// refreshAll refreshes the given feeds with up to Concurrency fetches at a
+// time. It returns once every fetch finished or, given a deadline, when it
+// passes: the remaining fetches keep running in the background so their
+// events are stored for the next queries.
+// Feeds already being refreshed by another batch are skipped.
+func (p *Poller) refreshAll(source string, feeds []storage.ScheduledFeed, deadline time.Duration) {
+	p.fanOut(source, p.claim(feeds), deadline)
+}
+
+// fanOut refreshes feeds already claimed like refreshAll.
+func (p *Poller) fanOut(source string, feeds []storage.ScheduledFeed, deadline time.Duration) {
+	if len(feeds) == 0 {
+		return
+	}
+
+	start := time.Now()
+	labels := prometheus.Labels{"source": source}
+	metrics.FanOutFeeds.With(labels).Observe(float64(len(feeds)))
+	defer func() {
+		metrics.FanOutDuration.With(labels).Observe(time.Since(start).Seconds())
+	}()
+
+	jobs := make(chan storage.ScheduledFeed, len(feeds))
+	for _, scheduled := range feeds {
+		jobs <- scheduled
+	}
+	close(jobs)
+
+	// buffered so workers never block on a batch that stopped waiting
+	done := make(chan struct{}, len(feeds))
+	workers := p.Concurrency
+	if workers <= 0 || workers > len(feeds) {
+		workers = len(feeds)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for scheduled := range jobs {
+				p.refresh(scheduled)
+				p.release(scheduled)
+				done <- struct{}{}
+			}
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if deadline > 0 {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for finished := 0; finished < len(feeds); finished++ {
+		select {
+		case <-done:
+		case <-timeout:
+			metrics.FanOutDeadlineExceeded.With(labels).Add(float64(len(feeds) - finished))
+			return
+		}
+	}
+}
+
+// claim marks the feeds as being refreshed, leaving out the ones already are.
+func (p *Poller) claim(feeds []storage.ScheduledFeed) []storage.ScheduledFeed {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.inFlight == nil {
+		p.inFlight = map[string]struct{}{}
+	}
+
+	var claimed []storage.ScheduledFeed
+	for _, scheduled := range feeds {
+		if _, ok := p.inFlight[scheduled.Entity.PublicKey]; ok {
+			continue
+		}
+		p.inFlight[scheduled.Entity.PublicKey] = struct{}{}
+		claimed = append(claimed, scheduled)
+	}
+	return claimed
+}
+
+func (p *Poller) release(scheduled storage.ScheduledFeed) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.inFlight, scheduled.Entity.PublicKey)
+}
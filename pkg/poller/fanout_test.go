@@ -0,0 +1,262 @@
+package poller
+
+import (
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/events"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/piraces/rsslay/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleFeed = `<rss version="2.0">
+<channel>
+<title>Sample</title>
+<link>https://example.com</link>
+<description>Sample feed</description>
+<item>
+<title>Sample item</title>
+<link>https://example.com/item</link>
+<guid>https://example.com/item</guid>
+<pubDate>Sat, 18 Feb 2023 12:35:17 GMT</pubDate>
+</item>
+</channel>
+</rss>`
+
+func feedServer(t *testing.T, delay time.Duration) *httptest.Server {
+	assert.NoError(t, feed.AllowAddresses([]string{"127.0.0.1"}))
+	t.Cleanup(func() { _ = feed.AllowAddresses(nil) })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(sampleFeed))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func insertFeed(t *testing.T, store storage.Storage, url string) string {
+	privateKey := feed.PrivateKeyFromFeed(url, "test")
+	publicKey, _ := nostr.GetPublicKey(privateKey)
+	_, err := store.InsertFeed(feed.Entity{PublicKey: publicKey, PrivateKey: privateKey, URL: url})
+	assert.NoError(t, err)
+	return publicKey
+}
+
+func TestRefreshPendingReturnsPartialResultsAtDeadline(t *testing.T) {
+	store := storagetest.Open(t)
+	fastPubKey := insertFeed(t, store, feedServer(t, 0).URL)
+	slowPubKey := insertFeed(t, store, feedServer(t, time.Second).URL)
+
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 10),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		Concurrency:     2,
+		QueryDeadline:   300 * time.Millisecond,
+	}
+
+	start := time.Now()
+	p.RefreshPending([]string{fastPubKey, slowPubKey})
+	assert.Less(t, time.Since(start), time.Second)
+
+	stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{fastPubKey}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+	status, err := store.GetFeedStatus(fastPubKey)
+	assert.NoError(t, err)
+	assert.NotZero(t, status.LastFetchAt)
+	assert.Empty(t, status.LastError)
+	stored, err = store.QueryEvents(&nostr.Filter{Authors: []string{slowPubKey}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// the slow feed is still being refreshed, so it isn't fetched twice
+	assert.Empty(t, p.claim([]storage.ScheduledFeed{{Entity: feed.Entity{PublicKey: slowPubKey}}}))
+
+	assert.Eventually(t, func() bool {
+		stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{slowPubKey}})
+		return err == nil && len(stored) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestRefreshSkipsFeedsRefusedByDomainPolicy(t *testing.T) {
+	store := storagetest.Open(t)
+	pubKey := insertFeed(t, store, feedServer(t, 0).URL)
+	policy, err := feed.ParseDomainPolicy(nil, []string{"127.0.0.1"})
+	assert.NoError(t, err)
+	feed.ConfigureDomainPolicy(policy)
+	t.Cleanup(func() { feed.ConfigureDomainPolicy(feed.DomainPolicy{}) })
+
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 10),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		Concurrency:     1,
+	}
+	p.RefreshPending([]string{pubKey})
+
+	stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{pubKey}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+	due, err := store.DueFeeds(time.Now().Add(23*time.Hour).Unix(), 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+}
+
+func TestRefreshPostponesFeedsThrottledByTheirHost(t *testing.T) {
+	store := storagetest.Open(t)
+	server := feedServer(t, 0)
+	firstPubKey := insertFeed(t, store, server.URL+"/first")
+	secondPubKey := insertFeed(t, store, server.URL+"/second")
+	feed.ConfigurePoliteness(feed.Politeness{UserAgent: feed.DefaultUserAgent, RequestsPerSecond: 0.01, Burst: 1})
+	t.Cleanup(func() { feed.ConfigurePoliteness(feed.Politeness{UserAgent: feed.DefaultUserAgent}) })
+
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 10),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		Concurrency:     1,
+	}
+	start := time.Now()
+	p.RefreshPending([]string{firstPubKey, secondPubKey})
+	assert.Less(t, time.Since(start), time.Second)
+
+	// one of them waits for the host, without counting as a failure
+	due, err := store.DueFeeds(time.Now().Add(2*time.Minute).Unix(), 10, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		status, err := store.GetFeedStatus(due[0].Entity.PublicKey)
+		assert.NoError(t, err)
+		assert.Zero(t, status.LastFetchAt)
+		assert.Empty(t, status.LastError)
+	}
+}
+
+func TestRefreshKeepsTheSiteImageWhenTheSiteFails(t *testing.T) {
+	store := storagetest.Open(t)
+	assert.NoError(t, feed.AllowAddresses([]string{"127.0.0.1"}))
+	t.Cleanup(func() { _ = feed.AllowAddresses(nil) })
+	siteDown := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(strings.Replace(sampleFeed, "https://example.com", "http://"+r.Host, 1)))
+		case siteDown:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head><meta property="og:image" content="/banner.png"></head></html>`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	pubKey := insertFeed(t, store, server.URL+"/rss")
+
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 10),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		Concurrency:     1,
+		QueryDeadline:   5 * time.Second,
+	}
+	banner := func() string {
+		stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{pubKey}, Kinds: []int{nostr.KindSetMetadata}})
+		assert.NoError(t, err)
+		assert.Len(t, stored, 1)
+		var metadata map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(stored[0].Content), &metadata))
+		return metadata["banner"].(string)
+	}
+
+	assert.NoError(t, p.ForceRefresh(pubKey))
+	assert.Equal(t, server.URL+"/banner.png", banner())
+	entity, err := store.GetFeed(pubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/banner.png", entity.SiteImage)
+
+	// the site isn't checked again until the image gets old, and then its
+	// failures don't take the banner away
+	siteDown = true
+	assert.NoError(t, store.SetFeedSiteImage(pubKey, entity.SiteImage, time.Now().Add(-siteImageTTL).Unix()))
+	assert.NoError(t, p.ForceRefresh(pubKey))
+	assert.Equal(t, server.URL+"/banner.png", banner())
+	entity, err = store.GetFeed(pubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/banner.png", entity.SiteImage)
+	assert.Greater(t, entity.SiteImageCheckedAt, time.Now().Add(-time.Minute).Unix())
+}
+
+func TestPollFetchesEveryDueFeedInBatches(t *testing.T) {
+	store := storagetest.Open(t)
+	server := feedServer(t, 0)
+	var pubKeys []string
+	for i := 0; i < 5; i++ {
+		pubKeys = append(pubKeys, insertFeed(t, store, server.URL+"/"+strconv.Itoa(i)))
+	}
+
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 20),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		MaxFeedsPerPoll: 2,
+		Concurrency:     2,
+	}
+	p.Poll()
+
+	for _, pubKey := range pubKeys {
+		status, err := store.GetFeedStatus(pubKey)
+		assert.NoError(t, err)
+		assert.NotZero(t, status.LastFetchAt)
+	}
+}
+
+func TestForceRefreshLeavesDisabledAndInFlightFeeds(t *testing.T) {
+	store := storagetest.Open(t)
+	pubKey := insertFeed(t, store, feedServer(t, 0).URL)
+	p := &Poller{
+		Store:           store,
+		Updates:         make(chan nostr.Event, 10),
+		Options:         &events.Options{MaxContentLength: 250},
+		DefaultInterval: 20 * time.Minute,
+		MinInterval:     5 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		QueryDeadline:   5 * time.Second,
+	}
+
+	assert.NoError(t, store.SetFeedDisabled(pubKey, true))
+	assert.ErrorIs(t, p.ForceRefresh(pubKey), ErrFeedDisabled)
+	assert.NoError(t, store.SetFeedDisabled(pubKey, false))
+
+	inFlight := p.claim([]storage.ScheduledFeed{{Entity: feed.Entity{PublicKey: pubKey}}})
+	assert.ErrorIs(t, p.ForceRefresh(pubKey), ErrAlreadyRefreshing)
+	p.release(inFlight[0])
+
+	assert.NoError(t, p.ForceRefresh(pubKey))
+	status, err := store.GetFeedStatus(pubKey)
+	assert.NoError(t, err)
+	assert.NotZero(t, status.LastFetchAt)
+	assert.ErrorIs(t, p.ForceRefresh(strings.Repeat("0", 64)), storage.ErrFeedNotFound)
+}
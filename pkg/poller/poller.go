@@ -0,0 +1,240 @@
+package poller
+
+import (
+	"errors"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/events"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/replayer"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const tickInterval = time.Minute
+
+// Errors of ForceRefresh.
+var (
+	ErrAlreadyRefreshing = errors.New("feed is already being refreshed")
+	ErrFeedDisabled      = errors.New("feed is disabled")
+)
+
+// feedLease is how long the feeds claimed by an instance are left alone by
+// the others sharing the database, in case it stops before scheduling them.
+const feedLease = 10 * time.Minute
+
+// siteImageTTL is how long the image of the site of a feed, the banner of
+// its profile, is kept before checking the site again.
+const siteImageTTL = 24 * time.Hour
+
+// Poller fetches every registered feed on its own schedule, stores the
+// generated events and pushes the new ones to the relay listeners.
+// Up to Concurrency feeds are fetched at the same time, out of batches of
+// MaxFeedsPerPoll due feeds, and queries wait for the feeds they trigger at
+// most QueryDeadline.
+type Poller struct {
+	Store              storage.Storage
+	Updates            chan nostr.Event
+	Options            *events.Options
+	DeleteFailingFeeds bool
+	NitterInstances    []string
+	DefaultInterval    time.Duration
+	MinInterval        time.Duration
+	MaxInterval        time.Duration
+	MaxFeedsPerPoll    int
+	Concurrency        int
+	QueryDeadline      time.Duration
+	OnNewEvents        func(events []replayer.EventWithPrivateKey)
+
+	mutex    sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func (p *Poller) Start() {
+	go func() {
+		for {
+			p.Poll()
+			time.Sleep(tickInterval)
+		}
+	}()
+}
+
+// Poll fetches the feeds whose next fetch time has been reached, a batch at
+// a time until none is left. Feeds scheduled again meanwhile wait for the
+// next poll.
+func (p *Poller) Poll() {
+	metrics.PollerOps.Inc()
+
+	start := time.Now()
+	batchSize := max(p.MaxFeedsPerPoll, 1)
+	for {
+		dueFeeds, err := p.Store.DueFeeds(start.Unix(), batchSize, time.Now().Add(feedLease).Unix())
+		if err != nil {
+			log.Printf("[ERROR] failed to retrieve feeds to poll: %v", err)
+			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
+			return
+		}
+
+		log.Printf("[DEBUG] polling %d feeds", len(dueFeeds))
+		p.refreshAll("poll", dueFeeds, 0)
+		if len(dueFeeds) < batchSize {
+			return
+		}
+	}
+}
+
+// RefreshPending fetches right away the feeds of the given public keys that
+// were never fetched, so clients don't have to wait for the next poll.
+// It waits for them at most QueryDeadline, so slow feeds are left out of the
+// current query instead of delaying the ones already stored.
+func (p *Poller) RefreshPending(pubKeys []string) {
+	if len(pubKeys) == 0 {
+		return
+	}
+
+	pendingFeeds, err := p.Store.PendingFeeds(pubKeys)
+	if err != nil {
+		log.Printf("[ERROR] failed to retrieve pending feeds: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
+		return
+	}
+
+	p.refreshAll("query", pendingFeeds, p.QueryDeadline)
+}
+
+// ForceRefresh fetches the feed of the public key right away, downloading it
+// again even if unchanged, and waits for it at most QueryDeadline.
+// Disabled feeds and feeds being refreshed already are left alone, failing
+// with ErrFeedDisabled and ErrAlreadyRefreshing.
+func (p *Poller) ForceRefresh(pubKey string) error {
+	status, err := p.Store.GetFeedStatus(pubKey)
+	if err != nil {
+		return err
+	}
+	if status.Disabled {
+		return ErrFeedDisabled
+	}
+	entity, err := p.Store.GetFeed(pubKey)
+	if err != nil {
+		return err
+	}
+
+	feeds := p.claim([]storage.ScheduledFeed{{Entity: entity}})
+	if len(feeds) == 0 {
+		return ErrAlreadyRefreshing
+	}
+	p.fanOut("admin", feeds, p.QueryDeadline)
+	return nil
+}
+
+func (p *Poller) refresh(scheduled storage.ScheduledFeed) {
+	// feeds refused by the domain policy are kept until purged, but not fetched
+	if err := feed.CheckDomain(scheduled.Entity.URL); err != nil {
+		log.Printf("[DEBUG] skipping feed at url %q: %v", scheduled.Entity.URL, err)
+		p.schedule(scheduled.Entity, p.MaxInterval, scheduled.Validators)
+		return
+	}
+
+	metrics.FeedFetches.Inc()
+
+	interval := p.DefaultInterval
+	validators := scheduled.Validators
+	result, entity, err := events.FetchFeedForEntity(scheduled.Entity, &validators, p.Store, p.DeleteFailingFeeds, p.NitterInstances)
+	var throttledError *feed.ThrottledError
+	if errors.As(err, &throttledError) {
+		// not a failure of the feed, just try again once its host has room
+		p.schedule(entity, max(time.Until(throttledError.Until), time.Second), validators)
+		return
+	}
+	if result != nil || err != nil {
+		if err := p.Store.RecordFetch(entity.PublicKey, time.Now().Unix(), err); err != nil {
+			log.Printf("[ERROR] failure to record fetch of feed %q: %v", entity.URL, err)
+			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+		}
+	}
+	if result != nil {
+		if result.NotModified {
+			log.Printf("[DEBUG] feed at url %q not modified since last fetch", entity.URL)
+		} else {
+			entity = p.refreshSiteImage(entity, result.Feed.Link)
+			newEvents := p.storeEvents(entity, result.Feed)
+			log.Printf("[DEBUG] fetched feed at url %q with %d new events", entity.URL, len(newEvents))
+
+			var eventsToReplay []replayer.EventWithPrivateKey
+			for _, evt := range newEvents {
+				evt := evt
+				p.Updates <- evt
+				eventsToReplay = append(eventsToReplay, replayer.EventWithPrivateKey{Event: &evt, PrivateKey: entity.PrivateKey, Relays: entity.Relays})
+			}
+			if p.OnNewEvents != nil {
+				p.OnNewEvents(eventsToReplay)
+			}
+		}
+
+		validators = result.Validators
+		interval = nextFetchInterval(result, time.Now(), p.DefaultInterval, p.MinInterval, p.MaxInterval)
+	}
+
+	p.schedule(entity, interval, validators)
+}
+
+// schedule records when to fetch the feed again, after the given interval.
+func (p *Poller) schedule(entity feed.Entity, interval time.Duration, validators feed.Validators) {
+	// don't come back before the host asked to
+	if backoff := time.Until(feed.HostBackoff(entity.URL)); backoff > interval {
+		interval = backoff
+	}
+
+	// spread fetches a little so feeds registered together don't stay in lockstep
+	interval += time.Duration(rand.Int63n(int64(interval/10) + 1))
+	nextFetchAt := time.Now().Add(interval).Unix()
+	if err := p.Store.ScheduleFeed(entity.PublicKey, nextFetchAt, validators); err != nil {
+		log.Printf("[ERROR] failure to schedule next fetch of feed %q: %v", entity.URL, err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+	}
+}
+
+// refreshSiteImage checks the image shared by the site of the feed when it
+// is first fetched and then every siteImageTTL, keeping the known image if
+// the site fails to answer so the profile doesn't change back and forth.
+func (p *Poller) refreshSiteImage(entity feed.Entity, siteUrl string) feed.Entity {
+	now := time.Now()
+	if now.Sub(time.Unix(entity.SiteImageCheckedAt, 0)) < siteImageTTL {
+		return entity
+	}
+
+	image, err := feed.SiteImage(siteUrl)
+	if err != nil {
+		log.Printf("[DEBUG] failed to fetch the image of %q, keeping the last one: %v", siteUrl, err)
+		image = entity.SiteImage
+	}
+	if err := p.Store.SetFeedSiteImage(entity.PublicKey, image, now.Unix()); err != nil {
+		log.Printf("[ERROR] failure to record the site image of feed %q: %v", entity.URL, err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+	}
+	entity.SiteImage = image
+	entity.SiteImageCheckedAt = now.Unix()
+	return entity
+}
+
+func (p *Poller) storeEvents(entity feed.Entity, parsedFeed *gofeed.Feed) []nostr.Event {
+	var newEvents []nostr.Event
+	for _, evt := range events.FeedToEvents(entity.PublicKey, parsedFeed, entity, p.Options) {
+		evt := evt
+		saved, err := p.Store.SaveEvent(&evt)
+		if err != nil {
+			log.Printf("[ERROR] failure to store event %s of feed %q: %v", evt.ID, entity.URL, err)
+			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+			continue
+		}
+		if saved {
+			newEvents = append(newEvents, evt)
+		}
+	}
+	return newEvents
+}
@@ -0,0 +1,116 @@
+package poller
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/piraces/rsslay/pkg/feed"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var updatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// nextFetchInterval picks how long to wait before fetching a feed again.
+// The longest refresh hint given by the publisher (RSS ttl, syndication
+// module or HTTP caching headers) wins, bounded by the configured limits.
+func nextFetchInterval(result *feed.FetchResult, now time.Time, defaultInterval time.Duration, minInterval time.Duration, maxInterval time.Duration) time.Duration {
+	var interval time.Duration
+	for _, hint := range []time.Duration{ttlHint(result.Feed), syndicationHint(result.Feed), cacheHint(result.Header, now)} {
+		if hint > interval {
+			interval = hint
+		}
+	}
+
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	if interval < minInterval {
+		interval = minInterval
+	}
+	if maxInterval > 0 && interval > maxInterval {
+		interval = maxInterval
+	}
+
+	return interval
+}
+
+func ttlHint(parsedFeed *gofeed.Feed) time.Duration {
+	if parsedFeed == nil || parsedFeed.Custom == nil {
+		return 0
+	}
+
+	minutes, err := strconv.Atoi(strings.TrimSpace(parsedFeed.Custom["ttl"]))
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func syndicationHint(parsedFeed *gofeed.Feed) time.Duration {
+	if parsedFeed == nil || parsedFeed.Extensions == nil {
+		return 0
+	}
+
+	sy, ok := parsedFeed.Extensions["sy"]
+	if !ok || len(sy["updatePeriod"]) == 0 {
+		return 0
+	}
+
+	period, ok := updatePeriods[strings.ToLower(strings.TrimSpace(sy["updatePeriod"][0].Value))]
+	if !ok {
+		return 0
+	}
+
+	frequency := 1
+	if len(sy["updateFrequency"]) > 0 {
+		if value, err := strconv.Atoi(strings.TrimSpace(sy["updateFrequency"][0].Value)); err == nil && value > 0 {
+			frequency = value
+		}
+	}
+
+	return period / time.Duration(frequency)
+}
+
+func cacheHint(header http.Header, now time.Time) time.Duration {
+	if header == nil {
+		return 0
+	}
+
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+		return 0
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || name != "max-age" {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if expiresAt.After(now) {
+			return expiresAt.Sub(now)
+		}
+	}
+
+	return 0
+}
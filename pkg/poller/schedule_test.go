@@ -0,0 +1,88 @@
+package poller
+
+import (
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var sampleNow = time.Date(2023, 2, 18, 12, 0, 0, 0, time.UTC)
+
+func syndicationExtensions(period string, frequency string) ext.Extensions {
+	return ext.Extensions{
+		"sy": map[string][]ext.Extension{
+			"updatePeriod":    {{Name: "updatePeriod", Value: period}},
+			"updateFrequency": {{Name: "updateFrequency", Value: frequency}},
+		},
+	}
+}
+
+func TestNextFetchInterval(t *testing.T) {
+	testCases := []struct {
+		feed             *gofeed.Feed
+		header           http.Header
+		expectedInterval time.Duration
+	}{
+		{
+			feed:             &gofeed.Feed{},
+			header:           http.Header{},
+			expectedInterval: 20 * time.Minute,
+		},
+		{
+			feed:             &gofeed.Feed{Custom: map[string]string{"ttl": "60"}},
+			header:           http.Header{},
+			expectedInterval: time.Hour,
+		},
+		{
+			feed:             &gofeed.Feed{Custom: map[string]string{"ttl": "not a number"}},
+			header:           http.Header{},
+			expectedInterval: 20 * time.Minute,
+		},
+		{
+			feed:             &gofeed.Feed{Extensions: syndicationExtensions("hourly", "2")},
+			header:           http.Header{},
+			expectedInterval: 30 * time.Minute,
+		},
+		{
+			feed:             &gofeed.Feed{Extensions: syndicationExtensions("weekly", "1")},
+			header:           http.Header{},
+			expectedInterval: 24 * time.Hour,
+		},
+		{
+			feed:             &gofeed.Feed{},
+			header:           http.Header{"Cache-Control": []string{"public, max-age=3600"}},
+			expectedInterval: time.Hour,
+		},
+		{
+			feed:             &gofeed.Feed{},
+			header:           http.Header{"Cache-Control": []string{"max-age=60"}},
+			expectedInterval: 5 * time.Minute,
+		},
+		{
+			feed:             &gofeed.Feed{},
+			header:           http.Header{"Cache-Control": []string{"no-cache, max-age=3600"}},
+			expectedInterval: 20 * time.Minute,
+		},
+		{
+			feed: &gofeed.Feed{},
+			header: http.Header{
+				"Date":    []string{sampleNow.Format(http.TimeFormat)},
+				"Expires": []string{sampleNow.Add(45 * time.Minute).Format(http.TimeFormat)},
+			},
+			expectedInterval: 45 * time.Minute,
+		},
+		{
+			feed:             &gofeed.Feed{Custom: map[string]string{"ttl": "10"}},
+			header:           http.Header{"Cache-Control": []string{"max-age=1800"}},
+			expectedInterval: 30 * time.Minute,
+		},
+	}
+	for _, tc := range testCases {
+		interval := nextFetchInterval(&feed.FetchResult{Feed: tc.feed, Header: tc.header}, sampleNow, 20*time.Minute, 5*time.Minute, 24*time.Hour)
+		assert.Equal(t, tc.expectedInterval, interval)
+	}
+}
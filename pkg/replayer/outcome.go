@@ -0,0 +1,71 @@
+package replayer
+
+import (
+	"errors"
+	"strings"
+)
+
+// Outcomes of sending an event to a relay, after the machine-readable prefix
+// of the NIP-20 OK message when the relay refused it.
+const (
+	OutcomeAccepted     = "accepted"
+	OutcomeDuplicate    = "duplicate"
+	OutcomeRateLimited  = "rate-limited"
+	OutcomeBlocked      = "blocked"
+	OutcomeAuthRequired = "auth-required"
+	// OutcomeRejected is any other refusal, such as invalid or pow.
+	OutcomeRejected = "rejected"
+	// OutcomeUnconfirmed events got no OK before the timeout.
+	OutcomeUnconfirmed = "unconfirmed"
+	// OutcomeUnreachable events could not be sent, as the relay was down.
+	OutcomeUnreachable = "unreachable"
+)
+
+// rejectedPrefix is how go-nostr reports the message of an OK false.
+const rejectedPrefix = "msg: "
+
+// Outcome classifies the result of publishing an event, returning along with
+// it the message of the relay, or the error for events not answered.
+// go-nostr only exposes the message of refusals, so accepted duplicates are
+// reported as accepted.
+func Outcome(err error) (string, string) {
+	if err == nil {
+		return OutcomeAccepted, ""
+	}
+	if errors.Is(err, errNoConfirmation) {
+		return OutcomeUnconfirmed, err.Error()
+	}
+	if errors.Is(err, errAuthenticationFailed) {
+		return OutcomeAuthRequired, err.Error()
+	}
+
+	message := err.Error()
+	if !strings.HasPrefix(message, rejectedPrefix) {
+		return OutcomeUnreachable, message
+	}
+	message = strings.TrimPrefix(message, rejectedPrefix)
+	prefix, _, _ := strings.Cut(message, ":")
+	switch prefix {
+	case "duplicate":
+		return OutcomeDuplicate, message
+	case "rate-limited":
+		return OutcomeRateLimited, message
+	case "blocked", "restricted":
+		return OutcomeBlocked, message
+	case "auth-required":
+		return OutcomeAuthRequired, message
+	default:
+		return OutcomeRejected, message
+	}
+}
+
+// delivered reports whether the relay has the event after the outcome.
+func delivered(outcome string) bool {
+	return outcome == OutcomeAccepted || outcome == OutcomeDuplicate
+}
+
+// retryable reports whether sending the event again may get a different
+// outcome, unlike for events the relay refuses outright.
+func retryable(outcome string) bool {
+	return outcome != OutcomeBlocked && outcome != OutcomeRejected
+}
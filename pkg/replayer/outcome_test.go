@@ -0,0 +1,27 @@
+package replayer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOutcomeClassifiesRelayAnswers(t *testing.T) {
+	for err, expected := range map[error][2]string{
+		nil:                                   {OutcomeAccepted, ""},
+		errors.New("msg: duplicate: have it"): {OutcomeDuplicate, "duplicate: have it"},
+		errors.New("msg: rate-limited: slow down"):         {OutcomeRateLimited, "rate-limited: slow down"},
+		errors.New("msg: blocked: not allowed"):            {OutcomeBlocked, "blocked: not allowed"},
+		errors.New("msg: restricted: members only"):        {OutcomeBlocked, "restricted: members only"},
+		errors.New("msg: auth-required: who are you"):      {OutcomeAuthRequired, "auth-required: who are you"},
+		errors.New("msg: invalid: bad signature"):          {OutcomeRejected, "invalid: bad signature"},
+		errors.New("msg: "):                                {OutcomeRejected, ""},
+		errNoConfirmation:                                  {OutcomeUnconfirmed, errNoConfirmation.Error()},
+		fmt.Errorf("%w: msg: no", errAuthenticationFailed): {OutcomeAuthRequired, "failed to authenticate: msg: no"},
+		errors.New("failed to dial: connection refused"):   {OutcomeUnreachable, "failed to dial: connection refused"},
+	} {
+		outcome, message := Outcome(err)
+		assert.Equal(t, expected, [2]string{outcome, message}, "%v", err)
+	}
+}
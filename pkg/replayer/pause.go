@@ -0,0 +1,129 @@
+package replayer
+
+import (
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"sort"
+	"time"
+)
+
+// RelayState tells how a relay has been answering the events replayed to it.
+// Relays refusing PauseAfter events in a row are paused until PausedUntil.
+type RelayState struct {
+	Relay string
+	// Rejections is the number of events refused in a row.
+	Rejections  int
+	LastOutcome string
+	LastMessage string
+	Paused      bool
+	PausedUntil time.Time
+}
+
+// rejected reports whether the relay refused the event, as opposed to being
+// unreachable or slow to answer, which doesn't tell anything about the event.
+func rejected(outcome string) bool {
+	return !delivered(outcome) && outcome != OutcomeUnreachable && outcome != OutcomeUnconfirmed
+}
+
+// recordOutcome keeps count of the refusals of the relay in a row, pausing
+// it for PauseDuration once they reach PauseAfter.
+func (o *Outbox) recordOutcome(relay string, outcome string, message string, now time.Time) {
+	o.stateMutex.Lock()
+	defer o.stateMutex.Unlock()
+
+	state := o.state(relay)
+	state.LastOutcome = outcome
+	state.LastMessage = message
+	if delivered(outcome) {
+		state.Rejections = 0
+		return
+	}
+	if !rejected(outcome) {
+		return
+	}
+
+	state.Rejections++
+	if o.PauseAfter > 0 && state.Rejections >= o.PauseAfter && !state.Paused {
+		state.Paused = true
+		state.PausedUntil = now.Add(o.PauseDuration)
+		metrics.ReplayRelayPaused.With(prometheus.Labels{"relay": relay}).Set(1)
+		log.Printf("[WARN] pausing replay to %s until %s after %d events refused in a row, last one with: %s",
+			relay, state.PausedUntil.Format(time.RFC3339), state.Rejections, message)
+	}
+}
+
+// pausedRelays returns the relays paused at the time, resuming the ones whose
+// pause ended. Those are paused again on the next refusal.
+func (o *Outbox) pausedRelays(now time.Time) []string {
+	o.stateMutex.Lock()
+	defer o.stateMutex.Unlock()
+
+	var paused []string
+	for relay, state := range o.states {
+		if !state.Paused {
+			continue
+		}
+		if now.Before(state.PausedUntil) {
+			paused = append(paused, relay)
+			continue
+		}
+		o.resume(relay, state)
+		state.Rejections = max(o.PauseAfter-1, 0)
+	}
+	sort.Strings(paused)
+	return paused
+}
+
+// Resume replays events to the relay again right away, reporting whether it
+// was paused.
+func (o *Outbox) Resume(relay string) bool {
+	o.stateMutex.Lock()
+	defer o.stateMutex.Unlock()
+
+	state, ok := o.states[relay]
+	if !ok || !state.Paused {
+		return false
+	}
+	o.resume(relay, state)
+	state.Rejections = 0
+	return true
+}
+
+func (o *Outbox) resume(relay string, state *RelayState) {
+	state.Paused = false
+	state.PausedUntil = time.Time{}
+	metrics.ReplayRelayPaused.With(prometheus.Labels{"relay": relay}).Set(0)
+	log.Printf("[INFO] resuming replay to %s", relay)
+}
+
+// RelayStates returns the state of the configured relays and of any other
+// relay events were replayed to, sorted by relay.
+func (o *Outbox) RelayStates() []RelayState {
+	o.stateMutex.Lock()
+	defer o.stateMutex.Unlock()
+
+	for _, relay := range o.Relays {
+		o.state(relay)
+	}
+	states := make([]RelayState, 0, len(o.states))
+	for _, state := range o.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Relay < states[j].Relay
+	})
+	return states
+}
+
+func (o *Outbox) state(relay string) *RelayState {
+	if o.states == nil {
+		o.states = make(map[string]*RelayState)
+	}
+	state, ok := o.states[relay]
+	if !ok {
+		state = &RelayState{Relay: relay}
+		o.states[relay] = state
+	}
+	return state
+}
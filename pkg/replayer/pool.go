@@ -0,0 +1,198 @@
+package replayer
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// reconnectDelay is how long deliveries to a relay fail right away after
+	// failing to connect to it, instead of each one trying again.
+	reconnectDelay = 30 * time.Second
+	// authTimeout bounds the wait for the relay to confirm an authentication,
+	// which NIP-42 does not require it to.
+	authTimeout = 3 * time.Second
+)
+
+// Pool keeps a long-lived connection to each relay events are replayed to,
+// shared by all the feeds and reconnected when dropped. go-nostr pings every
+// connection every 29 seconds, closing the ones whose relay is gone.
+type Pool struct {
+	mutex       sync.Mutex
+	connections map[string]*connection
+}
+
+type connection struct {
+	mutex   sync.Mutex
+	current *session
+	err     error
+	retryAt time.Time
+}
+
+// session is a connection to a relay, along with its latest NIP-42 challenge
+// and the feeds authenticated for it, which are lost when disconnected.
+type session struct {
+	relay     *nostr.Relay
+	challenge atomic.Pointer[string]
+	// challenged is closed once the relay sent a challenge.
+	challenged     chan struct{}
+	challengedOnce sync.Once
+
+	authMutex sync.Mutex
+	// authenticated maps public keys to the challenge they answered.
+	authenticated map[string]string
+}
+
+// Publish sends the event to the relay, authenticating the feed with its
+// private key first if the relay sent a challenge, and waits for the relay
+// to confirm it.
+func (p *Pool) Publish(ctx context.Context, url string, privateKey string, evt nostr.Event) error {
+	s, err := p.session(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if err := s.authenticate(ctx, privateKey, evt.PubKey); err != nil {
+		return err
+	}
+	status, err := s.relay.Publish(ctx, evt)
+	if err != nil && strings.Contains(err.Error(), "auth-required:") && s.waitForChallenge(ctx) {
+		// the challenge may come along with the refusal, as the ones sent
+		// right on connecting can be missed
+		if err := s.authenticate(ctx, privateKey, evt.PubKey); err != nil {
+			return err
+		}
+		status, err = s.relay.Publish(ctx, evt)
+	}
+	if err != nil {
+		return err
+	}
+	if status != nostr.PublishStatusSucceeded {
+		return errNoConfirmation
+	}
+	return nil
+}
+
+// Close disconnects from every relay.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, c := range p.connections {
+		c.mutex.Lock()
+		if c.current != nil {
+			_ = c.current.relay.Close()
+			c.current = nil
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (p *Pool) session(ctx context.Context, url string) (*session, error) {
+	p.mutex.Lock()
+	if p.connections == nil {
+		p.connections = make(map[string]*connection)
+	}
+	c, ok := p.connections[url]
+	if !ok {
+		c = &connection{}
+		p.connections[url] = c
+	}
+	p.mutex.Unlock()
+
+	return c.session(ctx, url)
+}
+
+// session returns the current connection to the relay, connecting again if
+// it was dropped.
+func (c *connection) session(ctx context.Context, url string) (*session, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.current != nil && c.current.relay.IsConnected() {
+		return c.current, nil
+	}
+	if time.Now().Before(c.retryAt) {
+		return nil, c.err
+	}
+
+	s := &session{challenged: make(chan struct{}), authenticated: make(map[string]string)}
+	s.relay = nostr.NewRelay(context.Background(), url, nostr.WithAuthHandler(s.handleChallenge))
+	if err := s.relay.Connect(ctx); err != nil {
+		log.Printf("[ERROR] Error while trying to connect with relay '%s': %v", url, err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "REPLAY_CONNECT"}).Inc()
+		c.current = nil
+		c.err = err
+		c.retryAt = time.Now().Add(reconnectDelay)
+		return nil, err
+	}
+
+	if c.current != nil {
+		log.Printf("[INFO] reconnected to relay '%s'", url)
+	}
+	c.current = s
+	return s, nil
+}
+
+// handleChallenge keeps the challenge, to be answered by each feed before
+// publishing, as the connection is shared by all of them.
+func (s *session) handleChallenge(_ context.Context, authEvent *nostr.Event) bool {
+	if tag := authEvent.Tags.GetFirst([]string{"challenge", ""}); tag != nil {
+		challenge := tag.Value()
+		s.challenge.Store(&challenge)
+		s.challengedOnce.Do(func() { close(s.challenged) })
+	}
+	return false
+}
+
+// waitForChallenge reports whether the relay sent a challenge, waiting for
+// it at most authTimeout.
+func (s *session) waitForChallenge(ctx context.Context) bool {
+	select {
+	case <-s.challenged:
+		return true
+	case <-time.After(authTimeout):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// authenticate answers the latest challenge of the relay with the private
+// key, unless the public key already did.
+func (s *session) authenticate(ctx context.Context, privateKey string, pubKey string) error {
+	challenge := s.challenge.Load()
+	if challenge == nil {
+		return nil
+	}
+
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	if s.authenticated[pubKey] == *challenge {
+		return nil
+	}
+
+	authEvent := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindClientAuthentication,
+		Tags:      nostr.Tags{{"relay", s.relay.URL}, {"challenge", *challenge}},
+	}
+	if err := authEvent.Sign(privateKey); err != nil {
+		return fmt.Errorf("failed to sign authentication: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+	if _, err := s.relay.Auth(ctx, authEvent); err != nil {
+		return fmt.Errorf("%w: %v", errAuthenticationFailed, err)
+	}
+
+	s.authenticated[pubKey] = *challenge
+	return nil
+}
@@ -0,0 +1,145 @@
+package replayer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authRelay is a relay accepting events only from the public keys that
+// answered its NIP-42 challenge on the same connection, sending the challenge
+// again along with each refusal.
+type authRelay struct {
+	mutex       sync.Mutex
+	connections []*websocket.Conn
+	received    []string
+}
+
+func (a *authRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	a.mutex.Lock()
+	a.connections = append(a.connections, conn)
+	a.mutex.Unlock()
+	defer conn.Close()
+
+	challenge := "challenge"
+	authenticated := map[string]bool{}
+	_ = conn.WriteJSON([]any{"AUTH", challenge})
+	for {
+		var message []json.RawMessage
+		if err := conn.ReadJSON(&message); err != nil || len(message) < 2 {
+			return
+		}
+		var label string
+		var evt nostr.Event
+		_ = json.Unmarshal(message[0], &label)
+		_ = json.Unmarshal(message[1], &evt)
+
+		switch label {
+		case "AUTH":
+			ok, _ := evt.CheckSignature()
+			authenticated[evt.PubKey] = ok && evt.Tags.GetFirst([]string{"challenge", challenge}) != nil
+			_ = conn.WriteJSON([]any{"OK", evt.ID, authenticated[evt.PubKey], ""})
+		case "EVENT":
+			if !authenticated[evt.PubKey] {
+				_ = conn.WriteJSON([]any{"AUTH", challenge})
+				_ = conn.WriteJSON([]any{"OK", evt.ID, false, "auth-required: publish as yourself"})
+				continue
+			}
+			a.mutex.Lock()
+			a.received = append(a.received, evt.ID)
+			a.mutex.Unlock()
+			_ = conn.WriteJSON([]any{"OK", evt.ID, true, ""})
+		}
+	}
+}
+
+func (a *authRelay) dropConnections() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, conn := range a.connections {
+		_ = conn.Close()
+	}
+}
+
+func (a *authRelay) counts() (int, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.connections), len(a.received)
+}
+
+func signedNote(t *testing.T, privateKey string) nostr.Event {
+	evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "note " + privateKey[:8]}
+	assert.NoError(t, evt.Sign(privateKey))
+	return evt
+}
+
+func TestPoolSharesAuthenticatedConnectionBetweenFeeds(t *testing.T) {
+	relay := &authRelay{}
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	pool := &Pool{}
+	t.Cleanup(pool.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, privateKey := range []string{nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()} {
+		assert.NoError(t, pool.Publish(ctx, url, privateKey, signedNote(t, privateKey)))
+		assert.NoError(t, pool.Publish(ctx, url, privateKey, signedNote(t, privateKey)))
+	}
+	connections, received := relay.counts()
+	assert.Equal(t, 1, connections)
+	assert.Equal(t, 4, received)
+}
+
+func TestPoolReconnectsDroppedConnections(t *testing.T) {
+	relay := &authRelay{}
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	pool := &Pool{}
+	t.Cleanup(pool.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	privateKey := nostr.GeneratePrivateKey()
+
+	assert.NoError(t, pool.Publish(ctx, url, privateKey, signedNote(t, privateKey)))
+	relay.dropConnections()
+	session, err := pool.session(ctx, url)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return !session.relay.IsConnected() }, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, pool.Publish(ctx, url, privateKey, signedNote(t, privateKey)))
+	connections, received := relay.counts()
+	assert.Equal(t, 2, connections)
+	assert.Equal(t, 2, received)
+}
+
+func TestPoolFailsFastAfterFailingToConnect(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	server.Close()
+
+	pool := &Pool{}
+	privateKey := nostr.GeneratePrivateKey()
+	err := pool.Publish(context.Background(), url, privateKey, signedNote(t, privateKey))
+	assert.Error(t, err)
+
+	start := time.Now()
+	assert.Equal(t, err, pool.Publish(context.Background(), url, privateKey, signedNote(t, privateKey)))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package replayer
+
+import (
+	"fmt"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"sync"
+)
+
+// Policies of a full Queue.
+const (
+	// PolicyBlock makes Submit wait for room in the queue.
+	PolicyBlock = "block"
+	// PolicyDropOldest drops the job waiting the longest to make room.
+	PolicyDropOldest = "drop-oldest"
+)
+
+// CheckPolicy returns an error for unknown queue policies.
+func CheckPolicy(policy string) error {
+	if policy != PolicyBlock && policy != PolicyDropOldest {
+		return fmt.Errorf("unknown queue policy %q, expected %q or %q", policy, PolicyBlock, PolicyDropOldest)
+	}
+	return nil
+}
+
+type job struct {
+	run  func()
+	drop func()
+}
+
+// Queue runs the submitted jobs with a fixed number of workers, holding up
+// to a fixed number of jobs waiting for them.
+type Queue struct {
+	jobs   chan job
+	policy string
+
+	submitMutex sync.Mutex
+	workers     sync.WaitGroup
+	pending     sync.WaitGroup
+}
+
+// NewQueue starts the workers of a queue holding up to size jobs, handling
+// submissions to it once full according to the policy.
+func NewQueue(size int, workers int, policy string) *Queue {
+	q := &Queue{jobs: make(chan job, max(size, 1)), policy: policy}
+	for i := 0; i < max(workers, 1); i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for j := range q.jobs {
+				metrics.ReplayRoutineQueueLength.Set(float64(len(q.jobs)))
+				j.run()
+				metrics.ReplayJobsCompleted.Inc()
+				q.pending.Done()
+			}
+		}()
+	}
+	return q
+}
+
+// Submit queues the job to run, or calls drop instead if the job is dropped
+// to make room for a newer one.
+func (q *Queue) Submit(run func(), drop func()) {
+	j := job{run: run, drop: drop}
+	q.pending.Add(1)
+	if q.policy != PolicyDropOldest {
+		q.jobs <- j
+		q.enqueued()
+		return
+	}
+
+	// submissions are serialized so the job dropped is the oldest one
+	q.submitMutex.Lock()
+	defer q.submitMutex.Unlock()
+	for {
+		select {
+		case q.jobs <- j:
+			q.enqueued()
+			return
+		default:
+		}
+		select {
+		case oldest := <-q.jobs:
+			metrics.ReplayJobsDropped.Inc()
+			oldest.drop()
+			q.pending.Done()
+		default:
+		}
+	}
+}
+
+// TrySubmit queues the job to run if there is room for it, without waiting
+// nor dropping other jobs, and tells whether it did. The job may still be
+// dropped later on, calling drop, to make room for a newer one.
+func (q *Queue) TrySubmit(run func(), drop func()) bool {
+	q.pending.Add(1)
+	select {
+	case q.jobs <- job{run: run, drop: drop}:
+		q.enqueued()
+		return true
+	default:
+		q.pending.Done()
+		return false
+	}
+}
+
+func (q *Queue) enqueued() {
+	metrics.ReplayJobsEnqueued.Inc()
+	metrics.ReplayRoutineQueueLength.Set(float64(len(q.jobs)))
+}
+
+// Wait waits for the jobs submitted so far to run or be dropped.
+func (q *Queue) Wait() {
+	q.pending.Wait()
+}
+
+// Close waits for the queued jobs to run and stops the workers.
+func (q *Queue) Close() {
+	close(q.jobs)
+	q.workers.Wait()
+}
@@ -0,0 +1,105 @@
+package replayer
+
+import (
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedQueue returns a queue with a single worker busy until release is
+// closed, and the jobs run or dropped so far.
+func blockedQueue(t *testing.T, size int, policy string) (*Queue, chan struct{}, func(string) (func(), func()), func() ([]string, []string)) {
+	queue := NewQueue(size, 1, policy)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	queue.Submit(func() {
+		close(started)
+		<-release
+	}, func() {})
+	<-started
+
+	var mutex sync.Mutex
+	var ran, dropped []string
+	job := func(name string) (func(), func()) {
+		return func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				ran = append(ran, name)
+			}, func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				dropped = append(dropped, name)
+			}
+	}
+	results := func() ([]string, []string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ran, dropped
+	}
+	return queue, release, job, results
+}
+
+func TestQueueBlocksSubmissionsWhenFull(t *testing.T) {
+	queue, release, job, results := blockedQueue(t, 1, PolicyBlock)
+	queue.Submit(job("first"))
+
+	submitted := make(chan struct{})
+	go func() {
+		queue.Submit(job("second"))
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submission to a full queue was expected to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-submitted
+	queue.Close()
+	ran, dropped := results()
+	assert.Equal(t, []string{"first", "second"}, ran)
+	assert.Empty(t, dropped)
+}
+
+func TestQueueDropsOldestJobsWhenFull(t *testing.T) {
+	enqueued := testutil.ToFloat64(metrics.ReplayJobsEnqueued)
+	droppedCount := testutil.ToFloat64(metrics.ReplayJobsDropped)
+	completed := testutil.ToFloat64(metrics.ReplayJobsCompleted)
+
+	queue, release, job, results := blockedQueue(t, 2, PolicyDropOldest)
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		queue.Submit(job(name))
+	}
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.ReplayRoutineQueueLength))
+
+	close(release)
+	queue.Close()
+	ran, dropped := results()
+	assert.Equal(t, []string{"third", "fourth"}, ran)
+	assert.Equal(t, []string{"first", "second"}, dropped)
+	assert.Equal(t, float64(5), testutil.ToFloat64(metrics.ReplayJobsEnqueued)-enqueued)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.ReplayJobsDropped)-droppedCount)
+	assert.Equal(t, float64(3), testutil.ToFloat64(metrics.ReplayJobsCompleted)-completed)
+}
+
+func TestQueueTrySubmitLeavesJobsOutWhenFull(t *testing.T) {
+	queue, release, job, results := blockedQueue(t, 1, PolicyBlock)
+	assert.True(t, queue.TrySubmit(job("first")))
+	assert.False(t, queue.TrySubmit(job("second")))
+
+	close(release)
+	queue.Close()
+	ran, dropped := results()
+	assert.Equal(t, []string{"first"}, ran)
+	assert.Empty(t, dropped)
+}
+
+func TestCheckPolicyRejectsUnknownPolicies(t *testing.T) {
+	assert.NoError(t, CheckPolicy(PolicyBlock))
+	assert.NoError(t, CheckPolicy(PolicyDropOldest))
+	assert.Error(t, CheckPolicy("drop-newest"))
+}
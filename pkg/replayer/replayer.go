@@ -2,103 +2,302 @@ package replayer
 
 import (
 	"context"
+	"errors"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
-	"sort"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
 
-type ReplayParameters struct {
-	MaxEventsToReplay        int
-	RelaysToPublish          []string
-	Mutex                    *sync.Mutex
-	Queue                    *int
-	WaitTime                 int64
-	WaitTimeForRelayResponse int64
-	Events                   []EventWithPrivateKey
-}
+// deliveryRetention is how long sent and failed deliveries are kept in the
+// outbox before being pruned.
+const deliveryRetention = 7 * 24 * time.Hour
+
+// minBackoff keeps failed deliveries from being retried within the same
+// pass, however low the configured backoff is.
+const minBackoff = time.Second
+
+// deliveryLease is how long the deliveries claimed by an instance are left
+// alone by the others sharing the database, in case it stops before
+// recording their attempt.
+const deliveryLease = 10 * time.Minute
+
+var (
+	errNoConfirmation       = errors.New("relay did not confirm the event before the timeout")
+	errAuthenticationFailed = errors.New("failed to authenticate")
+)
 
 type EventWithPrivateKey struct {
 	Event      *nostr.Event
 	PrivateKey string
+	// Relays overrides the relays the event is replayed to, as the relay
+	// list of its feed does, nil meaning the Relays of the outbox.
+	Relays []string
 }
 
-func ReplayEventsToRelays(parameters *ReplayParameters) {
-	eventCount := len(parameters.Events)
-	if eventCount == 0 {
-		return
-	}
+// Outbox replays the generated events to other relays. Events are stored in
+// the outbox table once per relay, so nothing is lost on restarts, and sent
+// right away through a Queue of QueueSize deliveries served by Workers if
+// there is room in it. Every Interval the deliveries left behind are queued
+// again in batches of BatchSize, applying QueuePolicy when the queue is full:
+// failed ones are retried with exponential backoff, from MinBackoff up to
+// MaxBackoff, until MaxAttempts is reached, unless the relay refused them
+// outright, and the ones that didn't fit in the queue on the next pass.
+// Relays refusing PauseAfter events in a row are paused for PauseDuration.
+type Outbox struct {
+	Store       storage.Storage
+	Relays      []string
+	Workers     int
+	QueueSize   int
+	QueuePolicy string
+	BatchSize   int
+	Interval    time.Duration
+	Timeout     time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+	// PauseAfter is the number of refusals in a row pausing a relay, or 0 to
+	// never pause relays.
+	PauseAfter    int
+	PauseDuration time.Duration
+	// Publish sends the event to the relay, authenticating with the private
+	// key if asked to. Defaults to publishing through a shared Pool.
+	Publish func(ctx context.Context, url string, privateKey string, evt nostr.Event) error
 
-	if eventCount > parameters.MaxEventsToReplay {
-		sort.Slice(parameters.Events, func(i, j int) bool {
-			return parameters.Events[i].Event.CreatedAt > parameters.Events[j].Event.CreatedAt
-		})
-		parameters.Events = parameters.Events[:parameters.MaxEventsToReplay]
+	pool      Pool
+	queue     *Queue
+	queueOnce sync.Once
+
+	stateMutex sync.Mutex
+	states     map[string]*RelayState
+}
+
+// Close stops the workers and disconnects from the relays, once the outbox
+// is no longer drained nor given events.
+func (o *Outbox) Close() {
+	if o.queue != nil {
+		o.queue.Close()
 	}
+	o.pool.Close()
+}
+
+// Wait waits for the deliveries queued so far to be sent or dropped.
+func (o *Outbox) Wait() {
+	o.jobs().Wait()
+}
 
+func (o *Outbox) Start() {
+	o.jobs()
 	go func() {
-		parameters.Mutex.Lock()
-		// publish the event to predefined relays
-		for _, url := range parameters.RelaysToPublish {
-			statusSummary := 0
-			for _, ev := range parameters.Events {
-				relay := connectToRelay(url, ev.PrivateKey)
-				if relay == nil {
-					continue
-				}
-				_ = relay.Close()
-
-				publishStatus := publishEvent(relay, *ev.Event, url)
-				statusSummary = statusSummary | int(publishStatus)
-			}
-			if statusSummary < 0 {
-				log.Printf("[WARN] Replayed %d events to %s with failed status summary %d\n", len(parameters.Events), url, statusSummary)
-			} else {
-				log.Printf("[DEBUG] Replayed %d events to %s with status summary %d\n", len(parameters.Events), url, statusSummary)
-			}
+		for {
+			o.Drain()
+			o.prune()
+			time.Sleep(o.Interval)
 		}
-		time.Sleep(time.Duration(parameters.WaitTime) * time.Millisecond)
-		*parameters.Queue--
-		metrics.ReplayRoutineQueueLength.Set(float64(*parameters.Queue))
-		parameters.Mutex.Unlock()
 	}()
 }
 
-func publishEvent(relay *nostr.Relay, ev nostr.Event, url string) nostr.Status {
-	publishStatus, err := relay.Publish(context.Background(), ev)
-	switch publishStatus {
-	case nostr.PublishStatusSent:
-		metrics.ReplayEvents.With(prometheus.Labels{"relay": url}).Inc()
-		break
-	default:
-		metrics.ReplayErrorEvents.With(prometheus.Labels{"relay": url}).Inc()
-		break
+// Enqueue stores the events to be sent to each of the write relays of their
+// feed, and queues them to be sent right away unless the relay is paused or
+// the queue is full. It never waits for the queue, since it is called while
+// refreshing feeds, leaving the deliveries that don't fit for the next pass.
+func (o *Outbox) Enqueue(events []EventWithPrivateKey) {
+	groups := make(map[string][]EventWithPrivateKey)
+	relays := make(map[string][]string)
+	for _, evt := range events {
+		writeRelays := evt.Relays
+		if writeRelays == nil {
+			writeRelays = o.Relays
+		}
+		key := strings.Join(writeRelays, " ")
+		groups[key] = append(groups[key], evt)
+		relays[key] = writeRelays
 	}
-	_ = relay.Close()
-	if err != nil {
-		log.Printf("[INFO] Failed to replay event to %s with error: %v", url, err)
+
+	now := time.Now()
+	paused := make(map[string]bool)
+	for _, relay := range o.pausedRelays(now) {
+		paused[relay] = true
+	}
+	for key, group := range groups {
+		eventIDs := make([]string, len(group))
+		byID := make(map[string]EventWithPrivateKey, len(group))
+		for i, evt := range group {
+			eventIDs[i] = evt.Event.ID
+			byID[evt.Event.ID] = evt
+		}
+
+		queued, err := o.Store.EnqueueDeliveries(eventIDs, relays[key], now.Unix(), now.Add(deliveryLease).Unix())
+		if err != nil {
+			log.Printf("[ERROR] failed to queue %d events to replay: %v", len(eventIDs), err)
+			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+			continue
+		}
+		for _, record := range queued {
+			evt := byID[record.EventID]
+			delivery := storage.Delivery{Relay: record.Relay, PrivateKey: evt.PrivateKey, Event: *evt.Event}
+			if paused[delivery.Relay] {
+				// left for the first pass after the relay is resumed
+				o.release(delivery)
+				continue
+			}
+			if !o.jobs().TrySubmit(o.job(delivery)) {
+				log.Printf("[DEBUG] replay queue full, event %s to %s left for the next pass", delivery.Event.ID, delivery.Relay)
+				o.release(delivery)
+			}
+		}
 	}
-	return publishStatus
 }
 
-func connectToRelay(url string, privateKey string) *nostr.Relay {
-	relay, e := nostr.RelayConnect(context.Background(), url, nostr.WithAuthHandler(func(ctx context.Context, authEvent *nostr.Event) (ok bool) {
-		err := authEvent.Sign(privateKey)
+// Drain queues the deliveries due, a batch at a time, until none is left or
+// a queue full of them was queued, so the ones failing again or dropped wait
+// for the next pass. It returns how many were queued.
+func (o *Outbox) Drain() int {
+	passLimit := max(o.QueueSize, 1)
+	batchSize := max(o.BatchSize, 1)
+	queued := 0
+	for queued < passLimit {
+		now := time.Now()
+		limit := min(batchSize, passLimit-queued)
+		due, err := o.Store.DueDeliveries(now.Unix(), limit, o.pausedRelays(now), now.Add(deliveryLease).Unix())
 		if err != nil {
-			log.Printf("[ERROR] Error while trying to authenticate with relay '%s': %v", url, err)
-			return false
+			log.Printf("[ERROR] failed to retrieve events to replay: %v", err)
+			metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
+			break
+		}
+
+		for _, delivery := range due {
+			o.submit(delivery)
+		}
+		queued += len(due)
+		if len(due) < limit {
+			break
+		}
+	}
+
+	if queued > 0 {
+		log.Printf("[DEBUG] queued %d events left to replay to other relays", queued)
+	}
+	o.updateMetrics()
+	return queued
+}
+
+// jobs returns the queue of the deliveries, starting it the first time.
+func (o *Outbox) jobs() *Queue {
+	o.queueOnce.Do(func() {
+		o.queue = NewQueue(o.QueueSize, o.Workers, o.QueuePolicy)
+	})
+	return o.queue
+}
+
+// submit queues the delivery according to the policy of the queue.
+func (o *Outbox) submit(delivery storage.Delivery) {
+	o.jobs().Submit(o.job(delivery))
+}
+
+// job returns the job sending the delivery, and the one giving it back for
+// the next pass if dropped from the queue.
+func (o *Outbox) job(delivery storage.Delivery) (func(), func()) {
+	return func() {
+			o.deliver(delivery)
+		}, func() {
+			log.Printf("[DEBUG] replay queue full, event %s to %s left for the next pass", delivery.Event.ID, delivery.Relay)
+			o.release(delivery)
 		}
-		return true
-	}),
-	)
-	if e != nil {
-		log.Printf("[ERROR] Error while trying to connect with relay '%s': %v", url, e)
-		metrics.AppErrors.With(prometheus.Labels{"type": "REPLAY_CONNECT"}).Inc()
-		return nil
+}
+
+func (o *Outbox) deliver(delivery storage.Delivery) {
+	publish := o.Publish
+	if publish == nil {
+		publish = o.pool.Publish
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	err := publish(ctx, delivery.Relay, delivery.PrivateKey, delivery.Event)
+	cancel()
+
+	now := time.Now()
+	outcome, message := Outcome(err)
+	metrics.ReplayDeliveryOutcomes.With(prometheus.Labels{"relay": delivery.Relay, "outcome": outcome}).Inc()
+	o.recordOutcome(delivery.Relay, outcome, message, now)
+
+	attempt := storage.DeliveryAttempt{
+		EventID:     delivery.Event.ID,
+		Relay:       delivery.Relay,
+		AttemptedAt: now.Unix(),
+		Status:      storage.DeliverySent,
+		Outcome:     outcome,
+		Error:       message,
+	}
+	attempts := delivery.Attempts + 1
+	switch {
+	case delivered(outcome):
+		metrics.ReplayEvents.With(prometheus.Labels{"relay": delivery.Relay}).Inc()
+	case !retryable(outcome):
+		metrics.ReplayErrorEvents.With(prometheus.Labels{"relay": delivery.Relay}).Inc()
+		log.Printf("[WARN] relay %s refused event %s (%s): %s", delivery.Relay, delivery.Event.ID, outcome, message)
+		attempt.Status = storage.DeliveryFailed
+	case o.MaxAttempts > 0 && attempts >= o.MaxAttempts:
+		metrics.ReplayErrorEvents.With(prometheus.Labels{"relay": delivery.Relay}).Inc()
+		log.Printf("[WARN] giving up replaying event %s to %s after %d attempts (%s): %s", delivery.Event.ID, delivery.Relay, attempts, outcome, message)
+		attempt.Status = storage.DeliveryFailed
+	default:
+		metrics.ReplayErrorEvents.With(prometheus.Labels{"relay": delivery.Relay}).Inc()
+		log.Printf("[INFO] failed to replay event %s to %s (attempt %d, %s): %s", delivery.Event.ID, delivery.Relay, attempts, outcome, message)
+		attempt.Status = storage.DeliveryPending
+		attempt.NextAttemptAt = now.Add(o.backoff(attempts)).Unix()
+	}
+
+	if err := o.Store.RecordDeliveryAttempt(attempt); err != nil {
+		log.Printf("[ERROR] failed to record replay of event %s to %s: %v", delivery.Event.ID, delivery.Relay, err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+	}
+}
 
-	return relay
+// release gives back a delivery that wasn't attempted, for the next pass.
+func (o *Outbox) release(delivery storage.Delivery) {
+	if err := o.Store.ReleaseDelivery(delivery.Event.ID, delivery.Relay, time.Now().Unix()); err != nil {
+		log.Printf("[ERROR] failed to release replay of event %s to %s: %v", delivery.Event.ID, delivery.Relay, err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+	}
+}
+
+// backoff doubles the wait after each failed attempt, with up to a tenth of
+// jitter so deliveries failing together don't retry together, waiting at
+// least minBackoff.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	wait := max(o.MinBackoff, minBackoff)
+	for i := 1; i < attempts && wait < o.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = max(min(wait, o.MaxBackoff), minBackoff)
+	return wait + time.Duration(rand.Int63n(int64(wait)/10+1))
+}
+
+func (o *Outbox) prune() {
+	pruned, err := o.Store.PruneDeliveries(time.Now().Add(-deliveryRetention).Unix())
+	if err != nil {
+		log.Printf("[ERROR] failed to prune replayed events: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_WRITE"}).Inc()
+		return
+	}
+	if pruned > 0 {
+		log.Printf("[DEBUG] pruned %d replayed events from the outbox", pruned)
+	}
+}
+
+func (o *Outbox) updateMetrics() {
+	counts, err := o.Store.CountDeliveries()
+	if err != nil {
+		log.Printf("[ERROR] failed to count events to replay: %v", err)
+		metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
+		return
+	}
+	for _, status := range []string{storage.DeliveryPending, storage.DeliverySent, storage.DeliveryFailed} {
+		metrics.ReplayOutboxDeliveries.With(prometheus.Labels{"status": status}).Set(float64(counts[status]))
+	}
 }
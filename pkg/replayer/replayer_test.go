@@ -0,0 +1,264 @@
+package replayer
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/metrics"
+	"github.com/piraces/rsslay/pkg/storage"
+	"github.com/piraces/rsslay/pkg/storage/storagetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	sampleRelay   = "wss://relay.example.com"
+	failingRelay  = "wss://relay.example.org"
+	blockingRelay = "wss://relay.example.net"
+)
+
+func storedEvents(t *testing.T, store storage.Storage, count int) []EventWithPrivateKey {
+	privateKey := feed.PrivateKeyFromFeed("https://example.com/feed", "test")
+	publicKey, _ := nostr.GetPublicKey(privateKey)
+	_, err := store.InsertFeed(feed.Entity{PublicKey: publicKey, PrivateKey: privateKey, URL: "https://example.com/feed"})
+	assert.NoError(t, err)
+
+	var events []EventWithPrivateKey
+	for i := 0; i < count; i++ {
+		evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(1000 + i), Tags: nostr.Tags{}, Content: "note"}
+		assert.NoError(t, evt.Sign(privateKey))
+		_, err := store.SaveEvent(&evt)
+		assert.NoError(t, err)
+		events = append(events, EventWithPrivateKey{Event: &evt, PrivateKey: privateKey})
+	}
+	return events
+}
+
+// recordingPublisher fails every delivery to failingRelay, and every one to
+// blockingRelay is refused.
+type recordingPublisher struct {
+	mutex     sync.Mutex
+	published map[string]int
+}
+
+func (p *recordingPublisher) publish(_ context.Context, url string, _ string, evt nostr.Event) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.published[url+" "+evt.ID]++
+	switch url {
+	case failingRelay:
+		return errors.New("connection refused")
+	case blockingRelay:
+		return errors.New("msg: blocked: not on the whitelist")
+	}
+	return nil
+}
+
+func TestOutboxDeliversEveryEventToEveryRelay(t *testing.T) {
+	store := storagetest.Open(t)
+	publisher := &recordingPublisher{published: map[string]int{}}
+	outbox := &Outbox{Store: store, Relays: []string{sampleRelay}, Workers: 3, QueueSize: 10, BatchSize: 2, Timeout: time.Second,
+		Publish: publisher.publish}
+	t.Cleanup(outbox.Close)
+
+	events := storedEvents(t, store, 5)
+	outbox.Enqueue(events)
+	outbox.Enqueue(events)
+	outbox.Wait()
+
+	for _, evt := range events {
+		assert.Equal(t, 1, publisher.published[sampleRelay+" "+evt.Event.ID])
+	}
+	assert.Equal(t, 0, outbox.Drain())
+	counts, err := store.CountDeliveries()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{storage.DeliverySent: 5}, counts)
+}
+
+func TestOutboxRetriesFailedDeliveriesUntilMaxAttempts(t *testing.T) {
+	store := storagetest.Open(t)
+	publisher := &recordingPublisher{published: map[string]int{}}
+	outbox := &Outbox{Store: store, Relays: []string{sampleRelay, failingRelay}, Workers: 2, QueueSize: 10, BatchSize: 10, Timeout: time.Second,
+		MaxAttempts: 3, Publish: publisher.publish}
+	t.Cleanup(outbox.Close)
+
+	events := storedEvents(t, store, 1)
+	outbox.Enqueue(events)
+	outbox.Wait()
+
+	// even without backoff, the retry waits for a later pass
+	assert.Equal(t, 0, outbox.Drain())
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, store.ReleaseDelivery(events[0].Event.ID, failingRelay, time.Now().Unix()))
+		assert.Equal(t, 1, outbox.Drain())
+		outbox.Wait()
+	}
+	assert.NoError(t, store.ReleaseDelivery(events[0].Event.ID, failingRelay, time.Now().Unix()))
+	assert.Equal(t, 0, outbox.Drain())
+	assert.Equal(t, 1, publisher.published[sampleRelay+" "+events[0].Event.ID])
+	assert.Equal(t, 3, publisher.published[failingRelay+" "+events[0].Event.ID])
+	counts, err := store.CountDeliveries()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{storage.DeliverySent: 1, storage.DeliveryFailed: 1}, counts)
+}
+
+func TestOutboxBacksOffExponentially(t *testing.T) {
+	outbox := &Outbox{MinBackoff: time.Minute, MaxBackoff: time.Hour}
+
+	for attempts, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 10: time.Hour} {
+		backoff := outbox.backoff(attempts)
+		assert.GreaterOrEqual(t, backoff, expected)
+		assert.LessOrEqual(t, backoff, expected+expected/10)
+	}
+
+	outbox = &Outbox{}
+	assert.GreaterOrEqual(t, outbox.backoff(1), minBackoff)
+	assert.LessOrEqual(t, outbox.backoff(1), minBackoff+minBackoff/10)
+}
+
+func TestOutboxPausesRelaysRefusingEvents(t *testing.T) {
+	store := storagetest.Open(t)
+	publisher := &recordingPublisher{published: map[string]int{}}
+	outbox := &Outbox{Store: store, Relays: []string{sampleRelay, blockingRelay}, Workers: 1, QueueSize: 10, BatchSize: 10, Timeout: time.Second,
+		MaxAttempts: 3, PauseAfter: 2, PauseDuration: time.Hour, Publish: publisher.publish}
+	t.Cleanup(outbox.Close)
+
+	events := storedEvents(t, store, 3)
+	outbox.Enqueue(events[:2])
+	outbox.Wait()
+	records, err := store.ListDeliveries(storage.DeliveryFilter{Relay: blockingRelay}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, storage.DeliveryFailed, record.Status)
+		assert.Equal(t, OutcomeBlocked, record.Outcome)
+		assert.Equal(t, "blocked: not on the whitelist", record.Message)
+	}
+
+	states := outbox.RelayStates()
+	assert.Len(t, states, 2)
+	assert.Equal(t, RelayState{Relay: sampleRelay, LastOutcome: OutcomeAccepted}, states[0])
+	assert.Equal(t, blockingRelay, states[1].Relay)
+	assert.True(t, states[1].Paused)
+	assert.Equal(t, 2, states[1].Rejections)
+	assert.Equal(t, OutcomeBlocked, states[1].LastOutcome)
+
+	outbox.Enqueue(events[2:])
+	outbox.Wait()
+	assert.Equal(t, 1, publisher.published[sampleRelay+" "+events[2].Event.ID])
+	assert.Equal(t, 0, outbox.Drain())
+	assert.Zero(t, publisher.published[blockingRelay+" "+events[2].Event.ID])
+
+	assert.True(t, outbox.Resume(blockingRelay))
+	assert.False(t, outbox.Resume(blockingRelay))
+	assert.Equal(t, 1, outbox.Drain())
+	outbox.Wait()
+	assert.Equal(t, 1, publisher.published[blockingRelay+" "+events[2].Event.ID])
+}
+
+func TestOutboxResumesPausedRelaysOnProbation(t *testing.T) {
+	outbox := &Outbox{PauseAfter: 3, PauseDuration: time.Minute}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		outbox.recordOutcome(blockingRelay, OutcomeRateLimited, "rate-limited: slow down", now)
+	}
+	outbox.recordOutcome(failingRelay, OutcomeUnreachable, "connection refused", now)
+	assert.Equal(t, []string{blockingRelay}, outbox.pausedRelays(now))
+	assert.Empty(t, outbox.pausedRelays(now.Add(time.Minute)))
+
+	outbox.recordOutcome(blockingRelay, OutcomeRateLimited, "rate-limited: slow down", now.Add(time.Minute))
+	assert.Equal(t, []string{blockingRelay}, outbox.pausedRelays(now.Add(time.Minute)))
+}
+
+func TestOutboxDeliversToTheRelaysOfEachFeed(t *testing.T) {
+	store := storagetest.Open(t)
+	publisher := &recordingPublisher{published: map[string]int{}}
+	outbox := &Outbox{Store: store, Relays: []string{sampleRelay}, Workers: 2, QueueSize: 10, BatchSize: 10, Timeout: time.Second,
+		Publish: publisher.publish}
+	t.Cleanup(outbox.Close)
+
+	events := storedEvents(t, store, 3)
+	events[1].Relays = []string{blockingRelay, failingRelay}
+	events[2].Relays = []string{}
+	outbox.Enqueue(events)
+	outbox.Wait()
+
+	assert.Equal(t, map[string]int{
+		sampleRelay + " " + events[0].Event.ID:   1,
+		blockingRelay + " " + events[1].Event.ID: 1,
+		failingRelay + " " + events[1].Event.ID:  1,
+	}, publisher.published)
+}
+
+// slowRelay holds every event sent to it until released, telling when each
+// one starts being sent.
+type slowRelay struct {
+	recordingPublisher
+	started chan string
+	release chan struct{}
+}
+
+func newSlowRelay() *slowRelay {
+	return &slowRelay{recordingPublisher: recordingPublisher{published: map[string]int{}}, started: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (r *slowRelay) publish(ctx context.Context, url string, privateKey string, evt nostr.Event) error {
+	r.started <- evt.ID
+	<-r.release
+	return r.recordingPublisher.publish(ctx, url, privateKey, evt)
+}
+
+func TestOutboxLeavesDeliveriesForTheNextPassWhenTheQueueIsFull(t *testing.T) {
+	for _, policy := range []string{PolicyBlock, PolicyDropOldest} {
+		t.Run(policy, func(t *testing.T) {
+			store := storagetest.Open(t)
+			relay := newSlowRelay()
+			outbox := &Outbox{Store: store, Relays: []string{sampleRelay}, Workers: 1, QueueSize: 2, QueuePolicy: policy,
+				BatchSize: 10, Timeout: time.Minute, Publish: relay.publish}
+			t.Cleanup(outbox.Close)
+
+			events := storedEvents(t, store, 5)
+			outbox.Enqueue(events[:1])
+			<-relay.started
+
+			dropped := testutil.ToFloat64(metrics.ReplayJobsDropped)
+			enqueued := make(chan struct{})
+			go func() {
+				outbox.Enqueue(events[1:])
+				close(enqueued)
+			}()
+			select {
+			case <-enqueued:
+			case <-time.After(time.Second):
+				t.Fatal("queueing to a full queue was expected not to wait for room")
+			}
+			assert.Zero(t, testutil.ToFloat64(metrics.ReplayJobsDropped)-dropped)
+
+			// the deliveries that didn't fit are given back while the queued ones stay claimed
+			now := time.Now().Unix()
+			for i, evt := range events[1:] {
+				records, err := store.ListDeliveries(storage.DeliveryFilter{EventID: evt.Event.ID}, 1)
+				assert.NoError(t, err)
+				assert.Equal(t, i >= 2, records[0].NextAttemptAt <= now, "event %d", i+1)
+			}
+
+			close(relay.release)
+			outbox.Wait()
+			assert.Equal(t, 3, len(relay.published))
+
+			assert.Equal(t, 2, outbox.Drain())
+			outbox.Wait()
+			for _, evt := range events {
+				assert.Equal(t, 1, relay.published[sampleRelay+" "+evt.Event.ID])
+			}
+			counts, err := store.CountDeliveries()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]int{storage.DeliverySent: 5}, counts)
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package storage
+
+func (s *sqlStorage) UseAuthEvent(id string, now int64, expiresAt int64) (bool, error) {
+	if _, err := s.db.Exec(`DELETE FROM auth_events WHERE expires_at < $1`, now); err != nil {
+		return false, err
+	}
+
+	result, err := s.db.Exec(`INSERT INTO auth_events (id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`, id, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"sort"
+	"strings"
+)
+
+func (s *sqlStorage) SaveEvent(evt *nostr.Event) (bool, error) {
+	tags, err := json.Marshal(evt.Tags)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if isReplaceable(evt.Kind) {
+		var content, storedTags string
+		row := tx.QueryRow(`SELECT content, tags FROM events WHERE pubkey = $1 AND kind = $2`, evt.PubKey, evt.Kind)
+		err := row.Scan(&content, &storedTags)
+		if err == nil && content == evt.Content && storedTags == string(tags) {
+			return false, nil
+		} else if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+
+		if err := deleteEvents(tx, `SELECT id FROM events WHERE pubkey = $1 AND kind = $2`, evt.PubKey, evt.Kind); err != nil {
+			return false, err
+		}
+	}
+
+	if isParameterizedReplaceable(evt.Kind) {
+		newer, err := replaceOlderVersion(tx, evt)
+		if err != nil || !newer {
+			return false, err
+		}
+	}
+
+	result, err := tx.Exec(`INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO NOTHING`,
+		evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, string(tags), evt.Content, evt.Sig)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO event_tags (event_id, name, value) VALUES ($1, $2, $3)`, evt.ID, tag[0], tag[1]); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *sqlStorage) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	if len(filter.Authors) <= maxQueryParams {
+		return s.queryEvents(filter)
+	}
+
+	// query the authors a chunk at a time, each chunk up to the limit, and
+	// keep the newest of them all
+	chunk := *filter
+	seen := map[string]bool{}
+	var events []nostr.Event
+	for start := 0; start < len(filter.Authors); start += maxQueryParams {
+		chunk.Authors = filter.Authors[start:min(start+maxQueryParams, len(filter.Authors))]
+		page, err := s.queryEvents(&chunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, evt := range page {
+			if !seen[evt.ID] {
+				seen[evt.ID] = true
+				events = append(events, evt)
+			}
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].CreatedAt != events[j].CreatedAt {
+			return events[i].CreatedAt > events[j].CreatedAt
+		}
+		return events[i].ID < events[j].ID
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (s *sqlStorage) queryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	var conditions []string
+	var params []any
+
+	if filter.IDs != nil {
+		if len(filter.IDs) == 0 {
+			return nil, nil
+		}
+		conditions = append(conditions, "id IN ("+placeholders(len(params), len(filter.IDs))+")")
+		for _, id := range filter.IDs {
+			params = append(params, strings.TrimSpace(id))
+		}
+	}
+
+	if filter.Authors != nil {
+		if len(filter.Authors) == 0 {
+			return nil, nil
+		}
+		conditions = append(conditions, "pubkey IN ("+placeholders(len(params), len(filter.Authors))+")")
+		for _, author := range filter.Authors {
+			params = append(params, strings.TrimSpace(author))
+		}
+	}
+
+	if filter.Kinds != nil {
+		if len(filter.Kinds) == 0 {
+			return nil, nil
+		}
+		conditions = append(conditions, "kind IN ("+placeholders(len(params), len(filter.Kinds))+")")
+		for _, kind := range filter.Kinds {
+			params = append(params, kind)
+		}
+	}
+
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		params = append(params, name)
+		conditions = append(conditions, fmt.Sprintf("id IN (SELECT event_id FROM event_tags WHERE name = $%d AND value IN (%s))", len(params), placeholders(len(params), len(values))))
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+
+	if filter.Since != nil {
+		params = append(params, *filter.Since)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(params)))
+	}
+
+	if filter.Until != nil {
+		params = append(params, *filter.Until)
+		conditions = append(conditions, fmt.Sprintf("created_at <= $%d", len(params)))
+	}
+
+	query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id"
+	if filter.Limit > 0 {
+		params = append(params, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(params))
+	}
+
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []nostr.Event
+	for rows.Next() {
+		var evt nostr.Event
+		var tags string
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &evt.CreatedAt, &evt.Kind, &tags, &evt.Content, &evt.Sig); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &evt.Tags); err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+
+	return events, rows.Err()
+}
+
+// placeholders returns a comma separated list of count positional
+// parameters, numbered after the offset ones already in use.
+func placeholders(offset int, count int) string {
+	list := make([]string, count)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", offset+i+1)
+	}
+	return strings.Join(list, ", ")
+}
+
+// isReplaceable tells the kinds of which only the latest event of each author
+// is kept, such as profiles and relay lists.
+func isReplaceable(kind int) bool {
+	return kind == nostr.KindSetMetadata || kind == nostr.KindContactList || (kind >= 10000 && kind < 20000)
+}
+
+func isParameterizedReplaceable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// replaceOlderVersion deletes the stored event with the same kind, author and
+// "d" tag of a parameterized replaceable event, unless the stored one is the
+// same event or a newer one, in which case it returns false.
+func replaceOlderVersion(tx *sql.Tx, evt *nostr.Event) (bool, error) {
+	identifier := ""
+	if tag := evt.Tags.GetFirst([]string{"d", ""}); tag != nil {
+		identifier = tag.Value()
+	}
+
+	const selectVersionsSQL = `SELECT id FROM events WHERE pubkey = $1 AND kind = $2
+		AND id IN (SELECT event_id FROM event_tags WHERE name = 'd' AND value = $3)`
+
+	var newest nostr.Timestamp
+	row := tx.QueryRow(`SELECT COALESCE(MAX(created_at), 0) FROM events WHERE id IN (`+selectVersionsSQL+`)`, evt.PubKey, evt.Kind, identifier)
+	if err := row.Scan(&newest); err != nil {
+		return false, err
+	}
+	if newest >= evt.CreatedAt {
+		return false, nil
+	}
+
+	return true, deleteEvents(tx, selectVersionsSQL, evt.PubKey, evt.Kind, identifier)
+}
+
+// deleteEvents deletes the events, along with their tags and queued
+// deliveries, whose ids are selected by the given query.
+func deleteEvents(tx *sql.Tx, selectIDs string, params ...any) error {
+	ids, err := queryIDs(tx, selectIDs, params...)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM event_tags WHERE event_id IN (`+placeholders(0, len(ids))+`)`, ids...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE event_id IN (`+placeholders(0, len(ids))+`)`, ids...); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM events WHERE id IN (`+placeholders(0, len(ids))+`)`, ids...)
+	return err
+}
+
+func queryIDs(tx *sql.Tx, query string, params ...any) ([]any, error) {
+	rows, err := tx.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/piraces/rsslay/pkg/feed"
+	"sort"
+	"strings"
+)
+
+// maxQueryParams keeps lists of public keys within the bound parameters
+// limit of SQLite builds older than 3.32.
+const maxQueryParams = 500
+
+const selectScheduledFeedsSQL = `SELECT publickey, privatekey, url, nitter, hashtags_in_content, max_hashtags, relays,
+	COALESCE(site_image, ''), site_image_checked_at, COALESCE(etag, ''), COALESCE(last_modified, ''), COALESCE(content_hash, '') FROM feeds`
+
+func (s *sqlStorage) CountFeeds() (uint64, error) {
+	var count uint64
+	err := s.db.QueryRow(`SELECT count(*) FROM feeds`).Scan(&count)
+	return count, err
+}
+
+func (s *sqlStorage) RandomFeeds(limit int) ([]feed.Entity, error) {
+	return s.queryFeeds(`SELECT publickey, url FROM feeds ORDER BY RANDOM() LIMIT $1`, limit)
+}
+
+func (s *sqlStorage) SearchFeeds(query string, limit int) ([]feed.Entity, error) {
+	return s.queryFeeds(`SELECT publickey, url FROM feeds WHERE lower(url) LIKE lower($1) LIMIT $2`, "%"+query+"%", limit)
+}
+
+func (s *sqlStorage) ListFeeds(cursor string, limit int) ([]feed.Entity, error) {
+	return s.queryFeeds(`SELECT publickey, url FROM feeds WHERE publickey > $1 ORDER BY publickey LIMIT $2`, cursor, limit)
+}
+
+func (s *sqlStorage) FeedsOf(pubKeys []string) ([]feed.Entity, error) {
+	var feeds []feed.Entity
+	for start := 0; start < len(pubKeys); start += maxQueryParams {
+		end := min(start+maxQueryParams, len(pubKeys))
+		params := make([]any, end-start)
+		for i, pubKey := range pubKeys[start:end] {
+			params[i] = strings.TrimSpace(pubKey)
+		}
+
+		page, err := s.queryFeeds(`SELECT publickey, url FROM feeds WHERE publickey IN (`+placeholders(0, len(params))+`)`, params...)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, page...)
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].URL < feeds[j].URL
+	})
+	return feeds, nil
+}
+
+func (s *sqlStorage) GetFeed(pubKey string) (feed.Entity, error) {
+	entity := feed.Entity{PublicKey: strings.TrimSpace(pubKey)}
+	var hashtags hashtagColumns
+	var relays sql.NullString
+	row := s.db.QueryRow(`SELECT privatekey, url, nitter, hashtags_in_content, max_hashtags, relays, COALESCE(site_image, ''), site_image_checked_at
+		FROM feeds WHERE publickey=$1`, entity.PublicKey)
+	err := row.Scan(&entity.PrivateKey, &entity.URL, &entity.Nitter, &hashtags.inContent, &hashtags.max, &relays, &entity.SiteImage, &entity.SiteImageCheckedAt)
+	if err == sql.ErrNoRows {
+		return entity, ErrFeedNotFound
+	}
+	if err != nil {
+		return entity, err
+	}
+	entity.Hashtags = hashtags.overrides()
+	entity.Relays, err = relayOverrides(relays)
+	return entity, err
+}
+
+func (s *sqlStorage) FindFeedByURL(text string) (feed.Entity, error) {
+	var entity feed.Entity
+	row := s.db.QueryRow(`SELECT publickey, privatekey, url, nitter FROM feeds WHERE lower(url) LIKE lower($1) LIMIT 1`, "%"+text+"%")
+	err := row.Scan(&entity.PublicKey, &entity.PrivateKey, &entity.URL, &entity.Nitter)
+	if err == sql.ErrNoRows {
+		return entity, ErrFeedNotFound
+	}
+	return entity, err
+}
+
+func (s *sqlStorage) InsertFeed(entity feed.Entity) (bool, error) {
+	result, err := s.db.Exec(`INSERT INTO feeds (publickey, privatekey, url, nitter) VALUES ($1, $2, $3, $4) ON CONFLICT (publickey) DO NOTHING`,
+		entity.PublicKey, entity.PrivateKey, entity.URL, boolToInt(entity.Nitter))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlStorage) SetFeedNitter(pubKey string, nitter bool) error {
+	_, err := s.db.Exec(`UPDATE feeds SET nitter = $1 WHERE publickey = $2`, boolToInt(nitter), pubKey)
+	return err
+}
+
+func (s *sqlStorage) SetFeedHashtags(pubKey string, overrides feed.HashtagOverrides) error {
+	var inContent, max any
+	if overrides.InContent != nil {
+		inContent = boolToInt(*overrides.InContent)
+	}
+	if overrides.Max != nil {
+		max = *overrides.Max
+	}
+
+	result, err := s.db.Exec(`UPDATE feeds SET hashtags_in_content = $1, max_hashtags = $2 WHERE publickey = $3`, inContent, max, strings.TrimSpace(pubKey))
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return ErrFeedNotFound
+	}
+	return err
+}
+
+func (s *sqlStorage) DeleteFeed(url string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteEvents(tx, `SELECT id FROM events WHERE pubkey IN (SELECT publickey FROM feeds WHERE url=$1)`, url); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM feeds WHERE url=$1`, url); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStorage) DueFeeds(now int64, limit int, leaseUntil int64) ([]ScheduledFeed, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	feeds, err := queryScheduledFeeds(tx, selectScheduledFeedsSQL+` WHERE next_fetch_at <= $1 AND disabled = 0 ORDER BY next_fetch_at LIMIT $2`+s.skipLocked("feeds"), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(feeds); start += maxQueryParams {
+		end := min(start+maxQueryParams, len(feeds))
+		params := []any{leaseUntil}
+		for _, scheduled := range feeds[start:end] {
+			params = append(params, scheduled.Entity.PublicKey)
+		}
+		if _, err := tx.Exec(`UPDATE feeds SET next_fetch_at = $1 WHERE publickey IN (`+placeholders(1, end-start)+`)`, params...); err != nil {
+			return nil, err
+		}
+	}
+
+	return feeds, tx.Commit()
+}
+
+func (s *sqlStorage) PendingFeeds(pubKeys []string) ([]ScheduledFeed, error) {
+	if len(pubKeys) == 0 {
+		return nil, nil
+	}
+
+	var feeds []ScheduledFeed
+	for start := 0; start < len(pubKeys); start += maxQueryParams {
+		end := min(start+maxQueryParams, len(pubKeys))
+		params := make([]any, end-start)
+		for i, pubKey := range pubKeys[start:end] {
+			params[i] = strings.TrimSpace(pubKey)
+		}
+
+		page, err := queryScheduledFeeds(s.db, selectScheduledFeedsSQL+` WHERE next_fetch_at = 0 AND disabled = 0 AND publickey IN (`+placeholders(0, len(params))+`)`, params...)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, page...)
+	}
+
+	return feeds, nil
+}
+
+func (s *sqlStorage) ScheduleFeed(pubKey string, nextFetchAt int64, validators feed.Validators) error {
+	_, err := s.db.Exec(`UPDATE feeds SET next_fetch_at = $1, etag = $2, last_modified = $3, content_hash = $4 WHERE publickey = $5`,
+		nextFetchAt, validators.ETag, validators.LastModified, validators.ContentHash, pubKey)
+	return err
+}
+
+func (s *sqlStorage) queryFeeds(query string, params ...any) ([]feed.Entity, error) {
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []feed.Entity
+	for rows.Next() {
+		var entity feed.Entity
+		if err := rows.Scan(&entity.PublicKey, &entity.URL); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, entity)
+	}
+
+	return feeds, rows.Err()
+}
+
+func (s *sqlStorage) SetFeedRelays(pubKey string, relays []string) error {
+	var value any
+	if relays != nil {
+		encoded, err := json.Marshal(relays)
+		if err != nil {
+			return err
+		}
+		value = string(encoded)
+	}
+
+	result, err := s.db.Exec(`UPDATE feeds SET relays = $1 WHERE publickey = $2`, value, strings.TrimSpace(pubKey))
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return ErrFeedNotFound
+	}
+	return err
+}
+
+func (s *sqlStorage) SetFeedSiteImage(pubKey string, image string, checkedAt int64) error {
+	_, err := s.db.Exec(`UPDATE feeds SET site_image = $1, site_image_checked_at = $2 WHERE publickey = $3`, image, checkedAt, strings.TrimSpace(pubKey))
+	return err
+}
+
+// querier runs queries on the database or within a transaction.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryScheduledFeeds(db querier, query string, params ...any) ([]ScheduledFeed, error) {
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []ScheduledFeed
+	for rows.Next() {
+		var scheduled ScheduledFeed
+		var hashtags hashtagColumns
+		var relays sql.NullString
+		if err := rows.Scan(&scheduled.Entity.PublicKey, &scheduled.Entity.PrivateKey, &scheduled.Entity.URL, &scheduled.Entity.Nitter,
+			&hashtags.inContent, &hashtags.max, &relays, &scheduled.Entity.SiteImage, &scheduled.Entity.SiteImageCheckedAt, &scheduled.Validators.ETag, &scheduled.Validators.LastModified, &scheduled.Validators.ContentHash); err != nil {
+			return nil, err
+		}
+		scheduled.Entity.Hashtags = hashtags.overrides()
+		if scheduled.Entity.Relays, err = relayOverrides(relays); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, scheduled)
+	}
+
+	return feeds, rows.Err()
+}
+
+// hashtagColumns scans the nullable hashtag settings of a feed.
+type hashtagColumns struct {
+	inContent sql.NullBool
+	max       sql.NullInt64
+}
+
+func (c hashtagColumns) overrides() feed.HashtagOverrides {
+	var overrides feed.HashtagOverrides
+	if c.inContent.Valid {
+		overrides.InContent = &c.inContent.Bool
+	}
+	if c.max.Valid {
+		max := int(c.max.Int64)
+		overrides.Max = &max
+	}
+	return overrides
+}
+
+// relayOverrides decodes the relays a feed overrides, nil if it doesn't.
+func relayOverrides(column sql.NullString) ([]string, error) {
+	if !column.Valid {
+		return nil, nil
+	}
+	relays := []string{}
+	err := json.Unmarshal([]byte(column.String), &relays)
+	return relays, err
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
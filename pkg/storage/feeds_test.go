@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const sampleUrl = "https://example.com/rss"
+
+func sampleEntity() feed.Entity {
+	return feed.Entity{PublicKey: samplePubKey, PrivateKey: samplePrivateKey, URL: sampleUrl}
+}
+
+func TestInsertAndGetFeed(t *testing.T) {
+	store := openTestStorage(t)
+
+	_, err := store.GetFeed(samplePubKey)
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+
+	inserted, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	inserted, err = store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+
+	entity, err := store.GetFeed(" " + samplePubKey + " ")
+	assert.NoError(t, err)
+	assert.Equal(t, sampleEntity(), entity)
+
+	assert.NoError(t, store.SetFeedNitter(samplePubKey, true))
+	entity, err = store.GetFeed(samplePubKey)
+	assert.NoError(t, err)
+	assert.True(t, entity.Nitter)
+
+	assert.NoError(t, store.SetFeedSiteImage(samplePubKey, "https://example.com/banner.png", 1000))
+	entity, err = store.GetFeed(samplePubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/banner.png", entity.SiteImage)
+	assert.Equal(t, int64(1000), entity.SiteImageCheckedAt)
+
+	count, err := store.CountFeeds()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), count)
+}
+
+func TestSearchFeeds(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+
+	found, err := store.SearchFeeds("example.com", 50)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: samplePubKey, URL: sampleUrl}}, found)
+
+	found, err = store.SearchFeeds("EXAMPLE.com", 50)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: samplePubKey, URL: sampleUrl}}, found)
+
+	found, err = store.SearchFeeds("example.org", 50)
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	entity, err := store.FindFeedByURL("example")
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, entity.PublicKey)
+
+	_, err = store.FindFeedByURL("missing")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+
+	random, err := store.RandomFeeds(50)
+	assert.NoError(t, err)
+	assert.Len(t, random, 1)
+}
+
+func TestDeleteFeedRemovesItsEvents(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	evt := signedEvent(nostr.KindTextNote, 1000, "note")
+	_, err = store.SaveEvent(&evt)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.DeleteFeed(sampleUrl))
+
+	_, err = store.GetFeed(samplePubKey)
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+	stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{samplePubKey}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+
+	assert.NoError(t, store.DeleteFeed(sampleUrl))
+}
+
+func TestScheduledFeeds(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+
+	pending, err := store.PendingFeeds([]string{samplePubKey})
+	assert.NoError(t, err)
+	assert.Equal(t, []ScheduledFeed{{Entity: sampleEntity()}}, pending)
+
+	due, err := store.DueFeeds(100, 10, 150)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	// claimed until the end of its lease
+	due, err = store.DueFeeds(100, 10, 150)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = store.DueFeeds(150, 10, 160)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	validators := feed.Validators{ETag: `"v1"`, ContentHash: "hash"}
+	assert.NoError(t, store.ScheduleFeed(samplePubKey, 200, validators))
+
+	pending, err = store.PendingFeeds([]string{samplePubKey})
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	due, err = store.DueFeeds(100, 10, 300)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	due, err = store.DueFeeds(200, 10, 300)
+	assert.NoError(t, err)
+	assert.Equal(t, []ScheduledFeed{{Entity: sampleEntity(), Validators: validators}}, due)
+}
+
+func TestPendingFeedsWithMoreKeysThanQueryParameters(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+
+	pubKeys := make([]string, maxQueryParams)
+	for i := range pubKeys {
+		pubKeys[i] = fmt.Sprintf("%064x", i)
+	}
+	pending, err := store.PendingFeeds(append(pubKeys, samplePubKey))
+	assert.NoError(t, err)
+	assert.Equal(t, []ScheduledFeed{{Entity: sampleEntity()}}, pending)
+}
+
+func TestListFeedsPaginatesByPublicKey(t *testing.T) {
+	store := openTestStorage(t)
+	for _, pubKey := range []string{"cc", "aa", "bb"} {
+		_, err := store.InsertFeed(feed.Entity{PublicKey: pubKey, PrivateKey: pubKey, URL: "https://" + pubKey + ".example.com/rss"})
+		assert.NoError(t, err)
+	}
+
+	page, err := store.ListFeeds("", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: "aa", URL: "https://aa.example.com/rss"}, {PublicKey: "bb", URL: "https://bb.example.com/rss"}}, page)
+
+	page, err = store.ListFeeds("bb", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: "cc", URL: "https://cc.example.com/rss"}}, page)
+}
+
+func TestFeedsOfReturnsOnlyRegisteredPublicKeys(t *testing.T) {
+	store := openTestStorage(t)
+	for _, pubKey := range []string{"cc", "aa", "bb"} {
+		_, err := store.InsertFeed(feed.Entity{PublicKey: pubKey, PrivateKey: pubKey, URL: "https://" + pubKey + ".example.com/rss"})
+		assert.NoError(t, err)
+	}
+
+	feeds, err := store.FeedsOf([]string{"cc", "dd", "aa"})
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: "aa", URL: "https://aa.example.com/rss"}, {PublicKey: "cc", URL: "https://cc.example.com/rss"}}, feeds)
+
+	feeds, err = store.FeedsOf(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, feeds)
+}
+
+func TestSetFeedHashtagsOverridesInstanceSettings(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+
+	entity, err := store.GetFeed(samplePubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HashtagOverrides{}, entity.Hashtags)
+
+	inContent, max := true, 3
+	assert.NoError(t, store.SetFeedHashtags(samplePubKey, feed.HashtagOverrides{InContent: &inContent, Max: &max}))
+	entity, err = store.GetFeed(samplePubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HashtagOverrides{InContent: &inContent, Max: &max}, entity.Hashtags)
+	due, err := store.DueFeeds(0, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.Hashtags, due[0].Entity.Hashtags)
+
+	assert.NoError(t, store.SetFeedHashtags(samplePubKey, feed.HashtagOverrides{Max: &max}))
+	status, err := store.GetFeedStatus(samplePubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HashtagOverrides{Max: &max}, status.Entity.Hashtags)
+
+	assert.ErrorIs(t, store.SetFeedHashtags("missing", feed.HashtagOverrides{}), ErrFeedNotFound)
+}
+
+func TestPurgeFeeds(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	_, err = store.InsertFeed(feed.Entity{PublicKey: "aa", PrivateKey: "aa", URL: "https://spam.example.org/rss"})
+	assert.NoError(t, err)
+	isSpam := func(entity feed.Entity) bool { return entity.URL == "https://spam.example.org/rss" }
+
+	purged, err := PurgeFeeds(store, isSpam, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: "aa", URL: "https://spam.example.org/rss"}}, purged)
+	count, _ := store.CountFeeds()
+	assert.Equal(t, uint64(2), count)
+
+	purged, err = PurgeFeeds(store, isSpam, false)
+	assert.NoError(t, err)
+	assert.Len(t, purged, 1)
+	_, err = store.GetFeed("aa")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+	_, err = store.GetFeed(samplePubKey)
+	assert.NoError(t, err)
+}
+
+func TestFeedStatuses(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	evt := signedEvent(nostr.KindTextNote, 1000, "note")
+	_, err = store.SaveEvent(&evt)
+	assert.NoError(t, err)
+
+	status, err := store.GetFeedStatus(samplePubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, FeedStatus{Entity: feed.Entity{PublicKey: samplePubKey, URL: sampleUrl}, EventCount: 1}, status)
+
+	assert.NoError(t, store.RecordFetch(samplePubKey, 1000, errors.New("timeout")))
+	assert.NoError(t, store.RecordFetch(samplePubKey, 2000, errors.New("not found")))
+	failing, err := store.FailingFeeds(10)
+	assert.NoError(t, err)
+	assert.Len(t, failing, 1)
+	assert.Equal(t, int64(2000), failing[0].LastFetchAt)
+	assert.Equal(t, "not found", failing[0].LastError)
+	assert.Equal(t, 2, failing[0].ErrorCount)
+
+	assert.NoError(t, store.SetFeedDisabled(samplePubKey, true))
+	assert.ErrorIs(t, store.SetFeedDisabled("missing", true), ErrFeedNotFound)
+	stats, err := store.FeedStats()
+	assert.NoError(t, err)
+	assert.Equal(t, FeedStats{Total: 1, Disabled: 1, Failing: 1}, stats)
+	due, err := store.DueFeeds(3000, 10, 4000)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	assert.NoError(t, store.RecordFetch(samplePubKey, 3000, nil))
+	statuses, err := store.ListFeedStatuses("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Disabled)
+	assert.Empty(t, statuses[0].LastError)
+	assert.Zero(t, statuses[0].ErrorCount)
+
+	_, err = store.GetFeedStatus("missing")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+}
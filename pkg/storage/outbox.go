@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+)
+
+// Statuses of the deliveries queued in the outbox.
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	// DeliveryFailed deliveries ran out of attempts and are not retried.
+	DeliveryFailed = "failed"
+)
+
+// Delivery is an event queued in the outbox to be sent to a relay, along with
+// the private key of its feed to authenticate with the relay.
+type Delivery struct {
+	Event      nostr.Event
+	Relay      string
+	PrivateKey string
+	// Attempts is the number of previous failed attempts.
+	Attempts int
+}
+
+// DeliveryAttempt is the outcome of sending a queued event to a relay.
+type DeliveryAttempt struct {
+	EventID     string
+	Relay       string
+	AttemptedAt int64
+	Status      string
+	// Outcome tells how the relay answered, as classified by the replayer.
+	Outcome string
+	// Error is the message of the relay, or why it couldn't be reached.
+	Error string
+	// NextAttemptAt is when to try again deliveries still pending.
+	NextAttemptAt int64
+}
+
+// DeliveryRecord is the state of an event queued for a relay, along with the
+// outcome of its last attempt, if any.
+type DeliveryRecord struct {
+	EventID       string
+	Relay         string
+	Status        string
+	Outcome       string
+	Message       string
+	Attempts      int
+	NextAttemptAt int64
+	UpdatedAt     int64
+}
+
+// DeliveryFilter selects deliveries by any of its non-empty fields.
+type DeliveryFilter struct {
+	EventID string
+	Relay   string
+	Status  string
+	Outcome string
+}
+
+// RelayDeliveryStats counts the deliveries queued for a relay by status and
+// by the outcome of their last attempt.
+type RelayDeliveryStats struct {
+	Relay    string
+	Statuses map[string]int
+	Outcomes map[string]int
+}
+
+func (s *sqlStorage) EnqueueDeliveries(eventIDs []string, relays []string, now int64, leaseUntil int64) ([]DeliveryRecord, error) {
+	if len(eventIDs) == 0 || len(relays) == 0 {
+		return nil, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var queued []DeliveryRecord
+	for _, eventID := range eventIDs {
+		for _, relay := range relays {
+			result, err := tx.Exec(`INSERT INTO outbox (event_id, relay, status, next_attempt_at, updated_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (event_id, relay) DO NOTHING`,
+				eventID, relay, DeliveryPending, leaseUntil, now)
+			if err != nil {
+				return nil, err
+			}
+			if inserted, err := result.RowsAffected(); err != nil {
+				return nil, err
+			} else if inserted > 0 {
+				queued = append(queued, DeliveryRecord{EventID: eventID, Relay: relay, Status: DeliveryPending, NextAttemptAt: leaseUntil, UpdatedAt: now})
+			}
+		}
+	}
+
+	return queued, tx.Commit()
+}
+
+func (s *sqlStorage) DueDeliveries(now int64, limit int, skipRelays []string, leaseUntil int64) ([]Delivery, error) {
+	args := []any{DeliveryPending, now}
+	skip := ""
+	if len(skipRelays) > 0 {
+		skip = "AND outbox.relay NOT IN (" + placeholders(len(args), len(skipRelays)) + ")"
+		for _, relay := range skipRelays {
+			args = append(args, relay)
+		}
+	}
+	args = append(args, limit)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deliveries, err := queryDeliveries(tx, fmt.Sprintf(`SELECT outbox.relay, outbox.attempts, feeds.privatekey, events.id, events.pubkey, events.created_at, events.kind, events.tags, events.content, events.sig
+		FROM outbox JOIN events ON events.id = outbox.event_id JOIN feeds ON feeds.publickey = events.pubkey
+		WHERE outbox.status = $1 AND outbox.next_attempt_at <= $2 %s ORDER BY outbox.next_attempt_at LIMIT $%d`, skip, len(args))+s.skipLocked("outbox"), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, delivery := range deliveries {
+		if _, err := tx.Exec(`UPDATE outbox SET next_attempt_at = $1 WHERE event_id = $2 AND relay = $3`, leaseUntil, delivery.Event.ID, delivery.Relay); err != nil {
+			return nil, err
+		}
+	}
+
+	return deliveries, tx.Commit()
+}
+
+func queryDeliveries(db querier, query string, args ...any) ([]Delivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var delivery Delivery
+		var tags string
+		if err := rows.Scan(&delivery.Relay, &delivery.Attempts, &delivery.PrivateKey, &delivery.Event.ID, &delivery.Event.PubKey,
+			&delivery.Event.CreatedAt, &delivery.Event.Kind, &tags, &delivery.Event.Content, &delivery.Event.Sig); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &delivery.Event.Tags); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (s *sqlStorage) ReleaseDelivery(eventID string, relay string, nextAttemptAt int64) error {
+	_, err := s.db.Exec(`UPDATE outbox SET next_attempt_at = $1 WHERE event_id = $2 AND relay = $3 AND status = $4`, nextAttemptAt, eventID, relay, DeliveryPending)
+	return err
+}
+
+func (s *sqlStorage) RecordDeliveryAttempt(attempt DeliveryAttempt) error {
+	var lastError any
+	if attempt.Error != "" {
+		lastError = attempt.Error
+	}
+
+	var outcome any
+	if attempt.Outcome != "" {
+		outcome = attempt.Outcome
+	}
+
+	_, err := s.db.Exec(`UPDATE outbox SET status = $1, attempts = attempts + 1, outcome = $2, last_error = $3, next_attempt_at = $4, updated_at = $5 WHERE event_id = $6 AND relay = $7`,
+		attempt.Status, outcome, lastError, attempt.NextAttemptAt, attempt.AttemptedAt, attempt.EventID, attempt.Relay)
+	return err
+}
+
+func (s *sqlStorage) ListDeliveries(filter DeliveryFilter, limit int) ([]DeliveryRecord, error) {
+	var conditions []string
+	var args []any
+	for _, condition := range []struct {
+		column string
+		value  string
+	}{{"event_id", filter.EventID}, {"relay", filter.Relay}, {"status", filter.Status}, {"outcome", filter.Outcome}} {
+		if condition.value != "" {
+			args = append(args, condition.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", condition.column, len(args)))
+		}
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT event_id, relay, status, outcome, last_error, attempts, next_attempt_at, updated_at
+		FROM outbox %s ORDER BY updated_at DESC, event_id, relay LIMIT $%d`, where, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []DeliveryRecord{}
+	for rows.Next() {
+		var record DeliveryRecord
+		var outcome, message sql.NullString
+		if err := rows.Scan(&record.EventID, &record.Relay, &record.Status, &outcome, &message, &record.Attempts,
+			&record.NextAttemptAt, &record.UpdatedAt); err != nil {
+			return nil, err
+		}
+		record.Outcome = outcome.String
+		record.Message = message.String
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (s *sqlStorage) RelayDeliveryStats() ([]RelayDeliveryStats, error) {
+	rows, err := s.db.Query(`SELECT relay, status, outcome, count(*) FROM outbox GROUP BY relay, status, outcome ORDER BY relay`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []RelayDeliveryStats
+	for rows.Next() {
+		var relay, status string
+		var outcome sql.NullString
+		var count int
+		if err := rows.Scan(&relay, &status, &outcome, &count); err != nil {
+			return nil, err
+		}
+		if len(stats) == 0 || stats[len(stats)-1].Relay != relay {
+			stats = append(stats, RelayDeliveryStats{Relay: relay, Statuses: map[string]int{}, Outcomes: map[string]int{}})
+		}
+		current := &stats[len(stats)-1]
+		current.Statuses[status] += count
+		if outcome.Valid {
+			current.Outcomes[outcome.String] += count
+		}
+	}
+
+	return stats, rows.Err()
+}
+
+func (s *sqlStorage) CountDeliveries() (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT status, count(*) FROM outbox GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *sqlStorage) PruneDeliveries(before int64) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM outbox WHERE status <> $1 AND updated_at < $2`, DeliveryPending, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const (
+	sampleRelay = "wss://relay.example.com"
+	otherRelay  = "wss://relay.example.org"
+)
+
+func TestOutboxQueuesEachEventOncePerRelay(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	evt := signedEvent(nostr.KindTextNote, 1000, "note")
+	_, err = store.SaveEvent(&evt)
+	assert.NoError(t, err)
+
+	queued, err := store.EnqueueDeliveries([]string{evt.ID}, []string{sampleRelay, otherRelay}, 100, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeliveryRecord{
+		{EventID: evt.ID, Relay: sampleRelay, Status: DeliveryPending, NextAttemptAt: 100, UpdatedAt: 100},
+		{EventID: evt.ID, Relay: otherRelay, Status: DeliveryPending, NextAttemptAt: 100, UpdatedAt: 100},
+	}, queued)
+	queued, err = store.EnqueueDeliveries([]string{evt.ID}, []string{sampleRelay}, 200, 200)
+	assert.NoError(t, err)
+	assert.Empty(t, queued)
+
+	due, err := store.DueDeliveries(99, 10, nil, 200)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = store.DueDeliveries(100, 10, nil, 200)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	assert.Equal(t, evt, due[0].Event)
+	assert.Equal(t, samplePrivateKey, due[0].PrivateKey)
+	assert.Zero(t, due[0].Attempts)
+
+	// claimed until the end of their lease, unless given back
+	due, err = store.DueDeliveries(100, 10, nil, 200)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	assert.NoError(t, store.ReleaseDelivery(evt.ID, otherRelay, 100))
+	due, err = store.DueDeliveries(100, 10, nil, 200)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+	assert.Equal(t, otherRelay, due[0].Relay)
+	due, err = store.DueDeliveries(200, 10, nil, 300)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+}
+
+func TestOutboxRecordsDeliveryAttempts(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	evt := signedEvent(nostr.KindTextNote, 1000, "note")
+	_, err = store.SaveEvent(&evt)
+	assert.NoError(t, err)
+	_, err = store.EnqueueDeliveries([]string{evt.ID}, []string{sampleRelay, otherRelay}, 100, 100)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.RecordDeliveryAttempt(DeliveryAttempt{EventID: evt.ID, Relay: sampleRelay, AttemptedAt: 100, Status: DeliverySent}))
+	assert.NoError(t, store.RecordDeliveryAttempt(DeliveryAttempt{EventID: evt.ID, Relay: otherRelay, AttemptedAt: 100, Status: DeliveryPending,
+		Error: "connection refused", NextAttemptAt: 160}))
+
+	due, err := store.DueDeliveries(150, 10, nil, 300)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = store.DueDeliveries(160, 10, nil, 300)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+	assert.Equal(t, otherRelay, due[0].Relay)
+	assert.Equal(t, 1, due[0].Attempts)
+
+	counts, err := store.CountDeliveries()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{DeliveryPending: 1, DeliverySent: 1}, counts)
+
+	pruned, err := store.PruneDeliveries(200)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+	counts, err = store.CountDeliveries()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{DeliveryPending: 1}, counts)
+
+	assert.NoError(t, store.DeleteFeed(sampleUrl))
+	counts, err = store.CountDeliveries()
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func TestOutboxReportsDeliveryOutcomesByRelay(t *testing.T) {
+	store := openTestStorage(t)
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	first := signedEvent(nostr.KindTextNote, 1000, "first")
+	second := signedEvent(nostr.KindTextNote, 1001, "second")
+	for _, evt := range []*nostr.Event{&first, &second} {
+		_, err = store.SaveEvent(evt)
+		assert.NoError(t, err)
+	}
+	_, err = store.EnqueueDeliveries([]string{first.ID, second.ID}, []string{sampleRelay, otherRelay}, 100, 100)
+	assert.NoError(t, err)
+
+	due, err := store.DueDeliveries(100, 10, []string{otherRelay}, 200)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	for _, delivery := range due {
+		assert.Equal(t, sampleRelay, delivery.Relay)
+	}
+
+	assert.NoError(t, store.RecordDeliveryAttempt(DeliveryAttempt{EventID: first.ID, Relay: sampleRelay, AttemptedAt: 110, Status: DeliverySent, Outcome: "accepted"}))
+	assert.NoError(t, store.RecordDeliveryAttempt(DeliveryAttempt{EventID: second.ID, Relay: sampleRelay, AttemptedAt: 120, Status: DeliveryFailed,
+		Outcome: "blocked", Error: "blocked: not on the whitelist"}))
+
+	records, err := store.ListDeliveries(DeliveryFilter{Relay: sampleRelay}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeliveryRecord{
+		{EventID: second.ID, Relay: sampleRelay, Status: DeliveryFailed, Outcome: "blocked", Message: "blocked: not on the whitelist", Attempts: 1, UpdatedAt: 120},
+		{EventID: first.ID, Relay: sampleRelay, Status: DeliverySent, Outcome: "accepted", Attempts: 1, UpdatedAt: 110},
+	}, records)
+	records, err = store.ListDeliveries(DeliveryFilter{EventID: first.ID, Status: DeliveryPending}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeliveryRecord{{EventID: first.ID, Relay: otherRelay, Status: DeliveryPending, NextAttemptAt: 100, UpdatedAt: 100}}, records)
+
+	stats, err := store.RelayDeliveryStats()
+	assert.NoError(t, err)
+	assert.Equal(t, []RelayDeliveryStats{
+		{Relay: sampleRelay, Statuses: map[string]int{DeliverySent: 1, DeliveryFailed: 1}, Outcomes: map[string]int{"accepted": 1, "blocked": 1}},
+		{Relay: otherRelay, Statuses: map[string]int{DeliveryPending: 2}, Outcomes: map[string]int{}},
+	}, stats)
+}
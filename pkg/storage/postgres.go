@@ -0,0 +1,12 @@
+package storage
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"github.com/piraces/rsslay/scripts"
+)
+
+// NewPostgres returns the storage backed by a PostgreSQL database.
+func NewPostgres(db *sql.DB) Storage {
+	return &sqlStorage{db: db, dialect: scripts.Postgres}
+}
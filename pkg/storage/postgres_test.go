@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+)
+
+// postgresDSN points to a throwaway PostgreSQL database for the tests of the
+// backend, which are skipped without it. Its public schema is wiped.
+var postgresDSN = os.Getenv("RSSLAY_TEST_POSTGRES_DSN")
+
+// openPostgresStorage empties the test database and returns count storages
+// connected to it, as instances sharing it would be.
+func openPostgresStorage(t *testing.T, count int) []Storage {
+	if postgresDSN == "" {
+		t.Skip("RSSLAY_TEST_POSTGRES_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", postgresDSN)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening the test database", err)
+	}
+	if _, err := db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`); err != nil {
+		t.Fatalf("an error '%s' was not expected when emptying the test database", err)
+	}
+	_ = db.Close()
+
+	stores := make([]Storage, count)
+	for i := range stores {
+		store, err := Open(postgresDSN)
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening the test database", err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		stores[i] = store
+	}
+	return stores
+}
+
+func migratePostgres(t *testing.T, count int) []Storage {
+	stores := openPostgresStorage(t, count)
+	if _, err := stores[0].Migrate(); err != nil {
+		t.Fatalf("an error '%s' was not expected when creating the test schema", err)
+	}
+	return stores
+}
+
+func TestPostgresMigratesOnceFromConcurrentInstances(t *testing.T) {
+	stores := openPostgresStorage(t, 4)
+
+	var wg sync.WaitGroup
+	applied := make([]int, len(stores))
+	for i, store := range stores {
+		i, store := i, store
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			migrations, err := store.Migrate()
+			assert.NoError(t, err)
+			applied[i] = len(migrations)
+		}()
+	}
+	wg.Wait()
+
+	statuses, err := stores[0].MigrationsStatus()
+	assert.NoError(t, err)
+	total := 0
+	for _, count := range applied {
+		total += count
+	}
+	assert.Equal(t, len(statuses), total)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+	}
+}
+
+func TestPostgresStoresAndQueriesEvents(t *testing.T) {
+	store := migratePostgres(t, 1)[0]
+	first := signedEvent(nostr.KindSetMetadata, 1000, `{"name":"first"}`)
+	second := signedEvent(nostr.KindSetMetadata, 2000, `{"name":"second"}`)
+	note := signedEvent(nostr.KindTextNote, 1500, "note")
+	for _, evt := range []*nostr.Event{&first, &second, &note} {
+		saved, err := store.SaveEvent(evt)
+		assert.NoError(t, err)
+		assert.True(t, saved)
+	}
+
+	stored, err := store.QueryEvents(&nostr.Filter{Authors: []string{samplePubKey}})
+	assert.NoError(t, err)
+	assert.Equal(t, []nostr.Event{second, note}, stored)
+	stored, err = store.QueryEvents(&nostr.Filter{Tags: nostr.TagMap{"proxy": []string{"https://example.com/rss"}}, Kinds: []int{nostr.KindTextNote}})
+	assert.NoError(t, err)
+	assert.Equal(t, []nostr.Event{note}, stored)
+}
+
+func TestPostgresSearchesFeedsIgnoringCase(t *testing.T) {
+	store := migratePostgres(t, 1)[0]
+	_, err := store.InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+
+	found, err := store.SearchFeeds("EXAMPLE.com", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []feed.Entity{{PublicKey: samplePubKey, URL: sampleUrl}}, found)
+	statuses, err := store.SearchFeedStatuses("Example", 10)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 1)
+	entity, err := store.FindFeedByURL("RSS")
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, entity.PublicKey)
+}
+
+func TestPostgresClaimsDueFeedsOnce(t *testing.T) {
+	stores := migratePostgres(t, 4)
+	for i := 0; i < 40; i++ {
+		_, err := stores[0].InsertFeed(feed.Entity{PublicKey: fmt.Sprintf("%064x", i), PrivateKey: "private", URL: fmt.Sprintf("https://example.com/%d", i)})
+		assert.NoError(t, err)
+	}
+
+	claimed := claimConcurrently(t, stores, func(store Storage) ([]string, error) {
+		due, err := store.DueFeeds(100, 5, 200)
+		var pubKeys []string
+		for _, scheduled := range due {
+			pubKeys = append(pubKeys, scheduled.Entity.PublicKey)
+		}
+		return pubKeys, err
+	})
+	assert.Len(t, claimed, 40)
+}
+
+func TestPostgresClaimsDueDeliveriesOnce(t *testing.T) {
+	stores := migratePostgres(t, 4)
+	_, err := stores[0].InsertFeed(sampleEntity())
+	assert.NoError(t, err)
+	var eventIDs []string
+	for i := 0; i < 20; i++ {
+		evt := signedEvent(nostr.KindTextNote, nostr.Timestamp(1000+i), "note")
+		_, err := stores[0].SaveEvent(&evt)
+		assert.NoError(t, err)
+		eventIDs = append(eventIDs, evt.ID)
+	}
+	_, err = stores[0].EnqueueDeliveries(eventIDs, []string{"wss://relay.example.com", "wss://relay.example.org"}, 100, 100)
+	assert.NoError(t, err)
+
+	claimed := claimConcurrently(t, stores, func(store Storage) ([]string, error) {
+		due, err := store.DueDeliveries(100, 5, nil, 200)
+		var keys []string
+		for _, delivery := range due {
+			keys = append(keys, delivery.Event.ID+" "+delivery.Relay)
+		}
+		return keys, err
+	})
+	assert.Len(t, claimed, 40)
+}
+
+// claimConcurrently claims from every store at once until none gets anything
+// left, failing if anything is claimed twice, and returns what was claimed.
+func claimConcurrently(t *testing.T, stores []Storage, claim func(store Storage) ([]string, error)) map[string]bool {
+	var mutex sync.Mutex
+	claimed := map[string]bool{}
+	var wg sync.WaitGroup
+	for _, store := range stores {
+		store := store
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				keys, err := claim(store)
+				if !assert.NoError(t, err) || len(keys) == 0 {
+					return
+				}
+				mutex.Lock()
+				for _, key := range keys {
+					assert.False(t, claimed[key], "%s claimed twice", key)
+					claimed[key] = true
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return claimed
+}
+
+func TestPostgresRefusesAuthEventsUsedByOtherInstances(t *testing.T) {
+	stores := migratePostgres(t, 2)
+
+	fresh, err := stores[0].UseAuthEvent("id", 100, 160)
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+	fresh, err = stores[1].UseAuthEvent("id", 100, 160)
+	assert.NoError(t, err)
+	assert.False(t, fresh)
+}
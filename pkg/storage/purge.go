@@ -0,0 +1,34 @@
+package storage
+
+import "github.com/piraces/rsslay/pkg/feed"
+
+const purgePageSize = 500
+
+// PurgeFeeds walks every registered feed and deletes, along with their events,
+// the ones matching, e.g. those refused by a newly added domain rule.
+// It returns the matching feeds, which are left untouched if dryRun is set.
+func PurgeFeeds(store Storage, match func(feed.Entity) bool, dryRun bool) ([]feed.Entity, error) {
+	var purged []feed.Entity
+	cursor := ""
+	for {
+		feeds, err := store.ListFeeds(cursor, purgePageSize)
+		if err != nil {
+			return purged, err
+		}
+		for _, entity := range feeds {
+			if !match(entity) {
+				continue
+			}
+			if !dryRun {
+				if err := store.DeleteFeed(entity.URL); err != nil {
+					return purged, err
+				}
+			}
+			purged = append(purged, entity)
+		}
+		if len(feeds) < purgePageSize {
+			return purged, nil
+		}
+		cursor = feeds[len(feeds)-1].PublicKey
+	}
+}
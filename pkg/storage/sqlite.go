@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/piraces/rsslay/scripts"
+)
+
+// NewSQLite returns the storage backed by a SQLite database.
+// SQLite allows a single writer at a time and fails transactions upgrading
+// their lock while another one writes, so the connections are limited to one
+// and concurrent callers wait for it instead of getting "database is locked".
+func NewSQLite(db *sql.DB) Storage {
+	db.SetMaxOpenConns(1)
+	return &sqlStorage{db: db, dialect: scripts.SQLite}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+const selectFeedStatusesSQL = `SELECT publickey, url, nitter, hashtags_in_content, max_hashtags, relays, disabled, next_fetch_at, last_fetch_at, COALESCE(last_error, ''), error_count,
+	(SELECT count(*) FROM events WHERE events.pubkey = feeds.publickey) FROM feeds`
+
+func (s *sqlStorage) GetFeedStatus(pubKey string) (FeedStatus, error) {
+	statuses, err := s.queryFeedStatuses(selectFeedStatusesSQL+` WHERE publickey = $1`, strings.TrimSpace(pubKey))
+	if err != nil {
+		return FeedStatus{}, err
+	}
+	if len(statuses) == 0 {
+		return FeedStatus{}, ErrFeedNotFound
+	}
+	return statuses[0], nil
+}
+
+func (s *sqlStorage) ListFeedStatuses(cursor string, limit int) ([]FeedStatus, error) {
+	return s.queryFeedStatuses(selectFeedStatusesSQL+` WHERE publickey > $1 ORDER BY publickey LIMIT $2`, cursor, limit)
+}
+
+func (s *sqlStorage) SearchFeedStatuses(query string, limit int) ([]FeedStatus, error) {
+	return s.queryFeedStatuses(selectFeedStatusesSQL+` WHERE lower(url) LIKE lower($1) ORDER BY publickey LIMIT $2`, "%"+query+"%", limit)
+}
+
+func (s *sqlStorage) FailingFeeds(limit int) ([]FeedStatus, error) {
+	return s.queryFeedStatuses(selectFeedStatusesSQL+` WHERE error_count > 0 ORDER BY error_count DESC, publickey LIMIT $1`, limit)
+}
+
+func (s *sqlStorage) FeedStats() (FeedStats, error) {
+	var stats FeedStats
+	err := s.db.QueryRow(`SELECT count(*),
+		COALESCE(SUM(CASE WHEN disabled <> 0 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN error_count > 0 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN last_fetch_at = 0 THEN 1 ELSE 0 END), 0)
+		FROM feeds`).Scan(&stats.Total, &stats.Disabled, &stats.Failing, &stats.NeverFetched)
+	return stats, err
+}
+
+func (s *sqlStorage) SetFeedDisabled(pubKey string, disabled bool) error {
+	result, err := s.db.Exec(`UPDATE feeds SET disabled = $1 WHERE publickey = $2`, boolToInt(disabled), strings.TrimSpace(pubKey))
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return ErrFeedNotFound
+	}
+	return err
+}
+
+func (s *sqlStorage) RecordFetch(pubKey string, fetchedAt int64, fetchErr error) error {
+	if fetchErr == nil {
+		_, err := s.db.Exec(`UPDATE feeds SET last_fetch_at = $1, last_error = NULL, error_count = 0 WHERE publickey = $2`, fetchedAt, pubKey)
+		return err
+	}
+
+	_, err := s.db.Exec(`UPDATE feeds SET last_fetch_at = $1, last_error = $2, error_count = error_count + 1 WHERE publickey = $3`,
+		fetchedAt, fetchErr.Error(), pubKey)
+	return err
+}
+
+func (s *sqlStorage) queryFeedStatuses(query string, params ...any) ([]FeedStatus, error) {
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []FeedStatus
+	for rows.Next() {
+		var status FeedStatus
+		var hashtags hashtagColumns
+		var relays sql.NullString
+		if err := rows.Scan(&status.Entity.PublicKey, &status.Entity.URL, &status.Entity.Nitter, &hashtags.inContent, &hashtags.max, &relays, &status.Disabled,
+			&status.NextFetchAt, &status.LastFetchAt, &status.LastError, &status.ErrorCount, &status.EventCount); err != nil {
+			return nil, err
+		}
+		status.Entity.Hashtags = hashtags.overrides()
+		if status.Entity.Relays, err = relayOverrides(relays); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, rows.Err()
+}
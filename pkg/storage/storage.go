@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/scripts"
+	"strings"
+)
+
+// ErrFeedNotFound is returned when no feed is registered with the requested key.
+var ErrFeedNotFound = errors.New("feed not found")
+
+// ScheduledFeed is a registered feed along with the validators of its last fetch.
+type ScheduledFeed struct {
+	Entity     feed.Entity
+	Validators feed.Validators
+}
+
+// FeedStatus is a registered feed, without its private key, along with the
+// outcome of its last fetch and the number of events stored for it.
+type FeedStatus struct {
+	Entity      feed.Entity
+	Disabled    bool
+	NextFetchAt int64
+	// LastFetchAt is zero for feeds never fetched.
+	LastFetchAt int64
+	// LastError is empty if the last fetch succeeded.
+	LastError string
+	// ErrorCount is the number of consecutive failed fetches.
+	ErrorCount int
+	EventCount int
+}
+
+// FeedStats counts the registered feeds by state.
+type FeedStats struct {
+	Total        int
+	Disabled     int
+	Failing      int
+	NeverFetched int
+}
+
+// Storage persists the registered feeds and the events generated for them.
+type Storage interface {
+	// Migrate applies the pending schema migrations and returns them.
+	Migrate() ([]scripts.Migration, error)
+	// MigrationsStatus lists every schema migration along with whether it was applied.
+	MigrationsStatus() ([]scripts.MigrationStatus, error)
+	Close() error
+
+	CountFeeds() (uint64, error)
+	// RandomFeeds returns up to limit feeds picked at random.
+	RandomFeeds(limit int) ([]feed.Entity, error)
+	// SearchFeeds returns up to limit feeds whose url contains the query.
+	SearchFeeds(query string, limit int) ([]feed.Entity, error)
+	// GetFeed returns the feed of a public key or ErrFeedNotFound.
+	GetFeed(pubKey string) (feed.Entity, error)
+	// ListFeeds returns up to limit feeds ordered by public key, starting
+	// after the cursor, which is the public key of the last feed of the
+	// previous page or empty for the first one.
+	ListFeeds(cursor string, limit int) ([]feed.Entity, error)
+	// FeedsOf returns the feeds registered with any of the public keys,
+	// ordered by url.
+	FeedsOf(pubKeys []string) ([]feed.Entity, error)
+	// FindFeedByURL returns the first feed whose url contains the text or ErrFeedNotFound.
+	FindFeedByURL(text string) (feed.Entity, error)
+	// InsertFeed registers a feed, returning false if its public key already was.
+	InsertFeed(entity feed.Entity) (bool, error)
+	SetFeedNitter(pubKey string, nitter bool) error
+	// SetFeedHashtags replaces the hashtag settings of a feed, returning
+	// ErrFeedNotFound if no feed is registered with the public key.
+	SetFeedHashtags(pubKey string, overrides feed.HashtagOverrides) error
+	// SetFeedRelays replaces the relays the events of a feed are replayed
+	// to, nil meaning the instance defaults, returning ErrFeedNotFound if no
+	// feed has the public key.
+	SetFeedRelays(pubKey string, relays []string) error
+	// SetFeedSiteImage records the image shared by the site of a feed and
+	// when it was checked.
+	SetFeedSiteImage(pubKey string, image string, checkedAt int64) error
+	// DeleteFeed removes the feeds with the given url along with their events.
+	DeleteFeed(url string) error
+
+	// GetFeedStatus returns the status of the feed of a public key or ErrFeedNotFound.
+	GetFeedStatus(pubKey string) (FeedStatus, error)
+	// ListFeedStatuses pages through the feed statuses like ListFeeds.
+	ListFeedStatuses(cursor string, limit int) ([]FeedStatus, error)
+	// SearchFeedStatuses returns up to limit feed statuses whose url contains the query.
+	SearchFeedStatuses(query string, limit int) ([]FeedStatus, error)
+	// FailingFeeds returns up to limit feeds whose last fetch failed, the ones
+	// failing for longer first.
+	FailingFeeds(limit int) ([]FeedStatus, error)
+	FeedStats() (FeedStats, error)
+	// SetFeedDisabled stops or resumes the fetches of a feed, returning
+	// ErrFeedNotFound if no feed is registered with the public key.
+	SetFeedDisabled(pubKey string, disabled bool) error
+	// RecordFetch records when a feed was fetched and the error it failed
+	// with, if any.
+	RecordFetch(pubKey string, fetchedAt int64, fetchErr error) error
+
+	// DueFeeds claims up to limit enabled feeds whose next fetch is scheduled
+	// at or before now, postponing it to leaseUntil so other instances sharing
+	// the database leave them alone until they are scheduled again.
+	DueFeeds(now int64, limit int, leaseUntil int64) ([]ScheduledFeed, error)
+	// PendingFeeds returns the enabled feeds of the given public keys that were never fetched.
+	PendingFeeds(pubKeys []string) ([]ScheduledFeed, error)
+	// ScheduleFeed records the validators of the last fetch of a feed and when to fetch it again.
+	ScheduleFeed(pubKey string, nextFetchAt int64, validators feed.Validators) error
+
+	// EnqueueDeliveries queues the events to be sent to each of the relays,
+	// skipping the ones already queued for a relay, and returns the ones
+	// queued. They are claimed until leaseUntil, like DueDeliveries does, for
+	// the caller to send them right away.
+	EnqueueDeliveries(eventIDs []string, relays []string, now int64, leaseUntil int64) ([]DeliveryRecord, error)
+	// DueDeliveries claims up to limit pending deliveries whose next attempt
+	// is at or before now, the longest waiting first, skipping the ones to the
+	// given relays. Their next attempt is postponed to leaseUntil, so other
+	// instances sharing the database leave them alone until it is recorded.
+	DueDeliveries(now int64, limit int, skipRelays []string, leaseUntil int64) ([]Delivery, error)
+	// ReleaseDelivery gives back a claimed delivery that wasn't attempted,
+	// due again at nextAttemptAt.
+	ReleaseDelivery(eventID string, relay string, nextAttemptAt int64) error
+	// RecordDeliveryAttempt records the outcome of sending a queued event.
+	RecordDeliveryAttempt(attempt DeliveryAttempt) error
+	// ListDeliveries returns up to limit deliveries matching the filter, the
+	// most recently attempted first.
+	ListDeliveries(filter DeliveryFilter, limit int) ([]DeliveryRecord, error)
+	// RelayDeliveryStats counts the deliveries of each relay by status and
+	// outcome of their last attempt.
+	RelayDeliveryStats() ([]RelayDeliveryStats, error)
+	// CountDeliveries counts the queued deliveries by status.
+	CountDeliveries() (map[string]int, error)
+	// PruneDeliveries deletes the deliveries no longer pending last attempted
+	// before the given time, returning how many were deleted.
+	PruneDeliveries(before int64) (int64, error)
+
+	// UseAuthEvent records the id of a NIP-98 auth event as used until
+	// expiresAt, forgetting the ones expired by now, and returns false if it
+	// already was, so each event authorizes a single request to any of the
+	// instances sharing the database.
+	UseAuthEvent(id string, now int64, expiresAt int64) (bool, error)
+
+	// SaveEvent persists a signed event generated for a feed.
+	// It returns true only if the event was not stored before, so callers can
+	// tell apart new events from the ones already served.
+	// Metadata events and relay lists are replaceable: a new one replaces the
+	// previous one of the same public key unless its content and tags are
+	// unchanged.
+	SaveEvent(evt *nostr.Event) (bool, error)
+	// QueryEvents retrieves the stored events matching the ids, authors, kinds,
+	// tags and time range of the given filter, newest first and no more than
+	// its limit, if any.
+	QueryEvents(filter *nostr.Filter) ([]nostr.Event, error)
+}
+
+// Open connects to the database of the datasource name: PostgreSQL for
+// postgres:// and postgresql:// URLs, SQLite for anything else.
+func Open(dsn string) (Storage, error) {
+	if IsPostgres(dsn) {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgres(db), nil
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLite(db), nil
+}
+
+// IsPostgres tells whether the datasource name points to a PostgreSQL database.
+func IsPostgres(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// sqlStorage implements Storage with SQL understood by both SQLite and
+// PostgreSQL, so the backends only differ in their driver and migrations.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (s *sqlStorage) Migrate() ([]scripts.Migration, error) {
+	return scripts.MigrateUp(s.db, s.dialect)
+}
+
+func (s *sqlStorage) MigrationsStatus() ([]scripts.MigrationStatus, error) {
+	return scripts.MigrationsStatus(s.db, s.dialect)
+}
+
+// skipLocked locks the rows of the table selected by the query until the end
+// of its transaction, skipping the ones locked by other instances. SQLite has
+// a single writer and no row locks, so it needs none.
+func (s *sqlStorage) skipLocked(table string) string {
+	if s.dialect != scripts.Postgres {
+		return ""
+	}
+	return " FOR UPDATE OF " + table + " SKIP LOCKED"
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,24 @@
+// Package storagetest provides the storage the tests of other packages run
+// against.
+package storagetest
+
+import (
+	"github.com/piraces/rsslay/pkg/storage"
+	"path/filepath"
+	"testing"
+)
+
+// Open returns a migrated SQLite database in a temporary file, opened as the
+// relay does, and closes it when the test finishes.
+func Open(t testing.TB) storage.Storage {
+	t.Helper()
+	store, err := storage.Open(filepath.Join(t.TempDir(), "rsslay.sqlite"))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a test database", err)
+	}
+	if _, err := store.Migrate(); err != nil {
+		t.Fatalf("an error '%s' was not expected when creating the test schema", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
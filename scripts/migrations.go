@@ -0,0 +1,231 @@
+package scripts
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialects with their own set of migrations, named after their directory.
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+)
+
+// migrationsLockID identifies the PostgreSQL advisory lock taken while
+// migrating, so instances sharing a database don't migrate it at once.
+const migrationsLockID = 4_520_117_813
+
+// executor runs statements on a database or on one of its connections.
+type executor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+const createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+   version INTEGER PRIMARY KEY,
+   name TEXT NOT NULL,
+   applied_at INTEGER NOT NULL
+)`
+
+// Migration is a numbered schema change embedded from the migrations directory
+// of a dialect. Files are named after their version and a short description,
+// e.g. 0002_add_index.sql, and every dialect has the same versions.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus tells whether a migration has been applied to a database and when.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrations returns every embedded migration of the dialect sorted by version.
+func Migrations(dialect string) ([]Migration, error) {
+	directory := "migrations/" + dialect
+	entries, err := fs.ReadDir(migrationFiles, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		fileName := entry.Name()
+		version, name, found := strings.Cut(strings.TrimSuffix(fileName, ".sql"), "_")
+		number, err := strconv.Atoi(version)
+		if !found || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, directory+"/"+fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: number, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicated migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// MigrationsStatus lists every embedded migration along with whether it was applied.
+func MigrationsStatus(db *sql.DB, dialect string) ([]MigrationStatus, error) {
+	return migrationsStatus(context.Background(), db, dialect)
+}
+
+func migrationsStatus(ctx context.Context, db executor, dialect string) ([]MigrationStatus, error) {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, createMigrationsTableSQL); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i].Migration = migration
+		if appliedAt, ok := applied[migration.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = time.Unix(appliedAt, 0)
+		}
+	}
+
+	return statuses, nil
+}
+
+// MigrateUp applies, in order and each one in its own transaction, the
+// migrations still pending on the database and returns them.
+// On PostgreSQL it holds an advisory lock meanwhile, so instances starting
+// together wait for the first one to migrate and then find nothing pending.
+func MigrateUp(db *sql.DB, dialect string) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if dialect == Postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+			return nil, fmt.Errorf("cannot lock the database to migrate it: %w", err)
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLockID)
+	}
+
+	if dialect == SQLite {
+		migrations, err := Migrations(dialect)
+		if err != nil {
+			return nil, err
+		}
+		if err := upgradeLegacySchema(ctx, conn, migrations[0]); err != nil {
+			return nil, fmt.Errorf("cannot migrate schema from previous versions: %w", err)
+		}
+	}
+
+	statuses, err := migrationsStatus(ctx, conn, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []Migration
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+		if err := applyMigration(ctx, conn, status.Migration); err != nil {
+			return migrated, fmt.Errorf("migration %04d_%s failed: %w", status.Version, status.Name, err)
+		}
+		migrated = append(migrated, status.Migration)
+	}
+
+	return migrated, nil
+}
+
+func applyMigration(ctx context.Context, db executor, migration Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, migration.Version, migration.Name, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, db executor) (map[int]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// upgradeLegacySchema records the initial migration as applied to databases
+// created by the releases before migrations were versioned, whose feeds table
+// is that schema, so the following migrations bring them up to date.
+func upgradeLegacySchema(ctx context.Context, db executor, initial Migration) error {
+	if _, err := db.ExecContext(ctx, `SELECT version FROM schema_migrations LIMIT 1`); err == nil {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, `SELECT publickey FROM feeds LIMIT 1`); err != nil {
+		return nil
+	}
+
+	// the releases before the nitter column added it when starting up
+	if _, err := db.ExecContext(ctx, checkNitterColumnSQL); err != nil {
+		if _, err := db.ExecContext(ctx, createNitterColumnSQL); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, createMigrationsTableSQL); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, initial.Version, initial.Name, time.Now().Unix())
+	return err
+}
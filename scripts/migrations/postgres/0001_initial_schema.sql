@@ -4,4 +4,3 @@ CREATE TABLE IF NOT EXISTS feeds (
    url TEXT NOT NULL,
    nitter INTEGER DEFAULT 0
 );
-
@@ -0,0 +1,20 @@
+ALTER TABLE feeds ADD COLUMN next_fetch_at BIGINT DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN etag TEXT;
+ALTER TABLE feeds ADD COLUMN last_modified TEXT;
+ALTER TABLE feeds ADD COLUMN content_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS feeds_next_fetch_at_idx ON feeds (next_fetch_at);
+
+CREATE TABLE IF NOT EXISTS events (
+   id VARCHAR(64) PRIMARY KEY,
+   pubkey VARCHAR(64) NOT NULL,
+   created_at BIGINT NOT NULL,
+   kind INTEGER NOT NULL,
+   tags TEXT NOT NULL,
+   content TEXT NOT NULL,
+   sig VARCHAR(128) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_pubkey_idx ON events (pubkey);
+CREATE INDEX IF NOT EXISTS events_kind_idx ON events (kind);
+CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at);
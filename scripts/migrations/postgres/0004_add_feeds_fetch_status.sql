@@ -0,0 +1,4 @@
+ALTER TABLE feeds ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN last_fetch_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN last_error TEXT;
+ALTER TABLE feeds ADD COLUMN error_count INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS event_tags (
+   event_id VARCHAR(64) NOT NULL,
+   name TEXT NOT NULL,
+   value TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS event_tags_name_value_idx ON event_tags (name, value);
+CREATE INDEX IF NOT EXISTS event_tags_event_id_idx ON event_tags (event_id);
+
+INSERT INTO event_tags (event_id, name, value)
+SELECT events.id, json_extract(tag.value, '$[0]'), json_extract(tag.value, '$[1]')
+FROM events, json_each(events.tags) AS tag
+WHERE json_array_length(tag.value) >= 2;
@@ -0,0 +1,2 @@
+ALTER TABLE feeds ADD COLUMN hashtags_in_content INTEGER;
+ALTER TABLE feeds ADD COLUMN max_hashtags INTEGER;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox (
+   event_id VARCHAR(64) NOT NULL,
+   relay TEXT NOT NULL,
+   status TEXT NOT NULL DEFAULT 'pending',
+   attempts INTEGER NOT NULL DEFAULT 0,
+   next_attempt_at INTEGER NOT NULL DEFAULT 0,
+   last_error TEXT,
+   updated_at INTEGER NOT NULL DEFAULT 0,
+   PRIMARY KEY (event_id, relay)
+);
+
+CREATE INDEX IF NOT EXISTS outbox_status_next_attempt_at_idx ON outbox (status, next_attempt_at);
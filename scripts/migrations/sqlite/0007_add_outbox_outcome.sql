@@ -0,0 +1,2 @@
+ALTER TABLE outbox ADD COLUMN outcome TEXT;
+CREATE INDEX IF NOT EXISTS outbox_updated_at_idx ON outbox (updated_at);
@@ -0,0 +1,2 @@
+ALTER TABLE feeds ADD COLUMN site_image TEXT;
+ALTER TABLE feeds ADD COLUMN site_image_checked_at INTEGER NOT NULL DEFAULT 0;
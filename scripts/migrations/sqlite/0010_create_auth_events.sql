@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS auth_events (
+   id VARCHAR(64) PRIMARY KEY,
+   expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS auth_events_expires_at_idx ON auth_events (expires_at);
@@ -0,0 +1,132 @@
+package scripts
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a test database", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestMigrationsAreSortedAndUnique(t *testing.T) {
+	for _, dialect := range []string{SQLite, Postgres} {
+		migrations, err := Migrations(dialect)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, migrations)
+		for i, migration := range migrations {
+			assert.Equal(t, i+1, migration.Version)
+			assert.NotEmpty(t, migration.Name)
+			assert.NotEmpty(t, migration.SQL)
+		}
+	}
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqliteMigrations, err := Migrations(SQLite)
+	assert.NoError(t, err)
+	postgresMigrations, err := Migrations(Postgres)
+	assert.NoError(t, err)
+
+	assert.Len(t, postgresMigrations, len(sqliteMigrations))
+	for i := range sqliteMigrations {
+		assert.Equal(t, sqliteMigrations[i].Version, postgresMigrations[i].Version)
+		assert.Equal(t, sqliteMigrations[i].Name, postgresMigrations[i].Name)
+	}
+}
+
+func TestMigrateUpAppliesPendingMigrationsOnce(t *testing.T) {
+	db := openTestDatabase(t)
+	migrations, err := Migrations(SQLite)
+	assert.NoError(t, err)
+
+	applied, err := MigrateUp(db, SQLite)
+	assert.NoError(t, err)
+	assert.Equal(t, migrations, applied)
+
+	applied, err = MigrateUp(db, SQLite)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	statuses, err := MigrationsStatus(db, SQLite)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, len(migrations))
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+}
+
+func TestMigrationsStatusReportsPendingMigrations(t *testing.T) {
+	db := openTestDatabase(t)
+
+	statuses, err := MigrationsStatus(db, SQLite)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.False(t, status.Applied)
+	}
+}
+
+func TestMigrateUpUpgradesLegacyDatabase(t *testing.T) {
+	db := openTestDatabase(t)
+	_, err := db.Exec(`CREATE TABLE feeds (publickey VARCHAR(64) PRIMARY KEY, privatekey VARCHAR(64) NOT NULL, url TEXT NOT NULL)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO feeds (publickey, privatekey, url) VALUES ('pub', 'priv', 'https://example.com/rss')`)
+	assert.NoError(t, err)
+
+	_, err = MigrateUp(db, SQLite)
+	assert.NoError(t, err)
+
+	var nitter bool
+	var nextFetchAt int64
+	row := db.QueryRow(`SELECT nitter, next_fetch_at FROM feeds WHERE publickey = 'pub'`)
+	assert.NoError(t, row.Scan(&nitter, &nextFetchAt))
+	assert.False(t, nitter)
+	assert.Zero(t, nextFetchAt)
+
+	_, err = db.Exec(`SELECT etag, last_modified, content_hash FROM feeds`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`SELECT id FROM events`)
+	assert.NoError(t, err)
+
+	statuses, err := MigrationsStatus(db, SQLite)
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+	}
+}
+
+func TestEventTagsMigrationIndexesExistingEvents(t *testing.T) {
+	db := openTestDatabase(t)
+	migrations, err := Migrations(SQLite)
+	assert.NoError(t, err)
+	for _, migration := range migrations[:2] {
+		_, err := db.Exec(migration.SQL)
+		assert.NoError(t, err)
+	}
+	_, err = db.Exec(`INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig) VALUES ('id', 'pub', 1, 1, '[["t","nostr"],["proxy","https://example.com/rss","rss"],["single"]]', '', '')`)
+	assert.NoError(t, err)
+
+	_, err = db.Exec(migrations[2].SQL)
+	assert.NoError(t, err)
+
+	rows, err := db.Query(`SELECT name, value FROM event_tags WHERE event_id = 'id' ORDER BY name`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var tags [][]string
+	for rows.Next() {
+		var name, value string
+		assert.NoError(t, rows.Scan(&name, &value))
+		tags = append(tags, []string{name, value})
+	}
+	assert.Equal(t, [][]string{{"proxy", "https://example.com/rss"}, {"t", "nostr"}}, tags)
+}
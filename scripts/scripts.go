@@ -1,12 +1,15 @@
 package scripts
 
-import _ "embed"
+import (
+	"embed"
+	_ "embed"
+)
 
-//go:embed schema.sql
-var SchemaSQL string
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
 
 //go:embed check_nitter_column.sql
-var CheckNitterColumnSQL string
+var checkNitterColumnSQL string
 
 //go:embed create_nitter_column.sql
-var CreateNitterColumnSQL string
+var createNitterColumnSQL string
@@ -4,6 +4,8 @@ const rsslayRelaysStorageKey = "rsslay.relays";
 const loginButton = document.getElementById('login');
 const logoutButton = document.getElementById('logout');
 const loginButtonText = document.getElementById('login-text');
+const exportFollows = document.getElementById('export-follows');
+const exportFollowsLink = document.getElementById('export-follows-link');
 
 let pubKey;
 let relays;
@@ -240,6 +242,9 @@ async function performLogout() {
     logoutButton.disabled = true;
     logoutButton.removeEventListener('click', performLogout);
     sessionStorage.clear();
+    if (exportFollows) {
+        exportFollows.classList.add('is-hidden');
+    }
     subs.unsub();
     pool.close([...relaysUrls]);
 }
@@ -250,5 +255,9 @@ function afterLogin() {
     loginButtonText.textContent = "Logged in!";
     logoutButton.disabled = false;
     logoutButton.addEventListener('click', performLogout);
+    if (exportFollows) {
+        exportFollowsLink.href = `/api/follows/${pubKey}`;
+        exportFollows.classList.remove('is-hidden');
+    }
     connectToRelays();
 }
\ No newline at end of file